@@ -4,10 +4,12 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"net/http"
 	"os"
 	"path/filepath"
 	"primehub-monitoring-agent/monitoring"
+	"sort"
+	"strings"
 	"syscall"
 	"time"
 
@@ -15,12 +17,78 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+type Options struct {
+	UpdateInterval  int
+	FlushInterval   int
+	Path            string
+	Tiers           []monitoring.TierConfig
+	GpuBackend      string
+	GpuPollInterval time.Duration
+	Policies        monitoring.AggregationPolicies
+	Envelopes       bool
+
+	// the flush file is written to the first writable path of Path and FallbackPaths
+	FallbackPaths []string
+	WriteRetries  int
+	WriteBackoff  time.Duration
+
+	// Outputs are the sinks of the reports: file for the flush file, tiers for a file per tier in TiersDir,
+	// legacy for the layout before the schema version in LegacyPath, and binary for the binary encoding in BinaryPath
+	Outputs     []string
+	TiersDir    string
+	AppendTiers []string
+	LegacyPath  string
+	BinaryPath  string
+
+	// every raw sample is appended to the journal if JournalPath is set
+	JournalPath       string
+	JournalMaxSize    int64
+	JournalMaxAge     time.Duration
+	JournalCompress   bool
+	JournalMaxBackups int
+
+	// the records of every ArchivePeriod are sealed into a file in ArchiveDir if it is set
+	ArchiveDir    string
+	ArchivePeriod time.Duration
+
+	// the latest record is served at /metrics in the Prometheus format on ListenAddress if it is set,
+	// labeled by JobName, and the records of a time range at /query in JSON
+	ListenAddress string
+	JobName       string
+
+	// every sample is pushed to RemoteWriteURL by the Prometheus remote_write protocol if it is set,
+	// labeled by JobName and RemoteWriteLabels
+	RemoteWriteURL           string
+	RemoteWriteLabels        map[string]string
+	RemoteWriteBatchSize     int
+	RemoteWriteBatchDeadline time.Duration
+	RemoteWriteQueueSize     int
+	RemoteWriteRetries       int
+
+	// the gauges and the summary of the job are pushed to PushgatewayURL on every flush if it is set,
+	// the group of the job is deleted after PushgatewayDeleteAfter once the agent stops if it is positive
+	PushgatewayURL         string
+	PushgatewayDeleteAfter time.Duration
+
+	// the agent exits within ShutdownTimeout once it is stopped, the pending pushgateway delete is abandoned after it
+	ShutdownTimeout time.Duration
+
+	// the gauges of the latest record are written into a *.prom file in TextfileDir if it is set, the directory of
+	// the textfile collector of node_exporter, labeled by JobName and PodName
+	TextfileDir string
+	PodName     string
+
+	// the buffers are checkpointed to StatePath, and restored from it or the flush file on start
+	StatePath          string
+	CheckpointInterval int
+	Restore            bool
+}
+
 type Monitor struct {
-	updateInterval int
+	options        Options
 	updateTime     time.Time
-	flushInterval  int
 	flushTime      time.Time
-	path           string
+	checkpointTime time.Time
 	flush          chan struct{}
 	stop           chan struct{}
 	stopped        chan struct{}
@@ -28,90 +96,241 @@ type Monitor struct {
 	cpuCollector monitoring.CpuMemoryCollector
 	gpuCollector monitoring.GpuMemoryCollector
 
-	metrics     *monitoring.Metrics
-	lifetimeMax int
+	metrics *monitoring.Metrics
+	sinks   *monitoring.SinkPipeline
+	journal *monitoring.Journal
+	archive *monitoring.Archive
+	server  *http.Server
+	remote  *monitoring.RemoteWriter
+
+	// deletes the group of the job after the other outputs are closed
+	pushgateway *monitoring.PushgatewaySink
 }
 
+// the default terminationGracePeriodSeconds of a pod
+const defaultShutdownTimeout = 30 * time.Second
+
+const (
+	outputFile   = "file"
+	outputTiers  = "tiers"
+	outputLegacy = "legacy"
+	outputBinary = "binary"
+)
+
 var (
 	context *daemon.Context
 	monitor *Monitor
 )
 
-func NewMonitor(updateInterval int, path string, lifetimeMax int, flushPeriod int) *Monitor {
+func NewMonitor(options Options) *Monitor {
 	m := Monitor{
-		updateInterval: updateInterval,
-		path:           path,
-		lifetimeMax:    lifetimeMax,
-		flushInterval:  flushPeriod,
+		options: options,
 	}
 	m.Init()
 	return &m
 }
 
 func (m *Monitor) updateMetrics() {
-	updatePoint := time.Now().Add(-time.Duration(m.updateInterval) * time.Second)
+	updatePoint := time.Now().Add(-time.Duration(m.options.UpdateInterval) * time.Second)
 	if m.updateTime.After(updatePoint) {
 		return
 	}
 	m.updateTime = time.Now()
 	log.Debugf("updateMetrics %v", m.updateTime)
-	m.metrics.Add(m.buildRecord(m.updateTime.Unix()))
+	// fetch before checking the staleness, so a gpu sampled only by Fetch recovers once the backend responds again
+	record, ok := m.buildRecord(m.updateTime.Unix())
+	stale := false
+	if m.cpuCollector.IsStale() {
+		log.Warnf("The cpu usage is stale since %v, record a gap", m.cpuCollector.LastUpdated())
+		stale = true
+	}
+	if m.gpuCollector.IsStale() {
+		log.Warnf("The gpu usage is stale since %v, record a gap", m.gpuCollector.LastSampled())
+		stale = true
+	} else if !ok {
+		log.Warnf("Cannot read the gpu usage, record a gap")
+		stale = true
+	}
+	if stale {
+		m.metrics.AddGap(m.updateTime.Unix())
+		m.export(monitoring.NewGapRecord(m.updateTime.Unix()))
+		return
+	}
+	m.metrics.Add(record)
+	m.export(record)
+}
+
+// export passes the raw sample to the journal and the remote write
+func (m *Monitor) export(record monitoring.Record) {
+	if m.journal != nil {
+		if err := m.journal.Append(record); err != nil {
+			log.Warnf("Cannot append to journal %s: %v", m.journal.Path, err)
+		}
+	}
+	if m.remote != nil {
+		m.remote.Append(record)
+	}
 }
 
-func (m *Monitor) buildRecord(updateTime int64) monitoring.Record {
+// buildRecord fetches the usage of the collectors, it is not ok if no gpu sample succeeded in the interval
+func (m *Monitor) buildRecord(updateTime int64) (monitoring.Record, bool) {
 	cpu := m.cpuCollector.Fetch()
 	gpuRecords := make([]monitoring.GPURecord, m.gpuCollector.NumDevices)
 	record := monitoring.Record{
 		Timestamp:      updateTime,
 		CpuUtilization: cpu.Utilization,
+		CpuMillicores:  cpu.UtilizationMilli,
 		MemoryUsed:     cpu.Memory,
 		GPURecords:     gpuRecords,
 	}
 
 	if m.gpuCollector.Available {
 		r := m.gpuCollector.Fetch()
+		if r.GPU == nil {
+			return record, false
+		}
 		for i := 0; i < m.gpuCollector.NumDevices; i++ {
 			gpuRecords[i] = monitoring.GPURecord{
-				Index:          r.GPU[i].Index,
-				GPUUtilization: r.GPU[i].Utilization,
-				MemoryUsed:     r.GPU[i].Memory,
+				Index:               r.GPU[i].Index,
+				GPUUtilization:      r.GPU[i].Utilization,
+				GPUUtilizationMilli: r.GPU[i].UtilizationMilli,
+				GPUUtilizationMax:   r.GPU[i].UtilizationMax,
+				MemoryUsed:          r.GPU[i].Memory,
+				Power:               r.GPU[i].Power,
+				Temperature:         r.GPU[i].Temperature,
 			}
 		}
 	}
 
 	if log.GetLevel() == log.DebugLevel {
-		log.Debugf("[BuildRecord] CPU: %d, MemoryUsed: %d", record.CpuUtilization, record.MemoryUsed)
+		log.Debugf("[BuildRecord] CPU: %dm, MemoryUsed: %d", record.CpuMillicores, record.MemoryUsed)
 		for i := 0; i < len(record.GPURecords); i++ {
-			log.Debugf("[BuildRecord] GPU[%d], GPUUtilization: %d, MemoryUsed: %d",
-				record.GPURecords[i].Index, record.GPURecords[i].GPUUtilization, record.GPURecords[i].MemoryUsed)
+			log.Debugf("[BuildRecord] GPU[%d], GPUUtilization: %d, GPUUtilizationMax: %d, MemoryUsed: %d",
+				record.GPURecords[i].Index, record.GPURecords[i].GPUUtilization, record.GPURecords[i].GPUUtilizationMax, record.GPURecords[i].MemoryUsed)
 		}
 	}
-	return record
+	return record, true
 }
 
-func (m *Monitor) flushToFile() {
-	flushPoint := time.Now().Add(-time.Duration(m.flushInterval) * time.Second)
-	if m.flushTime.After(flushPoint) {
+// flushToSinks publishes the report to the sinks, force skips the flush interval, e.g., on stop
+func (m *Monitor) flushToSinks(force bool) {
+	flushPoint := time.Now().Add(-time.Duration(m.options.FlushInterval) * time.Second)
+	if !force && m.flushTime.After(flushPoint) {
 		return
 	}
 
-	log.Debugf("[FlushRecord] Path: %s", m.path)
+	log.Debug("[FlushRecord]")
 	m.flushTime = time.Now()
-	report := monitoring.Monitoring{
-		Spec: monitoring.Spec{
-			MemoryTotal: m.cpuCollector.MemoryTotal,
-			GPUSpec:     m.gpuCollector.Devices,
-		},
-		Datasets: monitoring.Datasets{
-			FifteenMinutes: m.metrics.FifteenMinutes.LastAvailable(),
-			OneHour:        m.metrics.OneHour.LastAvailable(),
-			ThreeHours:     m.metrics.ThreeHours.LastAvailable(),
-			LifeTime:       m.metrics.LifeTime.LastAvailable(),
-		},
-	}
-
-	output, _ := json.Marshal(report)
-	ioutil.WriteFile(m.path, output, 0644)
+	report := monitoring.NewMonitoring(m.spec(), m.metrics.Snapshot())
+	m.sinks.Publish(report)
+}
+
+func (m *Monitor) spec() monitoring.Spec {
+	return monitoring.Spec{
+		MemoryTotal: m.cpuCollector.MemoryTotal,
+		GPUSpec:     m.gpuCollector.Devices,
+	}
+}
+
+// sealArchive seals the ended periods, and the current one up to now if partial is set
+func (m *Monitor) sealArchive(partial bool) {
+	if m.archive == nil {
+		return
+	}
+	seal := m.archive.Seal
+	if partial {
+		seal = m.archive.SealPartial
+	}
+	if err := seal(m.metrics, m.spec()); err != nil {
+		log.Warnf("Cannot seal archive in %s: %v", m.archive.Dir, err)
+	}
+}
+
+func (m *Monitor) newSinks() *monitoring.SinkPipeline {
+	sinks := make([]monitoring.Sink, 0)
+	for _, output := range m.options.Outputs {
+		switch output {
+		case outputFile:
+			fileSink := monitoring.NewFileSink(append([]string{m.options.Path}, m.options.FallbackPaths...)...)
+			fileSink.Retries = m.options.WriteRetries
+			fileSink.Backoff = m.options.WriteBackoff
+			sinks = append(sinks, fileSink)
+		case outputTiers:
+			sinks = append(sinks, monitoring.NewTierFileSink(m.options.TiersDir, m.options.AppendTiers...))
+		case outputLegacy:
+			legacySink := monitoring.NewLegacyFileSink(m.options.LegacyPath)
+			legacySink.Retries = m.options.WriteRetries
+			legacySink.Backoff = m.options.WriteBackoff
+			sinks = append(sinks, legacySink)
+		case outputBinary:
+			binarySink := monitoring.NewBinaryFileSink(m.options.BinaryPath)
+			binarySink.Retries = m.options.WriteRetries
+			binarySink.Backoff = m.options.WriteBackoff
+			sinks = append(sinks, binarySink)
+		}
+	}
+	if m.options.PushgatewayURL != "" {
+		m.pushgateway = monitoring.NewPushgatewaySink(m.options.PushgatewayURL, m.options.JobName)
+		m.pushgateway.Started = m.cpuCollector.StartedTime
+		m.pushgateway.DeleteAfter = m.options.PushgatewayDeleteAfter
+		sinks = append(sinks, m.pushgateway)
+	}
+	if m.options.TextfileDir != "" {
+		labels := map[string]string{"phjob_name": m.options.JobName, "pod": m.options.PodName}
+		sinks = append(sinks, monitoring.NewTextfileSink(m.options.TextfileDir, m.options.JobName, labels))
+	}
+	return monitoring.NewSinkPipeline(sinks...)
+}
+
+func (m *Monitor) checkpoint(force bool) {
+	if m.options.StatePath == "" || m.options.CheckpointInterval <= 0 {
+		return
+	}
+	checkpointPoint := time.Now().Add(-time.Duration(m.options.CheckpointInterval) * time.Second)
+	if !force && m.checkpointTime.After(checkpointPoint) {
+		return
+	}
+
+	log.Debugf("[Checkpoint] Path: %s", m.options.StatePath)
+	m.checkpointTime = time.Now()
+	if err := monitoring.SaveCheckpoint(m.options.StatePath, m.metrics); err != nil {
+		log.Warnf("Cannot checkpoint to %s: %v", m.options.StatePath, err)
+	}
+}
+
+// restore the buffers from the checkpoint, or the existing flush file if there is no checkpoint
+func (m *Monitor) restore() {
+	if !m.options.Restore {
+		return
+	}
+
+	if m.options.StatePath != "" {
+		checkpoint, err := monitoring.LoadCheckpoint(m.options.StatePath)
+		if err == nil {
+			err = m.metrics.Restore(checkpoint)
+			if err == nil {
+				log.Infof("Restored from checkpoint %s saved at %v", m.options.StatePath, checkpoint.Saved)
+				return
+			}
+		}
+		if !os.IsNotExist(err) {
+			log.Warnf("Cannot restore from checkpoint %s: %v", m.options.StatePath, err)
+		}
+	}
+
+	for _, path := range append([]string{m.options.Path}, m.options.FallbackPaths...) {
+		report, err := monitoring.LoadMonitoring(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			log.Warnf("Cannot restore from %s: %v", path, err)
+			continue
+		}
+		m.metrics.RestoreDatasets(report)
+		log.Infof("Restored from %s", path)
+		return
+	}
 }
 
 func (m *Monitor) Init() {
@@ -120,36 +339,146 @@ func (m *Monitor) Init() {
 	m.stop = make(chan struct{})
 	m.stopped = make(chan struct{})
 
-	m.cpuCollector = monitoring.CpuMemoryCollector{}
+	m.cpuCollector = monitoring.CpuMemoryCollector{UpdateInterval: m.tickInterval()}
 	m.cpuCollector.Start()
-	m.gpuCollector = monitoring.GpuMemoryCollector{}
+	m.gpuCollector = monitoring.GpuMemoryCollector{
+		PollInterval:   m.options.GpuPollInterval,
+		UpdateInterval: time.Duration(m.options.UpdateInterval) * time.Second,
+	}
+	if m.options.GpuBackend != monitoring.GpuBackendAuto {
+		m.gpuCollector.Backend = monitoring.NewGpuBackend(m.options.GpuBackend)
+		if m.gpuCollector.Backend == nil {
+			log.Warnf("Unknown gpu backend %s, fallback to %s", m.options.GpuBackend, monitoring.GpuBackendAuto)
+		}
+	}
 	m.gpuCollector.Start()
 
-	m.metrics = monitoring.NewMetrics(m.lifetimeMax)
+	metrics, err := monitoring.NewMetricsWithTiers(m.options.Tiers)
+	if err != nil {
+		log.Fatal(err)
+	}
+	m.metrics = metrics
+	if m.options.Policies != nil {
+		m.metrics.Policies = m.options.Policies
+	}
+	m.metrics.Envelopes = m.options.Envelopes
+	m.restore()
+	m.sinks = m.newSinks()
+	if m.options.JournalPath != "" {
+		m.journal = monitoring.NewJournal(m.options.JournalPath)
+		m.journal.MaxSize = m.options.JournalMaxSize
+		m.journal.MaxAge = m.options.JournalMaxAge
+		m.journal.Compress = m.options.JournalCompress
+		m.journal.MaxBackups = m.options.JournalMaxBackups
+	}
+	if m.options.ArchiveDir != "" {
+		m.archive = monitoring.NewArchive(m.options.ArchiveDir)
+		m.archive.Period = m.options.ArchivePeriod
+	}
+	if m.options.ListenAddress != "" {
+		m.serve()
+	}
+	if m.options.RemoteWriteURL != "" {
+		labels := map[string]string{"phjob_name": m.options.JobName}
+		for name, value := range m.options.RemoteWriteLabels {
+			labels[name] = value
+		}
+		m.remote = monitoring.NewRemoteWriter(m.options.RemoteWriteURL, m.spec())
+		m.remote.ExternalLabels = labels
+		m.remote.BatchSize = m.options.RemoteWriteBatchSize
+		m.remote.BatchDeadline = m.options.RemoteWriteBatchDeadline
+		m.remote.QueueSize = m.options.RemoteWriteQueueSize
+		m.remote.Retries = m.options.RemoteWriteRetries
+		m.remote.Start()
+	}
+}
+
+func (m *Monitor) serve() {
+	mux := http.NewServeMux()
+	exporter := monitoring.NewExporter(m.metrics, m.spec(), map[string]string{"phjob_name": m.options.JobName})
+	exporter.Sinks = m.sinks
+	mux.Handle("/metrics", exporter)
+	mux.Handle("/query", &monitoring.QueryHandler{Metrics: m.metrics})
+	m.server = &http.Server{Addr: m.options.ListenAddress, Handler: mux}
+	go func() {
+		log.Infof("Serve metrics on %s/metrics and %s/query", m.options.ListenAddress, m.options.ListenAddress)
+		if err := m.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Cannot serve metrics on %s: %v", m.options.ListenAddress, err)
+		}
+	}()
+}
+
+// logSinkStats summarizes the writes of each sink, a sink with failures is logged as a warning
+func (m *Monitor) logSinkStats() {
+	stats := m.sinks.Stats()
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s := stats[name]
+		if s.Errors == 0 && s.FailedAttempts == 0 {
+			log.Infof("Sink %s wrote %d reports, %d dropped", name, s.Writes, s.Dropped)
+			continue
+		}
+		log.Warnf("Sink %s wrote %d reports, %d errors, %d failed attempts, %d dropped, last error: %s",
+			name, s.Writes, s.Errors, s.FailedAttempts, s.Dropped, s.LastError)
+	}
 }
 
 func (m *Monitor) Flush() {
 	m.flush <- struct{}{}
 }
 
+// tickInterval ticks faster for the tiers finer than 5s, the cpu collector reads the usage at the same pace
+func (m *Monitor) tickInterval() time.Duration {
+	interval := monitoring.DefaultCpuUpdateInterval
+	if updateInterval := time.Duration(m.options.UpdateInterval) * time.Second; updateInterval < interval {
+		interval = updateInterval
+	}
+	return interval
+}
+
 func (m *Monitor) Worker() {
 	log.Debug("monitor start")
-	const tickerInterval = 5
-	ticker := time.NewTicker(time.Duration(tickerInterval) * time.Second)
+	ticker := time.NewTicker(m.tickInterval())
 
 	// flush empty data first
-	m.flushToFile()
+	m.flushToSinks(true)
 LOOP:
-	// TODO this might have race-condition
 	for {
 		select {
 		case <-ticker.C:
 			m.updateMetrics()
-			m.flushToFile()
+			m.sealArchive(false)
+			m.flushToSinks(false)
+			m.checkpoint(false)
 		case <-m.flush:
-			m.flushToFile()
+			m.flushToSinks(true)
 		case <-m.stop:
-			m.flushToFile()
+			shutdown := time.Now().Add(m.options.ShutdownTimeout)
+			m.sealArchive(true)
+			m.flushToSinks(true)
+			m.checkpoint(true)
+			// wait for the sinks writing the final report
+			m.sinks.Close()
+			m.logSinkStats()
+			if m.server != nil {
+				m.server.Close()
+			}
+			if m.remote != nil {
+				m.remote.Close()
+				log.Infof("Remote write sent %d records, failed %d, dropped %d", m.remote.Sent(), m.remote.Failed(), m.remote.Dropped())
+			}
+			if m.journal != nil {
+				if err := m.journal.Close(); err != nil {
+					log.Warnf("Cannot close journal %s: %v", m.journal.Path, err)
+				}
+			}
+			if m.pushgateway != nil {
+				m.pushgateway.WaitDelete(shutdown)
+			}
 			break LOOP
 		}
 	}
@@ -173,6 +502,17 @@ func getEnv(key, fallback string) string {
 	return value
 }
 
+// splitList splits the comma-separated values, skipping the empty ones
+func splitList(value string) []string {
+	values := make([]string, 0)
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
 func termHandler(sig os.Signal) error {
 	log.Infof("signal by %v ...", sig)
 	if monitor != nil {
@@ -193,23 +533,145 @@ func flushHandler(sig os.Signal) error {
 	return nil
 }
 
+// convert writes a monitoring document of any version or encoding as the current JSON,
+// e.g., monitoring-agent convert -o monitoring.json monitoring.bin
+func convert(args []string) error {
+	flags := flag.NewFlagSet("convert", flag.ExitOnError)
+	output := flags.String("o", "", "Path of the JSON output (default stdout)")
+	indent := flags.Bool("indent", false, "Indent the JSON output")
+	from := flags.String("from", "", "Keep the records from the unix time in seconds")
+	to := flags.String("to", "", "Keep the records before the unix time in seconds")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s convert [-o output] [-indent] [-from time] [-to time] <input>\n", filepath.Base(os.Args[0]))
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	start, end, err := monitoring.ParseQueryRange(*from, *to)
+	if err != nil {
+		return err
+	}
+	report, err := monitoring.LoadMonitoring(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *from != "" || *to != "" {
+		report = monitoring.QueryMonitoring(report, start, end)
+	}
+	var data []byte
+	if *indent {
+		data, err = json.MarshalIndent(report, "", "  ")
+	} else {
+		data, err = json.Marshal(report)
+	}
+	if err != nil {
+		return err
+	}
+	if *output == "" {
+		_, err = os.Stdout.Write(append(data, '\n'))
+		return err
+	}
+	return monitoring.WriteFileAtomic(*output, data, 0644)
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "convert" {
+		if err := convert(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	var debug bool
 	var isForeground bool
 	var lifetimeMax int
 	var updateInterval int
 	var flushInterval int
+	var gpuBackend string
+	var gpuPollInterval time.Duration
+	var aggregation string
+	var envelopes bool
+	var tiersFlag string
+	var lifetimeAdaptive bool
+	var statePath string
+	var checkpointInterval int
+	var restore bool
+	var fallbackPaths string
+	var writeRetries int
+	var writeBackoff time.Duration
+	var outputs string
+	var tiersDir string
+	var appendTiers string
+	var legacyPath string
+	var binaryPath string
+	var journalPath string
+	var journalMaxSize int64
+	var journalMaxAge time.Duration
+	var journalCompress bool
+	var journalMaxBackups int
+	var archiveDir string
+	var archivePeriod time.Duration
+	var listenAddress string
+	var remoteWriteURL string
+	var remoteWriteLabels string
+	var remoteWriteBatchSize int
+	var remoteWriteBatchDeadline time.Duration
+	var remoteWriteQueueSize int
+	var remoteWriteRetries int
+	var pushgatewayURL string
+	var pushgatewayDeleteAfter time.Duration
+	var shutdownTimeout time.Duration
+	var textfileDir string
 	phJobName := getEnv("PHJOB_NAME", "job-test")
 	flushPath := fmt.Sprintf("/phfs/jobArtifacts/%s/.metadata/monitoring", phJobName)
 
 	flag.BoolVar(&debug, "debug", false, "Enable debug mod")
 	flag.BoolVar(&isForeground, "D", false, "Run the agent in foreground")
 	flag.StringVar(&flushPath, "path", flushPath, "Path of flush file")
-	flag.IntVar(&updateInterval, "updateInterval", 10, "Interval seconds of update metrics")
+	flag.IntVar(&updateInterval, "updateInterval", 10, "Interval seconds of update metrics, the resolution of the finest tier")
 	flag.IntVar(&flushInterval, "flushInterval", 10, "Interval seconds of flushing metrics to file")
+	flag.StringVar(&fallbackPaths, "fallback-paths", "", "Comma-separated paths of flush file used in order when the path is not writable (default 'monitoring' in the working directory)")
+	flag.IntVar(&writeRetries, "write-retries", monitoring.DefaultWriteRetries, "Retries of a failed write before the next fallback path")
+	flag.DurationVar(&writeBackoff, "write-backoff", monitoring.DefaultWriteBackoff, "Backoff before the first retry of a failed write, doubled for each retry")
+	flag.StringVar(&outputs, "output", outputFile, "Comma-separated outputs: file for the flush file, tiers for a file per tier, legacy for the layout before the schema version, binary for the binary encoding")
+	flag.StringVar(&legacyPath, "legacy-path", "", "Path of the legacy output (default <path>.legacy)")
+	flag.StringVar(&binaryPath, "binary-path", "", "Path of the binary output (default <path>.bin)")
+	flag.StringVar(&tiersDir, "tiers-dir", "", "Directory of the tiers output (default <path>.tiers)")
+	flag.StringVar(&appendTiers, "append-tiers", "", "Comma-separated tiers written as append-only JSON lines by the tiers output, e.g., 15m")
+	flag.StringVar(&journalPath, "journal", "", "Path of the journal appending every raw sample as a JSON line, e.g., /phfs/jobArtifacts/<job>/monitoring.jsonl, empty to disable")
+	flag.Int64Var(&journalMaxSize, "journal-max-size", monitoring.DefaultJournalMaxSize, "Bytes of the journal before it is rotated")
+	flag.DurationVar(&journalMaxAge, "journal-max-age", monitoring.DefaultJournalMaxAge, "Age of the first sample in the journal before it is rotated, 0 to disable")
+	flag.BoolVar(&journalCompress, "journal-compress", true, "Compress the rotated journal segments by gzip")
+	flag.IntVar(&journalMaxBackups, "journal-max-backups", 0, "Max rotated journal segments kept, 0 to keep all")
+	flag.StringVar(&archiveDir, "archive-dir", "", "Directory of the archives sealing the records of every period with an index, e.g., /phfs/jobArtifacts/<job>/.metadata/archive, empty to disable")
+	flag.DurationVar(&archivePeriod, "archive-period", monitoring.DefaultArchivePeriod, "Period of each archive, aligned to the multiples since the epoch")
+	flag.StringVar(&listenAddress, "listen", "", "Address serving the latest metrics at /metrics in the Prometheus format, e.g., :9100, empty to disable")
+	flag.StringVar(&remoteWriteURL, "remote-write-url", "", "URL of the Prometheus remote_write endpoint every sample is pushed to, empty to disable")
+	flag.StringVar(&remoteWriteLabels, "remote-write-labels", "", "Comma-separated external labels of the remote write besides phjob_name, e.g., cluster=a")
+	flag.IntVar(&remoteWriteBatchSize, "remote-write-batch-size", monitoring.DefaultRemoteWriteBatchSize, "Max sampled records in a remote write request")
+	flag.DurationVar(&remoteWriteBatchDeadline, "remote-write-batch-deadline", monitoring.DefaultRemoteWriteBatchDeadline, "Max time the sampled records wait for a remote write request")
+	flag.IntVar(&remoteWriteQueueSize, "remote-write-queue-size", monitoring.DefaultRemoteWriteQueueSize, "Max sampled records queued for the remote write, the oldest are dropped when it is full")
+	flag.IntVar(&remoteWriteRetries, "remote-write-retries", monitoring.DefaultRemoteWriteRetries, "Retries of a failed remote write request")
+	flag.StringVar(&pushgatewayURL, "pushgateway-url", "", "URL of the Prometheus Pushgateway the gauges and the job summary are pushed to on every flush and on exit, empty to disable")
+	flag.DurationVar(&pushgatewayDeleteAfter, "pushgateway-delete-after", 0, "Delete the group of the job from the Pushgateway after the duration once the agent exits, 0 to keep it, the exit waits for the delete within 10s after the duration and the shutdown timeout")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", defaultShutdownTimeout, "Max time the agent waits for the pending outputs once terminated, within the termination grace period of the pod")
+	flag.StringVar(&textfileDir, "textfile-dir", "", "Directory of the node_exporter textfile collector the gauges are written to as a *.prom file, e.g., /var/lib/node_exporter/textfile_collector, empty to disable")
+	flag.StringVar(&statePath, "state", "", "Path of the checkpoint file of the buffers (default <path>.state)")
+	flag.IntVar(&checkpointInterval, "checkpointInterval", 60, "Interval seconds of checkpointing the buffers, 0 to disable")
+	flag.BoolVar(&restore, "restore", true, "Restore the buffers from the checkpoint or the flush file on start")
+	flag.StringVar(&gpuBackend, "gpu-backend", monitoring.GpuBackendAuto, "Backend of gpu metrics: auto, nvml, nvidia-smi or amd")
+	flag.DurationVar(&gpuPollInterval, "gpu-poll-interval", monitoring.DefaultGpuPollInterval, "Interval of polling gpu utilization within an update interval, 0 to disable, 5s by default for nvidia-smi")
+	flag.StringVar(&aggregation, "aggregation", "", "Aggregation policies of the downsampled buffers, e.g., mem_used=max,cpu_util=mean")
+	flag.BoolVar(&envelopes, "envelopes", false, "Attach min, max and p95 envelopes to the downsampled points")
 
 	// 4 week: 5m → 4 * 7 * 24 * 60 * 60 / 300 = 8064 points
 	flag.IntVar(&lifetimeMax, "lifetime-max", 8064, "Max data in the lifetime buffer")
+	flag.BoolVar(&lifetimeAdaptive, "lifetime-adaptive", false, "Halve the resolution of the coarsest tier instead of dropping the oldest data when it is full")
+	flag.StringVar(&tiersFlag, "tiers", "", "Tiers of the buffers from the finest, e.g., 15m=10s/15m,1h=30s/1h,lifetime=5m/4w (default 15m at updateInterval, 1h, 3h and lifetime)")
 	flag.Parse()
 
 	context = &daemon.Context{
@@ -226,6 +688,39 @@ func main() {
 		log.SetLevel(log.DebugLevel)
 	}
 
+	policies, err := monitoring.ParseAggregationPolicies(aggregation)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// the flags given in the command line
+	setFlags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+
+	// the finest tier receives every record, it is derived from updateInterval unless the tiers are given
+	tiers := monitoring.DefaultTiersAt(lifetimeMax, time.Duration(updateInterval)*time.Second)
+	if tiersFlag != "" {
+		tiers, err = monitoring.ParseTiers(tiersFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		resolution := int(tiers[0].Resolution.Seconds())
+		if setFlags["updateInterval"] && resolution != updateInterval {
+			log.Fatalf("The updateInterval %d seconds differs from the resolution %v of tier %s",
+				updateInterval, tiers[0].Resolution, tiers[0].Name)
+		}
+		updateInterval = resolution
+	}
+
+	if lifetimeAdaptive {
+		tiers[len(tiers)-1].Adaptive = true
+	}
+	if err := monitoring.ValidateTiers(tiers); err != nil {
+		log.Fatal(err)
+	}
+
 	// Demonize the usage-agent
 	if isForeground == false {
 		d, err := context.Reborn()
@@ -240,14 +735,58 @@ func main() {
 		log.Info("daemon started")
 	}
 
-	// Check flush path exist or not
+	pwd, err := os.Getwd()
+	if err != nil {
+		log.Fatal(err)
+	}
+	fallbacks := []string{filepath.Join(pwd, "monitoring")}
+	if fallbackPaths != "" {
+		fallbacks = splitList(fallbackPaths)
+	}
+	outputList := splitList(outputs)
+	for _, output := range outputList {
+		if output != outputFile && output != outputTiers && output != outputLegacy && output != outputBinary {
+			log.Fatalf("Unknown output %s", output)
+		}
+	}
+	// the default of the gpu backend unless the interval is given
+	if !setFlags["gpu-poll-interval"] {
+		gpuPollInterval = monitoring.GpuPollIntervalDefault
+	}
+	if tiersDir == "" {
+		tiersDir = flushPath + ".tiers"
+	}
+	if legacyPath == "" {
+		legacyPath = flushPath + ".legacy"
+	}
+	if binaryPath == "" {
+		binaryPath = flushPath + ".bin"
+	}
+	externalLabels, err := monitoring.ParseLabels(remoteWriteLabels)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if remoteWriteBatchSize <= 0 || remoteWriteQueueSize <= 0 || remoteWriteBatchDeadline <= 0 {
+		log.Fatal("The remote write batch size, batch deadline and queue size should be positive")
+	}
+	if archiveDir != "" && archivePeriod < tiers[0].Resolution {
+		log.Fatalf("The archive period %v is shorter than the resolution of tier %s", archivePeriod, tiers[0].Name)
+	}
+	if pushgatewayURL != "" && pushgatewayDeleteAfter > 0 && pushgatewayDeleteAfter >= shutdownTimeout {
+		log.Warnf("The pushgateway group will not be deleted, the delete after %v is abandoned at the shutdown timeout %v",
+			pushgatewayDeleteAfter, shutdownTimeout)
+	}
+
+	// Check flush path exist or not, the flush file moves back to the path once the directory is available
+	statePathBase := flushPath
 	if _, err := os.Stat(filepath.Dir(flushPath)); os.IsNotExist(err) {
-		log.Warnf("Directory %s doesn't exist, fallback to 'monitoring'", filepath.Dir(flushPath))
-		pwd, err := os.Getwd()
-		if err != nil {
-			log.Fatal(err)
+		log.Warnf("Directory %s doesn't exist, fallback to %v", filepath.Dir(flushPath), fallbacks)
+		if len(fallbacks) > 0 {
+			statePathBase = fallbacks[0]
 		}
-		flushPath = filepath.Join(pwd, "monitoring")
+	}
+	if statePath == "" {
+		statePath = statePathBase + ".state"
 	}
 
 	// Setup signal handler
@@ -258,16 +797,79 @@ func main() {
 
 	log.Debug(monitoring.GetVersion())
 	log.Debugf("path: %s", flushPath)
+	log.Debugf("fallbackPaths: %v", fallbacks)
+	log.Debugf("outputs: %v", outputList)
+	log.Debugf("journal: %s", journalPath)
+	log.Debugf("archive: %s every %v", archiveDir, archivePeriod)
+	log.Debugf("listen: %s", listenAddress)
+	log.Debugf("remoteWrite: %s %v", remoteWriteURL, externalLabels)
+	log.Debugf("pushgateway: %s", pushgatewayURL)
+	log.Debugf("textfile: %s", textfileDir)
+	log.Debugf("state: %s", statePath)
 	log.Debugf("debug: %v", debug)
 	log.Debugf("isForeground: %v", isForeground)
-
-	monitor = NewMonitor(updateInterval, flushPath, lifetimeMax, flushInterval)
+	log.Debugf("gpuBackend: %s", gpuBackend)
+	log.Debugf("gpuPollInterval: %v", gpuPollInterval)
+	log.Debugf("aggregation: %v", policies)
+	log.Debugf("envelopes: %v", envelopes)
+	log.Debugf("tiers: %v", tiers)
+
+	monitor = NewMonitor(Options{
+		UpdateInterval:  updateInterval,
+		FlushInterval:   flushInterval,
+		Path:            flushPath,
+		Tiers:           tiers,
+		GpuBackend:      gpuBackend,
+		GpuPollInterval: gpuPollInterval,
+		Policies:        policies,
+		Envelopes:       envelopes,
+
+		FallbackPaths: fallbacks,
+		WriteRetries:  writeRetries,
+		WriteBackoff:  writeBackoff,
+
+		Outputs:     outputList,
+		TiersDir:    tiersDir,
+		AppendTiers: splitList(appendTiers),
+		LegacyPath:  legacyPath,
+		BinaryPath:  binaryPath,
+
+		JournalPath:       journalPath,
+		JournalMaxSize:    journalMaxSize,
+		JournalMaxAge:     journalMaxAge,
+		JournalCompress:   journalCompress,
+		JournalMaxBackups: journalMaxBackups,
+
+		ArchiveDir:    archiveDir,
+		ArchivePeriod: archivePeriod,
+
+		ListenAddress: listenAddress,
+		JobName:       phJobName,
+
+		RemoteWriteURL:           remoteWriteURL,
+		RemoteWriteLabels:        externalLabels,
+		RemoteWriteBatchSize:     remoteWriteBatchSize,
+		RemoteWriteBatchDeadline: remoteWriteBatchDeadline,
+		RemoteWriteQueueSize:     remoteWriteQueueSize,
+		RemoteWriteRetries:       remoteWriteRetries,
+
+		PushgatewayURL:         pushgatewayURL,
+		PushgatewayDeleteAfter: pushgatewayDeleteAfter,
+		ShutdownTimeout:        shutdownTimeout,
+
+		TextfileDir: textfileDir,
+		PodName:     getEnv("HOSTNAME", ""),
+
+		StatePath:          statePath,
+		CheckpointInterval: checkpointInterval,
+		Restore:            restore,
+	})
 
 	// Run MainLoop as worker thread
 	go monitor.Worker()
 
 	// Handle the signals
-	err := daemon.ServeSignals()
+	err = daemon.ServeSignals()
 	if err != nil {
 		log.Errorf("Error: %s", err.Error())
 	}
@@ -0,0 +1,229 @@
+package monitoring
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+type AggregationPolicy string
+
+const (
+	AggregateMean AggregationPolicy = "mean"
+	AggregateMin  AggregationPolicy = "min"
+	AggregateMax  AggregationPolicy = "max"
+	AggregateP95  AggregationPolicy = "p95"
+	AggregateLast AggregationPolicy = "last"
+)
+
+// The metric names follow the json names, the GPURecord ones are prefixed by gpu_
+const (
+	MetricCpuUtilization    = "cpu_util"
+	MetricMemoryUsed        = "mem_used"
+	MetricGPUUtilization    = "gpu_util"
+	MetricGPUUtilizationMax = "gpu_util_max"
+	MetricGPUMemoryUsed     = "gpu_mem_used"
+	MetricGPUPower          = "gpu_power"
+	MetricGPUTemperature    = "gpu_temperature"
+)
+
+const (
+	defaultAggregationPolicy   = AggregateMean
+	envelopePercentile         = 0.95
+	aggregationPoliciesExample = "mem_used=max,cpu_util=mean"
+)
+
+// AggregationPolicies maps the metric name to the policy used to merge the samples of a downsampled point
+type AggregationPolicies map[string]AggregationPolicy
+
+// Memory peaks are kept by max, otherwise an OOM spike is averaged away in the coarser tiers
+func DefaultAggregationPolicies() AggregationPolicies {
+	return AggregationPolicies{
+		MetricCpuUtilization:    AggregateMean,
+		MetricMemoryUsed:        AggregateMax,
+		MetricGPUUtilization:    AggregateMean,
+		MetricGPUUtilizationMax: AggregateMax,
+		MetricGPUMemoryUsed:     AggregateMax,
+		MetricGPUPower:          AggregateMean,
+		MetricGPUTemperature:    AggregateMean,
+	}
+}
+
+// averagePolicies merges by mean, except the max of the max
+var averagePolicies = AggregationPolicies{
+	MetricGPUUtilizationMax: AggregateMax,
+}
+
+func (p AggregationPolicies) Get(metric string) AggregationPolicy {
+	if policy, ok := p[metric]; ok {
+		return policy
+	}
+	return defaultAggregationPolicy
+}
+
+// ParseAggregationPolicies parses "metric=policy" pairs separated by comma on top of the default policies
+func ParseAggregationPolicies(value string) (AggregationPolicies, error) {
+	policies := DefaultAggregationPolicies()
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid aggregation policy %q, should be like %q", pair, aggregationPoliciesExample)
+		}
+		metric, policy := strings.TrimSpace(kv[0]), AggregationPolicy(strings.TrimSpace(kv[1]))
+		if _, ok := policies[metric]; !ok {
+			return nil, fmt.Errorf("unknown metric %q", metric)
+		}
+		switch policy {
+		case AggregateMean, AggregateMin, AggregateMax, AggregateP95, AggregateLast:
+			policies[metric] = policy
+		default:
+			return nil, fmt.Errorf("unknown aggregation policy %q of %s", policy, metric)
+		}
+	}
+	return policies, nil
+}
+
+// Envelope is the distribution of the samples merged into a downsampled point
+type Envelope struct {
+	Min int64 `json:"min"`
+	Max int64 `json:"max"`
+	P95 int64 `json:"p95"`
+}
+
+func aggregate(values []int64, policy AggregationPolicy) int64 {
+	if len(values) == 0 {
+		return 0
+	}
+
+	switch policy {
+	case AggregateMin:
+		min := values[0]
+		for _, v := range values {
+			if v < min {
+				min = v
+			}
+		}
+		return min
+	case AggregateMax:
+		max := values[0]
+		for _, v := range values {
+			if v > max {
+				max = v
+			}
+		}
+		return max
+	case AggregateP95:
+		return percentile(values, envelopePercentile)
+	case AggregateLast:
+		return values[len(values)-1]
+	}
+
+	var sum int64
+	for _, v := range values {
+		sum += v
+	}
+	return roundDiv(sum, int64(len(values)))
+}
+
+// aggregateWeighted is aggregate with the mean weighted, e.g., by the samples merged into each value
+func aggregateWeighted(values []int64, weights []int64, policy AggregationPolicy) int64 {
+	if policy != AggregateMean || len(values) == 0 {
+		return aggregate(values, policy)
+	}
+
+	var sum, total int64
+	for i, v := range values {
+		sum += v * weights[i]
+		total += weights[i]
+	}
+	return roundDiv(sum, total)
+}
+
+// roundDiv divides with the result rounded half away from zero instead of truncated
+func roundDiv(a int64, b int64) int64 {
+	if (a < 0) != (b < 0) {
+		return (a - b/2) / b
+	}
+	return (a + b/2) / b
+}
+
+// scaled converts the envelope of the scaled values to the unit of the rounded metric
+func (e *Envelope) scaled(convert func(int64) int) *Envelope {
+	if e == nil {
+		return nil
+	}
+	return &Envelope{Min: int64(convert(e.Min)), Max: int64(convert(e.Max)), P95: int64(convert(e.P95))}
+}
+
+func newEnvelope(values []int64) *Envelope {
+	if len(values) == 0 {
+		return nil
+	}
+	return &Envelope{
+		Min: aggregate(values, AggregateMin),
+		Max: aggregate(values, AggregateMax),
+		P95: percentile(values, envelopePercentile),
+	}
+}
+
+// mergeEnvelopes merges the envelopes of downsampled points, so the min and max of the raw samples are kept up the tiers.
+// A raw sample counts as an envelope of its value converted by convert, the p95 is bounded by the max of the p95s.
+func mergeEnvelopes(values []int64, envelopes []*Envelope, convert func(int64) int) *Envelope {
+	merging := false
+	for _, e := range envelopes {
+		if e != nil {
+			merging = true
+			break
+		}
+	}
+	if !merging {
+		if convert == nil {
+			return newEnvelope(values)
+		}
+		return newEnvelope(values).scaled(convert)
+	}
+
+	var merged *Envelope
+	for i, e := range envelopes {
+		if e == nil {
+			v := values[i]
+			if convert != nil {
+				v = int64(convert(v))
+			}
+			e = &Envelope{Min: v, Max: v, P95: v}
+		}
+		if merged == nil {
+			merged = &Envelope{Min: e.Min, Max: e.Max, P95: e.P95}
+			continue
+		}
+		if e.Min < merged.Min {
+			merged.Min = e.Min
+		}
+		if e.Max > merged.Max {
+			merged.Max = e.Max
+		}
+		if e.P95 > merged.P95 {
+			merged.P95 = e.P95
+		}
+	}
+	return merged
+}
+
+// percentile by the nearest-rank method
+func percentile(values []int64, p float64) int64 {
+	sorted := make([]int64, len(values))
+	copy(sorted, values)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
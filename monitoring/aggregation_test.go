@@ -0,0 +1,129 @@
+package monitoring
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLastAggregateKeepsMemorySpike(t *testing.T) {
+	t.Log("Give 20 samples with a memory spike of 900 in a flat usage of 100")
+	buffer := NewBuffer(0, 20)
+	for i := 0; i < 20; i++ {
+		memory := int64(100)
+		if i == 7 {
+			memory = 900
+		}
+		buffer.Add(Record{
+			Timestamp:      int64(i),
+			CpuUtilization: i,
+			MemoryUsed:     memory,
+			GPURecords:     []GPURecord{{Index: 0, MemoryUsed: memory, GPUUtilization: i * 5}},
+		})
+	}
+
+	record := buffer.LastAggregate(20, DefaultAggregationPolicies(), true)
+	if record.MemoryUsed != 900 || record.GPURecords[0].MemoryUsed != 900 {
+		t.Errorf("memory should be merged by max, but got %d and %d", record.MemoryUsed, record.GPURecords[0].MemoryUsed)
+	}
+	t.Log("The memory is merged by max")
+
+	if record.CpuMillicores != 95 || record.CpuUtilization != 10 {
+		t.Errorf("cpu should be merged by mean, but got %dm and %d%%", record.CpuMillicores, record.CpuUtilization)
+	}
+	t.Log("The cpu is merged by mean, the percent is rounded instead of truncated")
+
+	if *record.CpuEnvelope != (Envelope{Min: 0, Max: 19, P95: 18}) {
+		t.Errorf("unexpected cpu envelope %+v", *record.CpuEnvelope)
+	}
+	if *record.GPURecords[0].GPUUtilizationEnvelope != (Envelope{Min: 0, Max: 95, P95: 90}) {
+		t.Errorf("unexpected gpu envelope %+v", *record.GPURecords[0].GPUUtilizationEnvelope)
+	}
+	t.Log("The envelopes have the min, max and p95 of the samples")
+
+	record = buffer.LastAverage(20)
+	if record.MemoryUsed != 140 || record.CpuEnvelope != nil {
+		t.Errorf("LastAverage should merge by mean without envelopes, but got %+v", record)
+	}
+	t.Log("LastAverage still merges by mean")
+}
+
+func TestEnvelopesAcrossTiers(t *testing.T) {
+	t.Log("Give samples every 10s at 10% cpu with a spike of 90% at 1000000100, downsampled to 30s and 90s")
+	metrics, _ := NewMetricsWithTiers([]TierConfig{
+		{Name: "10s", Resolution: 10 * time.Second, Retention: 15 * time.Minute},
+		{Name: "30s", Resolution: 30 * time.Second, Retention: time.Hour},
+		{Name: "90s", Resolution: 90 * time.Second, Retention: 3 * time.Hour},
+	})
+	metrics.Envelopes = true
+	base := int64(1000000080)
+	for i := int64(0); i <= 12; i++ {
+		cpu := int64(100)
+		if i == 2 {
+			cpu = 900
+		}
+		metrics.Add(Record{Timestamp: base + i*10, CpuMillicores: cpu, MemoryUsed: 100 + i})
+	}
+
+	points := metrics.Tier("90s").LastAvailable()
+	if len(points) != 1 || points[0].Samples != 9 {
+		t.Fatalf("expected a point of 9 samples, but got %v", points)
+	}
+	if *points[0].CpuEnvelope != (Envelope{Min: 10, Max: 90, P95: 90}) {
+		t.Errorf("expected the cpu envelope of the samples, but got %+v", *points[0].CpuEnvelope)
+	}
+	if *points[0].MemoryEnvelope != (Envelope{Min: 100, Max: 108, P95: 108}) {
+		t.Errorf("expected the memory envelope of the samples, but got %+v", *points[0].MemoryEnvelope)
+	}
+	t.Log("The envelope of the coarsest tier has the min and max of the raw samples, not of the 30s means")
+}
+
+func TestAggregatePrecision(t *testing.T) {
+	t.Log("Give a job using 3 millicores and a gpu utilization alternating between 0% and 1%")
+	records := make([]Record, 0)
+	for i := 0; i < 4; i++ {
+		records = append(records, Record{
+			Timestamp:      int64(i),
+			CpuUtilization: MillicoresToPercent(3),
+			CpuMillicores:  3,
+			GPURecords:     []GPURecord{{GPUUtilization: i % 2, GPUUtilizationMilli: int64(i%2) * 1000}},
+		})
+	}
+
+	record := aggregateRecords(records, DefaultAggregationPolicies(), false)
+	if record.CpuMillicores != 3 || record.CpuUtilization != 0 {
+		t.Errorf("expected 3 millicores and 0%%, but got %dm and %d%%", record.CpuMillicores, record.CpuUtilization)
+	}
+	if gpu := record.GPURecords[0]; gpu.GPUUtilizationMilli != 500 || gpu.GPUUtilization != 1 {
+		t.Errorf("expected the gpu utilization 0.5%% rounded to 1%%, but got %+v", gpu)
+	}
+	t.Log("The low usages are kept in the scaled values")
+
+	t.Log("Give records written before the scaled values")
+	record = aggregateRecords([]Record{
+		{Timestamp: 0, CpuUtilization: 50, GPURecords: []GPURecord{{GPUUtilization: 20}}},
+		{Timestamp: 1, CpuUtilization: 25, GPURecords: []GPURecord{{GPUUtilization: 25}}},
+	}, DefaultAggregationPolicies(), false)
+	if record.CpuMillicores != 375 || record.CpuUtilization != 38 || record.GPURecords[0].GPUUtilizationMilli != 22500 {
+		t.Errorf("expected the values derived from the percents, but got %+v", record)
+	}
+	t.Log("The scaled values are derived from cpu_util and gpu_util")
+}
+
+func TestParseAggregationPolicies(t *testing.T) {
+	policies, err := ParseAggregationPolicies("cpu_util=p95, gpu_util=last")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policies.Get(MetricCpuUtilization) != AggregateP95 || policies.Get(MetricGPUUtilization) != AggregateLast {
+		t.Errorf("unexpected policies %v", policies)
+	}
+	if policies.Get(MetricMemoryUsed) != AggregateMax {
+		t.Errorf("the default policies should be kept, but got %v", policies)
+	}
+
+	for _, invalid := range []string{"cpu_util", "unknown=max", "cpu_util=median"} {
+		if _, err := ParseAggregationPolicies(invalid); err == nil {
+			t.Errorf("%q should be invalid", invalid)
+		}
+	}
+}
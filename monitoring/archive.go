@@ -0,0 +1,253 @@
+package monitoring
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultArchivePeriod = 24 * time.Hour
+
+	ArchiveIndexFile      = "index.json"
+	archiveFileTimeFormat = "20060102T150405Z"
+	archiveIndexVersion   = 1
+)
+
+// ArchiveEntry describes a sealed archive file holding the records with From <= Timestamp < To
+type ArchiveEntry struct {
+	File    string   `json:"file"`
+	From    int64    `json:"from"`
+	To      int64    `json:"to"`
+	Records int      `json:"records"`
+	Tiers   []string `json:"tiers"`
+	SHA256  string   `json:"sha256"`
+}
+
+// ArchiveIndex lists the sealed archives ordered by time, the ranges are contiguous unless a period had no records
+type ArchiveIndex struct {
+	Version  int            `json:"version"`
+	Period   int            `json:"period"`
+	Archives []ArchiveEntry `json:"archives"`
+}
+
+// Archive seals the records of every Period into a file in Dir once the period is over, e.g., a file per day,
+// so the history of a job running longer than the coarsest tier is kept. The records are queried at the best
+// resolution the tiers still hold, each file is written once and never modified, and the files are listed in the
+// index file ArchiveIndexFile. The periods are aligned to the multiples of Period since the epoch, e.g., the UTC days.
+type Archive struct {
+	Dir    string
+	Period time.Duration
+
+	index  *ArchiveIndex
+	next   int64
+	failed bool
+}
+
+func NewArchive(dir string) *Archive {
+	return &Archive{Dir: dir, Period: DefaultArchivePeriod}
+}
+
+// Seal writes the archives of the periods ended before the latest record
+func (a *Archive) Seal(metrics *Metrics, spec Spec) error {
+	latest, ok := metrics.Latest()
+	if !ok {
+		return nil
+	}
+	if ready, err := a.ready(metrics); !ready {
+		return err
+	}
+
+	period := int(a.Period.Seconds())
+	for {
+		to := alignTimestamp(a.next, period) + int64(period)
+		if latest.Timestamp < to {
+			return nil
+		}
+		if err := a.seal(metrics, spec, a.next, to); err != nil {
+			return err
+		}
+	}
+}
+
+// SealPartial writes the archive of the current period up to the latest record, e.g., when the agent stops.
+// The next period starts from the end of it, so the archives never overlap.
+func (a *Archive) SealPartial(metrics *Metrics, spec Spec) error {
+	if err := a.Seal(metrics, spec); err != nil || a.index == nil {
+		return err
+	}
+	latest, ok := metrics.Latest()
+	if !ok {
+		return nil
+	}
+	to := latest.Timestamp + int64(metrics.Tiers[0].Interval)
+	if to <= a.next {
+		return nil
+	}
+	return a.seal(metrics, spec, a.next, to)
+}
+
+// Index returns a copy of the index, or nil if it is not loaded yet
+func (a *Archive) Index() *ArchiveIndex {
+	if a.index == nil {
+		return nil
+	}
+	index := *a.index
+	index.Archives = append([]ArchiveEntry{}, a.index.Archives...)
+	return &index
+}
+
+// ready loads the index on the first call and finds the start of the next archive, false if it cannot start yet.
+// An index that cannot be read is reported once and disables the archive, so it is never overwritten.
+func (a *Archive) ready(metrics *Metrics) (bool, error) {
+	if a.failed {
+		return false, nil
+	}
+	if a.index == nil {
+		index, err := LoadArchiveIndex(a.Dir)
+		if os.IsNotExist(err) {
+			index, err = &ArchiveIndex{Version: archiveIndexVersion, Archives: make([]ArchiveEntry, 0)}, nil
+		}
+		if err != nil {
+			a.failed = true
+			return false, fmt.Errorf("cannot read the archive index, archiving is disabled: %v", err)
+		}
+		index.Period = int(a.Period.Seconds())
+		a.index = index
+		if n := len(index.Archives); n > 0 {
+			a.next = index.Archives[n-1].To
+		}
+	}
+
+	if a.next == 0 {
+		// the first archive starts from the period of the oldest record held
+		metrics.Each(0, math.MaxInt64, func(tier string, r Record) bool {
+			a.next = alignTimestamp(r.Timestamp, int(a.Period.Seconds()))
+			return false
+		})
+	}
+	return a.next != 0, nil
+}
+
+func (a *Archive) seal(metrics *Metrics, spec Spec, from int64, to int64) error {
+	result := metrics.Query(from, to)
+	if len(result) == 0 {
+		// nothing is held for the period, e.g., the agent was stopped
+		a.next = to
+		return nil
+	}
+
+	specs := metrics.TierSpecs()
+	report := Monitoring{Version: SchemaVersion, Spec: spec, Tiers: make([]TierSpec, 0), Datasets: make(Datasets)}
+	entry := ArchiveEntry{
+		File:  fmt.Sprintf("archive-%s.json", time.Unix(from, 0).UTC().Format(archiveFileTimeFormat)),
+		From:  from,
+		To:    to,
+		Tiers: make([]string, 0, len(result)),
+	}
+	for _, tier := range specs {
+		for _, segment := range result {
+			if segment.Tier == tier.Name {
+				report.Tiers = append(report.Tiers, tier)
+				report.Datasets[tier.Name] = segment.Records
+				entry.Tiers = append(entry.Tiers, tier.Name)
+				entry.Records += len(segment.Records)
+			}
+		}
+	}
+
+	if err := os.Mkdir(a.Dir, 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	path := filepath.Join(a.Dir, entry.File)
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		// sealed before the index was written, the archive is never rewritten
+		log.Warnf("Archive %s exists, add it to the index as is", path)
+	} else {
+		if data, err = json.Marshal(report); err != nil {
+			return err
+		}
+		if err := WriteFileAtomic(path, data, 0644); err != nil {
+			return err
+		}
+		log.Infof("Seal archive %s with %d records", path, entry.Records)
+	}
+	sum := sha256.Sum256(data)
+	entry.SHA256 = hex.EncodeToString(sum[:])
+
+	index := a.Index()
+	index.Archives = append(index.Archives, entry)
+	if err := writeArchiveIndex(a.Dir, index); err != nil {
+		return err
+	}
+	a.index = index
+	a.next = to
+	return nil
+}
+
+func writeArchiveIndex(dir string, index *ArchiveIndex) error {
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(filepath.Join(dir, ArchiveIndexFile), data, 0644)
+}
+
+func LoadArchiveIndex(dir string) (*ArchiveIndex, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, ArchiveIndexFile))
+	if err != nil {
+		return nil, err
+	}
+	index := &ArchiveIndex{}
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, err
+	}
+	if index.Version > archiveIndexVersion {
+		return nil, fmt.Errorf("unsupported archive index version %d", index.Version)
+	}
+	return index, nil
+}
+
+// ReadArchiveHistory rebuilds the history from the archives listed in the index of dir,
+// the records are ordered by time and each archive is verified by its checksum
+func ReadArchiveHistory(dir string) ([]Record, error) {
+	index, err := LoadArchiveIndex(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	history := make([]Record, 0)
+	for _, entry := range index.Archives {
+		data, err := ioutil.ReadFile(filepath.Join(dir, entry.File))
+		if err != nil {
+			return nil, err
+		}
+		if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != entry.SHA256 {
+			return nil, fmt.Errorf("archive %s doesn't match its checksum", entry.File)
+		}
+		report, err := ReadMonitoring(data)
+		if err != nil {
+			return nil, fmt.Errorf("archive %s: %v", entry.File, err)
+		}
+
+		records := make([]Record, 0, entry.Records)
+		for _, dataset := range report.Datasets {
+			records = append(records, dataset...)
+		}
+		sort.SliceStable(records, func(i, j int) bool {
+			return records[i].Timestamp < records[j].Timestamp
+		})
+		history = append(history, records...)
+	}
+	return history, nil
+}
@@ -0,0 +1,130 @@
+package monitoring
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestArchiveMetrics(t *testing.T) *Metrics {
+	metrics, err := NewMetricsWithTiers([]TierConfig{
+		{Name: "fine", Resolution: 10 * time.Second, Retention: 2 * time.Minute},
+		{Name: "coarse", Resolution: time.Minute, Retention: time.Hour},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return metrics
+}
+
+func TestArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	t.Log("Give 12 minutes of samples and an archive of 5 minutes")
+	metrics := newTestArchiveMetrics(t)
+	archive := NewArchive(filepath.Join(dir, "archive"))
+	archive.Period = 5 * time.Minute
+	base := int64(1000000200)
+	for i := int64(0); i < 72; i++ {
+		metrics.Add(Record{Timestamp: base + i*10, MemoryUsed: i})
+		if err := archive.Seal(metrics, Spec{MemoryTotal: 100}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	index, err := LoadArchiveIndex(archive.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Archives) != 2 || index.Period != 300 {
+		t.Fatalf("expected 2 archives of 300 seconds, but got %+v", index)
+	}
+	first, second := index.Archives[0], index.Archives[1]
+	if first.From != 1000000200 || first.To != 1000000500 || second.From != first.To || second.To != 1000000800 {
+		t.Errorf("expected the contiguous periods, but got %+v", index.Archives)
+	}
+	if first.Records != 10 || len(first.Tiers) != 2 || first.Tiers[0] != "fine" || first.Tiers[1] != "coarse" {
+		t.Errorf("expected the first period served by the coarse tier before the fine one, but got %+v", first)
+	}
+	t.Log("The ended periods are sealed at the best resolution held")
+
+	if err := archive.SealPartial(metrics, Spec{MemoryTotal: 100}); err != nil {
+		t.Fatal(err)
+	}
+	index = archive.Index()
+	last := index.Archives[len(index.Archives)-1]
+	if len(index.Archives) != 3 || last.From != 1000000800 || last.To != base+720 {
+		t.Fatalf("expected the partial archive up to the latest record, but got %+v", index.Archives)
+	}
+	t.Log("The current period is sealed up to the latest record on stop")
+
+	t.Log("Give the agent restarted with the same archive")
+	restarted := NewArchive(archive.Dir)
+	restarted.Period = 5 * time.Minute
+	for i := int64(72); i < 102; i++ {
+		metrics.Add(Record{Timestamp: base + i*10, MemoryUsed: i})
+		if err := restarted.Seal(metrics, Spec{MemoryTotal: 100}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	index = restarted.Index()
+	if len(index.Archives) != 4 || index.Archives[3].From != last.To || index.Archives[3].To != 1000001100 {
+		t.Fatalf("expected the archive continued from the partial one, but got %+v", index.Archives)
+	}
+
+	history, err := ReadArchiveHistory(archive.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < len(history); i++ {
+		if history[i].Timestamp <= history[i-1].Timestamp {
+			t.Fatalf("expected the history ordered without overlap, but got %d after %d", history[i].Timestamp, history[i-1].Timestamp)
+		}
+	}
+	if history[0].Timestamp != 1000000200 || history[len(history)-1].Timestamp != 1000001090 {
+		t.Errorf("expected the history from %d to %d, but got %+v", 1000000200, 1000001090, history)
+	}
+	t.Log("The history is rebuilt from the index")
+
+	if err := ioutil.WriteFile(filepath.Join(archive.Dir, first.File), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadArchiveHistory(archive.Dir); err == nil {
+		t.Error("expected the modified archive to be rejected")
+	}
+}
+
+func TestArchiveBrokenIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	t.Log("Give an index that cannot be read")
+	if err := ioutil.WriteFile(filepath.Join(dir, ArchiveIndexFile), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	metrics := newTestArchiveMetrics(t)
+	metrics.Add(Record{Timestamp: 1000000000})
+	metrics.Add(Record{Timestamp: 1000100000})
+	archive := NewArchive(dir)
+	archive.Period = time.Minute
+
+	if err := archive.Seal(metrics, Spec{}); err == nil {
+		t.Fatal("expected the broken index to be reported")
+	}
+	if err := archive.SealPartial(metrics, Spec{}); err != nil {
+		t.Errorf("expected the error reported once, but got %v", err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, ArchiveIndexFile)); string(data) != "{" {
+		t.Errorf("expected the index untouched, but got %s", data)
+	}
+	t.Log("The archive is disabled without overwriting the index")
+}
@@ -0,0 +1,348 @@
+package monitoring
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// The binary encoding of the Monitoring document:
+//
+//	magic "PHMB", format version byte
+//	uvarint length + JSON header: the version, the spec and the tiers
+//	uvarint number of datasets, then for each dataset:
+//	  uvarint length + name, uvarint number of records, the records
+//
+// A record is a flags byte followed by varints: the timestamp as the delta of the delta from the previous record,
+// and the other values as the zigzag delta from the same value of the previous record, including each GPU by position,
+// so the slowly changing series take a byte or two per value. The envelopes are written as is when present.
+var binaryMagic = []byte("PHMB")
+
+const binaryFormatVersion = 1
+
+const (
+	binaryGap uint8 = 1 << iota
+	binaryHasGPUs
+	binaryCpuEnvelope
+	binaryMemoryEnvelope
+)
+
+var errBinaryTruncated = errors.New("truncated binary monitoring")
+
+type binaryHeader struct {
+	Version int        `json:"version"`
+	Spec    Spec       `json:"spec"`
+	Tiers   []TierSpec `json:"tiers"`
+}
+
+// binaryState is the previous values the deltas are taken from
+type binaryState struct {
+	timestamp, timestampDelta int64
+	cpu, cpuMilli, memory     int64
+	samples                   int64
+	gpus                      [][gpuBinaryFields]int64
+}
+
+const gpuBinaryFields = 7
+
+// IsBinaryMonitoring reports the data is the binary encoding
+func IsBinaryMonitoring(data []byte) bool {
+	return bytes.HasPrefix(data, binaryMagic)
+}
+
+// MarshalBinary encodes the document, the datasets follow the order of the tiers
+func MarshalBinary(report Monitoring) ([]byte, error) {
+	header, err := json.Marshal(binaryHeader{Version: report.Version, Spec: report.Spec, Tiers: report.Tiers})
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 0, 1024)
+	buf = append(buf, binaryMagic...)
+	buf = append(buf, binaryFormatVersion)
+	buf = appendUvarint(buf, uint64(len(header)))
+	buf = append(buf, header...)
+
+	names := datasetNames(report)
+	buf = appendUvarint(buf, uint64(len(names)))
+	for _, name := range names {
+		records := report.Datasets[name]
+		buf = appendUvarint(buf, uint64(len(name)))
+		buf = append(buf, name...)
+		buf = appendUvarint(buf, uint64(len(records)))
+
+		state := binaryState{}
+		for i := range records {
+			buf = state.appendRecord(buf, &records[i])
+		}
+	}
+	return buf, nil
+}
+
+// datasetNames returns the names of the tiers, followed by the other datasets sorted by name
+func datasetNames(report Monitoring) []string {
+	names := make([]string, 0, len(report.Datasets))
+	known := make(map[string]bool)
+	for _, tier := range report.Tiers {
+		if _, ok := report.Datasets[tier.Name]; ok && !known[tier.Name] {
+			names = append(names, tier.Name)
+			known[tier.Name] = true
+		}
+	}
+	others := make([]string, 0)
+	for name := range report.Datasets {
+		if !known[name] {
+			others = append(others, name)
+		}
+	}
+	sort.Strings(others)
+	return append(names, others...)
+}
+
+func (s *binaryState) appendRecord(buf []byte, r *Record) []byte {
+	var flags uint8
+	if r.Gap {
+		flags |= binaryGap
+	}
+	if r.GPURecords != nil {
+		flags |= binaryHasGPUs
+	}
+	if r.CpuEnvelope != nil {
+		flags |= binaryCpuEnvelope
+	}
+	if r.MemoryEnvelope != nil {
+		flags |= binaryMemoryEnvelope
+	}
+	buf = append(buf, flags)
+
+	delta := r.Timestamp - s.timestamp
+	buf = appendVarint(buf, delta-s.timestampDelta)
+	s.timestamp, s.timestampDelta = r.Timestamp, delta
+
+	buf = appendDelta(buf, &s.cpu, int64(r.CpuUtilization))
+	buf = appendDelta(buf, &s.cpuMilli, r.CpuMillicores)
+	buf = appendDelta(buf, &s.memory, r.MemoryUsed)
+	buf = appendDelta(buf, &s.samples, int64(r.Samples))
+	buf = appendEnvelope(buf, r.CpuEnvelope)
+	buf = appendEnvelope(buf, r.MemoryEnvelope)
+
+	buf = appendUvarint(buf, uint64(len(r.GPURecords)))
+	for len(s.gpus) < len(r.GPURecords) {
+		s.gpus = append(s.gpus, [gpuBinaryFields]int64{})
+	}
+	for g := range r.GPURecords {
+		gpu := &r.GPURecords[g]
+		var gpuFlags uint8
+		if gpu.GPUUtilizationEnvelope != nil {
+			gpuFlags |= gpuHasUtilizationEnvelope
+		}
+		if gpu.MemoryEnvelope != nil {
+			gpuFlags |= gpuHasMemoryEnvelope
+		}
+		buf = append(buf, gpuFlags)
+
+		prev := &s.gpus[g]
+		for f, v := range gpuBinaryValues(gpu) {
+			buf = appendDelta(buf, &prev[f], v)
+		}
+		buf = appendEnvelope(buf, gpu.GPUUtilizationEnvelope)
+		buf = appendEnvelope(buf, gpu.MemoryEnvelope)
+	}
+	return buf
+}
+
+func gpuBinaryValues(gpu *GPURecord) [gpuBinaryFields]int64 {
+	return [gpuBinaryFields]int64{
+		int64(gpu.Index),
+		gpu.MemoryUsed,
+		int64(gpu.GPUUtilization),
+		gpu.GPUUtilizationMilli,
+		int64(gpu.GPUUtilizationMax),
+		gpu.Power,
+		int64(gpu.Temperature),
+	}
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutUvarint(tmp[:], v)]...)
+}
+
+func appendVarint(buf []byte, v int64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutVarint(tmp[:], v)]...)
+}
+
+func appendDelta(buf []byte, prev *int64, v int64) []byte {
+	buf = appendVarint(buf, v-*prev)
+	*prev = v
+	return buf
+}
+
+func appendEnvelope(buf []byte, e *Envelope) []byte {
+	if e == nil {
+		return buf
+	}
+	buf = appendVarint(buf, e.Min)
+	buf = appendVarint(buf, e.Max)
+	return appendVarint(buf, e.P95)
+}
+
+// binaryReader decodes the values, the first error is kept and the later reads return zeros
+type binaryReader struct {
+	data []byte
+	err  error
+}
+
+func (r *binaryReader) byte() uint8 {
+	if r.err != nil || len(r.data) == 0 {
+		r.err = errBinaryTruncated
+		return 0
+	}
+	b := r.data[0]
+	r.data = r.data[1:]
+	return b
+}
+
+func (r *binaryReader) bytes(n uint64) []byte {
+	if r.err != nil || uint64(len(r.data)) < n {
+		r.err = errBinaryTruncated
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *binaryReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.err = errBinaryTruncated
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *binaryReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.err = errBinaryTruncated
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+// count reads a length, bounded by the remaining bytes since every item takes at least a byte
+func (r *binaryReader) count() int {
+	n := r.uvarint()
+	if n > uint64(len(r.data)) {
+		r.err = errBinaryTruncated
+		return 0
+	}
+	return int(n)
+}
+
+func (r *binaryReader) delta(prev *int64) int64 {
+	*prev += r.varint()
+	return *prev
+}
+
+func (r *binaryReader) envelope(present bool) *Envelope {
+	if !present {
+		return nil
+	}
+	return &Envelope{Min: r.varint(), Max: r.varint(), P95: r.varint()}
+}
+
+// UnmarshalBinary decodes the document encoded by MarshalBinary
+func UnmarshalBinary(data []byte) (Monitoring, error) {
+	report := Monitoring{}
+	if !IsBinaryMonitoring(data) {
+		return report, errors.New("not a binary monitoring")
+	}
+	r := &binaryReader{data: data[len(binaryMagic):]}
+	if format := r.byte(); r.err == nil && format != binaryFormatVersion {
+		return report, fmt.Errorf("unsupported binary monitoring format %d", format)
+	}
+
+	header := binaryHeader{}
+	if raw := r.bytes(r.uvarint()); r.err == nil {
+		if err := json.Unmarshal(raw, &header); err != nil {
+			return report, err
+		}
+	}
+	report.Version, report.Spec, report.Tiers = header.Version, header.Spec, header.Tiers
+
+	report.Datasets = make(Datasets)
+	datasets := r.count()
+	for d := 0; d < datasets && r.err == nil; d++ {
+		name := string(r.bytes(r.uvarint()))
+		records := make([]Record, r.count())
+		state := binaryState{}
+		for i := 0; i < len(records) && r.err == nil; i++ {
+			records[i] = state.readRecord(r)
+		}
+		report.Datasets[name] = records
+	}
+	if r.err != nil {
+		return Monitoring{}, r.err
+	}
+	return report, nil
+}
+
+func (s *binaryState) readRecord(r *binaryReader) Record {
+	flags := r.byte()
+	s.timestampDelta += r.varint()
+	s.timestamp += s.timestampDelta
+
+	record := Record{
+		Timestamp:      s.timestamp,
+		CpuUtilization: int(r.delta(&s.cpu)),
+		CpuMillicores:  r.delta(&s.cpuMilli),
+		MemoryUsed:     r.delta(&s.memory),
+		Samples:        int(r.delta(&s.samples)),
+		Gap:            flags&binaryGap != 0,
+	}
+	record.CpuEnvelope = r.envelope(flags&binaryCpuEnvelope != 0)
+	record.MemoryEnvelope = r.envelope(flags&binaryMemoryEnvelope != 0)
+
+	n := r.count()
+	if flags&binaryHasGPUs == 0 {
+		return record
+	}
+	record.GPURecords = make([]GPURecord, n)
+	for len(s.gpus) < n {
+		s.gpus = append(s.gpus, [gpuBinaryFields]int64{})
+	}
+	for g := range record.GPURecords {
+		gpuFlags := r.byte()
+		prev := &s.gpus[g]
+		var values [gpuBinaryFields]int64
+		for f := range values {
+			values[f] = r.delta(&prev[f])
+		}
+		record.GPURecords[g] = GPURecord{
+			Index:                  int(values[0]),
+			MemoryUsed:             values[1],
+			GPUUtilization:         int(values[2]),
+			GPUUtilizationMilli:    values[3],
+			GPUUtilizationMax:      int(values[4]),
+			Power:                  values[5],
+			Temperature:            int(values[6]),
+			GPUUtilizationEnvelope: r.envelope(gpuFlags&gpuHasUtilizationEnvelope != 0),
+			MemoryEnvelope:         r.envelope(gpuFlags&gpuHasMemoryEnvelope != 0),
+		}
+	}
+	return record
+}
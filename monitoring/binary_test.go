@@ -0,0 +1,115 @@
+package monitoring
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestBinaryRoundTrip(t *testing.T) {
+	t.Log("Give a document with irregular timestamps, gaps, envelopes, no GPU and a changing number of GPUs")
+	gpus := newTestGPURecords(2, 42)
+	gpus[1].GPUUtilizationMilli = 41999
+	gpus[1].GPUUtilizationEnvelope = &Envelope{Min: 10, Max: 90, P95: 85}
+	report := Monitoring{
+		Version: SchemaVersion,
+		Spec:    Spec{MemoryTotal: 8 << 30, GPUSpec: []GPUSpec{{Index: 0, MemoryTotal: 16 << 30}}},
+		Tiers: []TierSpec{
+			{Name: "fine", Interval: 10, Capacity: 90, Retention: 900},
+			{Name: "coarse", Interval: 300, Capacity: 10, Retention: 3000, Source: "fine", Adaptive: true},
+		},
+		Datasets: Datasets{
+			"fine": {
+				{Timestamp: 1000000000, CpuUtilization: 120, CpuMillicores: 1204, MemoryUsed: 1 << 30},
+				{Timestamp: 1000000010, CpuUtilization: 5, MemoryUsed: 1 << 29, GPURecords: []GPURecord{}},
+				{Timestamp: 1000000020, GPURecords: gpus},
+				NewGapRecord(1000000030),
+				{Timestamp: 1000000095, CpuMillicores: -1, GPURecords: newTestGPURecords(8, 7)},
+				{Timestamp: 1000000100, GPURecords: newTestGPURecords(1, 99)},
+			},
+			"coarse": {
+				{
+					Timestamp:      1000000000,
+					CpuUtilization: 60,
+					MemoryUsed:     3 << 29,
+					Samples:        30,
+					CpuEnvelope:    &Envelope{Min: 5, Max: 120, P95: 118},
+					MemoryEnvelope: &Envelope{Min: 1 << 29, Max: 1 << 30, P95: 1 << 30},
+				},
+			},
+			"extra": {},
+		},
+	}
+
+	data, err := MarshalBinary(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsBinaryMonitoring(data) {
+		t.Fatal("expected the binary magic")
+	}
+	decoded, err := UnmarshalBinary(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report, decoded) {
+		t.Errorf("expected %+v, but got %+v", report, decoded)
+	}
+	read, err := ReadMonitoring(data)
+	if err != nil || !reflect.DeepEqual(report, read) {
+		t.Errorf("expected ReadMonitoring to decode the binary encoding, but got %+v, %v", read, err)
+	}
+	t.Log("The document is decoded as it was")
+
+	for n := 0; n < len(data); n++ {
+		if _, err := UnmarshalBinary(data[:n]); err == nil {
+			t.Fatalf("expected an error for the data truncated to %d bytes", n)
+		}
+	}
+	t.Log("The truncated data is rejected")
+}
+
+func TestBinarySize(t *testing.T) {
+	t.Log("Give the default tiers filled by a day of samples with 2 GPUs")
+	metrics := NewMetrics(8064)
+	base := int64(1000000000)
+	for i := 0; i < 8640; i++ {
+		metrics.Add(Record{
+			Timestamp:      base + int64(i)*10,
+			CpuUtilization: 100 + i%7,
+			CpuMillicores:  int64(1000 + i%70),
+			MemoryUsed:     1<<30 + int64(i%13)<<20,
+			GPURecords:     newTestGPURecords(2, 40+i%5),
+		})
+	}
+	report := NewMonitoring(Spec{MemoryTotal: 8 << 30}, metrics.Snapshot())
+
+	data, err := MarshalBinary(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, err := json.Marshal(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("The binary encoding takes %d bytes, the JSON takes %d bytes", len(data), len(text))
+	if len(data)*5 > len(text) {
+		t.Errorf("expected the binary encoding to be less than a fifth of the JSON")
+	}
+}
+
+func BenchmarkMarshalBinary(b *testing.B) {
+	metrics := NewMetrics(8064)
+	base := int64(1000000000)
+	for i := 0; i < 8640; i++ {
+		metrics.Add(Record{Timestamp: base + int64(i)*10, MemoryUsed: int64(i), GPURecords: newTestGPURecords(2, i)})
+	}
+	report := NewMonitoring(Spec{}, metrics.Snapshot())
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := MarshalBinary(report); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -1,18 +1,37 @@
 package monitoring
 
-import "time"
+import (
+	"sort"
+	"time"
+)
 
 type Buffer struct {
-	Data          []Record
+	Name string
+
+	// the records by slot of the ring, stored in columns
+	data *recordColumns
+
 	NextIndex     int64
 	Max           int
 	LastUpdated   time.Time
 	Interval      int
 	AverageByLast int
+
+	// the finer buffer the records are aggregated from
+	Source *Buffer
+
+	// start timestamp of the wall-clock-aligned bucket being filled, -1 if none
+	OpenBucket int64
+
+	// Compact merges the points pairwise when the buffer is full, doubling the Interval,
+	// the source is still aggregated by buckets of BaseInterval, which are merged in Pending
+	Compact      bool
+	BaseInterval int
+	Pending      []Record
 }
 
 func (b *Buffer) Add(record Record) {
-	b.Data[b.NextIndex%int64(b.Max)] = record
+	b.data.set(int(b.NextIndex%int64(b.Max)), record)
 	b.NextIndex++
 	b.LastUpdated = time.Now()
 }
@@ -23,13 +42,8 @@ func (b *Buffer) Last(request int) []Record {
 		last = int(b.NextIndex)
 	}
 
-	p := make([]Record, last)
 	fromIndex := b.NextIndex - int64(last)
-	for i := fromIndex; i < fromIndex+int64(last); i++ {
-		p[i-fromIndex] = b.Data[i%int64(b.Max)]
-	}
-
-	return p
+	return b.data.getRange(int(fromIndex%int64(b.Max)), last)
 }
 
 func (b *Buffer) LastAvailable() []Record {
@@ -48,10 +62,121 @@ func (b *Buffer) HasLast(last int) bool {
 	return b.NextIndex >= int64(last) && last <= b.Max
 }
 
+// Between returns the available records with from <= Timestamp < to
+func (b *Buffer) Between(from int64, to int64) []Record {
+	start, end := b.search(from, to)
+	if start >= end {
+		return make([]Record, 0)
+	}
+	return b.data.getRange(b.slotOf(start), end-start)
+}
+
+// search returns the positions of the available records with from <= Timestamp < to,
+// found by a binary search since the timestamps are increasing
+func (b *Buffer) search(from int64, to int64) (int, int) {
+	n := b.Len()
+	start := sort.Search(n, func(i int) bool { return b.data.timestamp(b.slotOf(i)) >= from })
+	end := start + sort.Search(n-start, func(i int) bool { return b.data.timestamp(b.slotOf(start+i)) >= to })
+	return start, end
+}
+
+// Len returns the number of the available records
+func (b *Buffer) Len() int {
+	if b.NextIndex < int64(b.Max) {
+		return int(b.NextIndex)
+	}
+	return b.Max
+}
+
+// At returns the i-th available record from the oldest one, without copying the ring
+func (b *Buffer) At(i int) Record {
+	return b.data.get(b.slotOf(i))
+}
+
+func (b *Buffer) slotOf(i int) int {
+	return int((b.NextIndex - int64(b.Len()) + int64(i)) % int64(b.Max))
+}
+
+// reset drops all records
+func (b *Buffer) reset() {
+	b.data = newRecordColumns(b.Max)
+	b.NextIndex = 0
+}
+
+// Oldest returns the first available record
+func (b *Buffer) Oldest() (Record, bool) {
+	if b.NextIndex == 0 {
+		return Record{}, false
+	}
+	return b.At(0), true
+}
+
+// Each calls fn with the available records from the oldest one until fn returns false
+func (b *Buffer) Each(fn func(r Record) bool) {
+	for i, n := 0, b.Len(); i < n; i++ {
+		if !fn(b.At(i)) {
+			return
+		}
+	}
+}
+
+// EachBetween calls fn with the available records with from <= Timestamp < to until fn returns false
+func (b *Buffer) EachBetween(from int64, to int64, fn func(r Record) bool) {
+	start, end := b.search(from, to)
+	for i := start; i < end; i++ {
+		if !fn(b.At(i)) {
+			return
+		}
+	}
+}
+
+// BucketOf returns the start of the bucket aggregated from the source the timestamp falls in, aligned to the epoch
+func (b *Buffer) BucketOf(timestamp int64) int64 {
+	return alignTimestamp(timestamp, b.BaseInterval)
+}
+
+func alignTimestamp(timestamp int64, interval int) int64 {
+	i := int64(interval)
+	return timestamp - ((timestamp%i)+i)%i
+}
+
 func (b *Buffer) LastAverage(request int) Record {
-	last := request
-	if int64(last) > b.NextIndex {
-		last = int(b.NextIndex)
+	return b.LastAggregate(request, averagePolicies, false)
+}
+
+// LastAggregate merges the last records into one by the aggregation policy of each metric,
+// the envelopes of the merged samples are attached when withEnvelope is set
+func (b *Buffer) LastAggregate(request int, policies AggregationPolicies, withEnvelope bool) Record {
+	return aggregateRecords(b.Last(request), policies, withEnvelope)
+}
+
+// Latest returns the last added record
+func (b *Buffer) Latest() (Record, bool) {
+	if b.NextIndex == 0 {
+		return Record{}, false
+	}
+	return b.data.get(int((b.NextIndex - 1) % int64(b.Max))), true
+}
+
+// aggregateRecords merges the records into one with the timestamp of the first record,
+// the gaps are skipped, and the result is a gap if there is no sample.
+// The envelopes of the downsampled records are merged rather than recomputed from their aggregated values.
+func aggregateRecords(all []Record, policies AggregationPolicies, withEnvelope bool) Record {
+	records := make([]Record, 0, len(all))
+	samples := 0
+	for _, r := range all {
+		if r.Gap {
+			continue
+		}
+		records = append(records, r)
+		if r.Samples > 0 {
+			samples += r.Samples
+		} else {
+			samples++
+		}
+	}
+	if len(records) == 0 && len(all) > 0 {
+		return NewGapRecord(all[0].Timestamp)
 	}
 
 	var record = Record{
@@ -60,38 +185,82 @@ func (b *Buffer) LastAverage(request int) Record {
 		MemoryUsed:     0,
 		GPURecords:     make([]GPURecord, 0),
 	}
+	if len(records) == 0 {
+		return record
+	}
 
-	fromIndex := b.NextIndex - int64(last)
-	for i := fromIndex; i < fromIndex+int64(last); i++ {
-		r := b.Data[int(i%int64(b.Max))]
-
-		// init record
-		if i == fromIndex {
-			record.Timestamp = r.Timestamp
-			if r.GPURecords != nil && len(r.GPURecords) != 0 {
-				record.GPURecords = make([]GPURecord, len(r.GPURecords))
-			}
+	record.Timestamp = records[0].Timestamp
+	record.Samples = samples
+	numGPUs := len(records[0].GPURecords)
+	for _, r := range records {
+		if len(r.GPURecords) < numGPUs {
+			numGPUs = len(r.GPURecords)
 		}
-		//sum += b.Buffer[int(i%b.Max)].Value
-		record.CpuUtilization += r.CpuUtilization
-		record.MemoryUsed += r.MemoryUsed
-
-		if record.GPURecords != nil {
-			for g := 0; g < len(r.GPURecords); g++ {
-				record.GPURecords[g].Index = r.GPURecords[g].Index
-				record.GPURecords[g].GPUUtilization += r.GPURecords[g].GPUUtilization
-				record.GPURecords[g].MemoryUsed += r.GPURecords[g].MemoryUsed
-			}
+	}
+
+	collect := func(value func(r Record) int64) []int64 {
+		values := make([]int64, len(records))
+		for i, r := range records {
+			values[i] = value(r)
 		}
+		return values
+	}
+	// a downsampled record weighs the samples merged into it
+	weights := collect(func(r Record) int64 {
+		if r.Samples > 0 {
+			return int64(r.Samples)
+		}
+		return 1
+	})
+	envelopes := func(envelope func(r Record) *Envelope) []*Envelope {
+		merged := make([]*Envelope, len(records))
+		for i, r := range records {
+			merged[i] = envelope(r)
+		}
+		return merged
 	}
 
-	record.CpuUtilization /= last
-	record.MemoryUsed /= int64(last)
-	if record.GPURecords != nil {
-		for g := 0; g < len(record.GPURecords); g++ {
-			record.GPURecords[g].GPUUtilization /= last
-			record.GPURecords[g].MemoryUsed /= int64(last)
+	// aggregate the scaled values, so the means of low usages are not truncated to 0
+	cpu := collect(func(r Record) int64 { return r.Millicores() })
+	record.CpuMillicores = aggregateWeighted(cpu, weights, policies.Get(MetricCpuUtilization))
+	record.CpuUtilization = MillicoresToPercent(record.CpuMillicores)
+	if withEnvelope {
+		record.CpuEnvelope = mergeEnvelopes(cpu, envelopes(func(r Record) *Envelope { return r.CpuEnvelope }), MillicoresToPercent)
+	}
+
+	memory := collect(func(r Record) int64 { return r.MemoryUsed })
+	record.MemoryUsed = aggregateWeighted(memory, weights, policies.Get(MetricMemoryUsed))
+	if withEnvelope {
+		record.MemoryEnvelope = mergeEnvelopes(memory, envelopes(func(r Record) *Envelope { return r.MemoryEnvelope }), nil)
+	}
+
+	if numGPUs > 0 {
+		record.GPURecords = make([]GPURecord, numGPUs)
+	}
+	for g := 0; g < numGPUs; g++ {
+		gpu := &record.GPURecords[g]
+		gpu.Index = records[0].GPURecords[g].Index
+
+		utilization := collect(func(r Record) int64 { return r.GPURecords[g].UtilizationMilli() })
+		gpu.GPUUtilizationMilli = aggregateWeighted(utilization, weights, policies.Get(MetricGPUUtilization))
+		gpu.GPUUtilization = UtilizationMilliToPercent(gpu.GPUUtilizationMilli)
+		if withEnvelope {
+			gpu.GPUUtilizationEnvelope = mergeEnvelopes(utilization,
+				envelopes(func(r Record) *Envelope { return r.GPURecords[g].GPUUtilizationEnvelope }), UtilizationMilliToPercent)
+		}
+
+		memory := collect(func(r Record) int64 { return r.GPURecords[g].MemoryUsed })
+		gpu.MemoryUsed = aggregateWeighted(memory, weights, policies.Get(MetricGPUMemoryUsed))
+		if withEnvelope {
+			gpu.MemoryEnvelope = mergeEnvelopes(memory, envelopes(func(r Record) *Envelope { return r.GPURecords[g].MemoryEnvelope }), nil)
 		}
+
+		gpu.GPUUtilizationMax = int(aggregateWeighted(collect(func(r Record) int64 { return int64(r.GPURecords[g].GPUUtilizationMax) }), weights,
+			policies.Get(MetricGPUUtilizationMax)))
+		gpu.Power = aggregateWeighted(collect(func(r Record) int64 { return r.GPURecords[g].Power }), weights,
+			policies.Get(MetricGPUPower))
+		gpu.Temperature = int(aggregateWeighted(collect(func(r Record) int64 { return int64(r.GPURecords[g].Temperature) }), weights,
+			policies.Get(MetricGPUTemperature)))
 	}
 
 	return record
@@ -101,7 +270,9 @@ func NewBuffer(interval int, size int) *Buffer {
 	p := new(Buffer)
 	p.Max = size
 	p.NextIndex = 0
-	p.Data = make([]Record, size)
+	p.data = newRecordColumns(size)
 	p.Interval = interval
+	p.BaseInterval = interval
+	p.OpenBucket = -1
 	return p
 }
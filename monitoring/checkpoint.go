@@ -0,0 +1,146 @@
+package monitoring
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const checkpointVersion = 1
+
+// Checkpoint is the state of the Metrics saved across the agent restarts
+type Checkpoint struct {
+	Version int              `json:"version"`
+	Saved   time.Time        `json:"saved"`
+	Tiers   []TierCheckpoint `json:"tiers"`
+}
+
+type TierCheckpoint struct {
+	Name         string    `json:"name"`
+	Interval     int       `json:"interval"`
+	BaseInterval int       `json:"base_interval"`
+	Max          int       `json:"max"`
+	NextIndex    int64     `json:"next_index"`
+	LastUpdated  time.Time `json:"last_updated"`
+	OpenBucket   int64     `json:"open_bucket"`
+
+	// the available records from the oldest one
+	Data    []Record `json:"data"`
+	Pending []Record `json:"pending,omitempty"`
+}
+
+func (m *Metrics) Checkpoint() Checkpoint {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	checkpoint := Checkpoint{
+		Version: checkpointVersion,
+		Saved:   time.Now(),
+		Tiers:   make([]TierCheckpoint, len(m.Tiers)),
+	}
+	for i, tier := range m.Tiers {
+		checkpoint.Tiers[i] = TierCheckpoint{
+			Name:         tier.Name,
+			Interval:     tier.Interval,
+			BaseInterval: tier.BaseInterval,
+			Max:          tier.Max,
+			NextIndex:    tier.NextIndex,
+			LastUpdated:  tier.LastUpdated,
+			OpenBucket:   tier.OpenBucket,
+			Data:         tier.LastAvailable(),
+			Pending:      append([]Record(nil), tier.Pending...),
+		}
+	}
+	return checkpoint
+}
+
+// Restore loads the tiers of the checkpoint by name.
+// The tiers with a different resolution are skipped, and the ones with a different capacity keep the latest points.
+// The next record continues the timeline with a gap marker for the downtime.
+func (m *Metrics) Restore(checkpoint Checkpoint) error {
+	if checkpoint.Version != checkpointVersion {
+		return fmt.Errorf("unsupported checkpoint version %d", checkpoint.Version)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, saved := range checkpoint.Tiers {
+		tier := m.Tier(saved.Name)
+		if tier == nil || tier.BaseInterval != saved.BaseInterval || (saved.Interval != saved.BaseInterval && !tier.Compact) {
+			log.Warnf("Skip restoring tier %s, the tier is removed or its resolution is changed", saved.Name)
+			continue
+		}
+		records := saved.Data
+		if saved.Max <= 0 || len(records) > saved.Max || int64(len(records)) > saved.NextIndex {
+			log.Warnf("Skip restoring tier %s, the checkpoint is corrupted", saved.Name)
+			continue
+		}
+
+		tier.Interval = saved.Interval
+		tier.OpenBucket = saved.OpenBucket
+		tier.Pending = append([]Record(nil), saved.Pending...)
+		tier.restoreRecords(records)
+		tier.LastUpdated = saved.LastUpdated
+		log.Infof("Restore tier %s with %d points", tier.Name, len(tier.LastAvailable()))
+	}
+	return nil
+}
+
+// RestoreDatasets loads the records of an existing monitoring document, e.g., written by the agent before a restart
+func (m *Metrics) RestoreDatasets(report Monitoring) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	intervals := make(map[string]int)
+	for _, spec := range report.Tiers {
+		intervals[spec.Name] = spec.Interval
+	}
+
+	for name, records := range report.Datasets {
+		tier := m.Tier(name)
+		if tier == nil || len(records) == 0 {
+			continue
+		}
+		if interval, ok := intervals[name]; ok && interval != tier.Interval {
+			if !tier.Compact || interval < tier.BaseInterval {
+				log.Warnf("Skip restoring tier %s, the resolution is changed from %ds to %ds", name, interval, tier.Interval)
+				continue
+			}
+			tier.Interval = interval
+		}
+		tier.restoreRecords(records)
+		log.Infof("Restore tier %s with %d points from the monitoring file", tier.Name, len(tier.LastAvailable()))
+	}
+}
+
+func (b *Buffer) restoreRecords(records []Record) {
+	if len(records) > b.Max {
+		records = records[len(records)-b.Max:]
+	}
+	b.reset()
+	for _, r := range records {
+		b.Add(r)
+	}
+}
+
+func SaveCheckpoint(path string, m *Metrics) error {
+	data, err := json.Marshal(m.Checkpoint())
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(path, data, 0644)
+}
+
+func LoadCheckpoint(path string) (Checkpoint, error) {
+	checkpoint := Checkpoint{}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return checkpoint, err
+	}
+	err = json.Unmarshal(data, &checkpoint)
+	return checkpoint, err
+}
@@ -0,0 +1,110 @@
+package monitoring
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestMetrics(lifetimeMax int) *Metrics {
+	metrics, _ := NewMetricsWithTiers([]TierConfig{
+		{Name: "15m", Resolution: 10 * time.Second, Retention: 15 * time.Minute},
+		{Name: "lifetime", Resolution: 30 * time.Second, Retention: time.Duration(lifetimeMax) * 30 * time.Second},
+	})
+	return metrics
+}
+
+func TestCheckpointAndRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "monitoring.state")
+
+	t.Log("Give metrics with 100 samples checkpointed to a state file")
+	base := int64(1000000020)
+	metrics := newTestMetrics(100)
+	for i := int64(0); i < 100; i++ {
+		metrics.Add(Record{Timestamp: base + i*10, MemoryUsed: i})
+	}
+	if err := SaveCheckpoint(path, metrics); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := newTestMetrics(100)
+	checkpoint, err := LoadCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.Restore(checkpoint); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(restored.Datasets(), metrics.Datasets()) {
+		t.Fatal("the restored datasets should be the same")
+	}
+	if restored.Tier("lifetime").OpenBucket != metrics.Tier("lifetime").OpenBucket {
+		t.Error("the open bucket should be restored")
+	}
+	t.Log("The datasets and the open bucket are restored")
+
+	t.Log("Add a sample 10 minutes after the last one")
+	restored.Add(Record{Timestamp: base + 99*10 + 600, MemoryUsed: 1})
+	latest := restored.Tier("15m").Last(2)
+	if !latest[0].Gap || latest[1].Gap {
+		t.Errorf("the timeline should continue with a gap marker, but got %v", latest)
+	}
+	t.Log("The timeline continues with a gap marker")
+}
+
+func TestRestoreDatasets(t *testing.T) {
+	t.Log("Give a monitoring file with 10 points in the lifetime tier")
+	report := Monitoring{
+		Tiers:    []TierSpec{{Name: "lifetime", Interval: 30, Capacity: 10}},
+		Datasets: Datasets{"lifetime": make([]Record, 10), "removed": make([]Record, 1)},
+	}
+	for i := range report.Datasets["lifetime"] {
+		report.Datasets["lifetime"][i].Timestamp = int64(i * 30)
+	}
+
+	metrics := newTestMetrics(4)
+	metrics.RestoreDatasets(report)
+	points := metrics.Tier("lifetime").LastAvailable()
+	if len(points) != 4 || points[0].Timestamp != 180 {
+		t.Errorf("expected the latest 4 points, but got %v", points)
+	}
+	t.Log("The tier with a smaller capacity keeps the latest points")
+}
+
+func TestRestoreSkipsChangedResolution(t *testing.T) {
+	metrics := newTestMetrics(10)
+	metrics.Add(Record{Timestamp: 1000000020})
+
+	checkpoint := metrics.Checkpoint()
+	checkpoint.Tiers[0].BaseInterval = 5
+	restored := newTestMetrics(10)
+	if err := restored.Restore(checkpoint); err != nil {
+		t.Fatal(err)
+	}
+	if len(restored.Tier("15m").LastAvailable()) != 0 {
+		t.Error("the tier with a different resolution should not be restored")
+	}
+}
+
+func TestCheckpointAvailableRecords(t *testing.T) {
+	t.Log("Give a fresh job with 3 samples and a lifetime of 8064 points")
+	metrics := newTestMetrics(8064)
+	for i := int64(0); i < 3; i++ {
+		metrics.Add(Record{Timestamp: 1000000020 + i*10})
+	}
+
+	checkpoint := metrics.Checkpoint()
+	if len(checkpoint.Tiers[0].Data) != 3 || len(checkpoint.Tiers[1].Data) != 0 {
+		t.Fatalf("expected only the available records, but got %d and %d",
+			len(checkpoint.Tiers[0].Data), len(checkpoint.Tiers[1].Data))
+	}
+	t.Log("Only the available records are checkpointed")
+}
@@ -4,9 +4,19 @@ type ResourceCollectorResult struct {
 	Utilization int
 	Memory      int64
 
+	// the precise utilization, in millicores for the cpu result and thousandths of a percent for the gpu result
+	UtilizationMilli int64
+
+	// the max utilization during the sampling window, used by gpu result
+	UtilizationMax int
+
 	// used by gpu result
 	Index int
 	GPU   []ResourceCollectorResult
+
+	// optional gpu sensors, in milliwatts and degrees Celsius
+	Power       int64
+	Temperature int
 }
 
 type ResourceCollector interface {
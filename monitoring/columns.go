@@ -0,0 +1,308 @@
+package monitoring
+
+import "math"
+
+const (
+	// the GPURecords of the record is not nil
+	columnHasGPUs uint8 = 1 << iota
+	columnGap
+	columnCpuEnvelope
+	columnMemoryEnvelope
+)
+
+const (
+	gpuHasUtilizationEnvelope uint8 = 1 << iota
+	gpuHasMemoryEnvelope
+)
+
+// recordColumns stores the records of a ring buffer in fixed-width columns by slot,
+// so a buffer holds a few large arrays instead of a GPURecords slice per record.
+// The records are decoded on read, the GPU columns are widened when a record has more GPUs than before.
+// The records read together share the backing arrays of their GPU records and envelopes.
+type recordColumns struct {
+	size int
+
+	// the timestamps are stored as offsets from base, or in wide if any offset does not fit in 32 bits
+	base    int64
+	hasBase bool
+	offsets []int32
+	wide    []int64
+
+	flags    []uint8
+	cpu      []int32
+	cpuMilli []int32
+	memory   []int64
+	samples  []int32
+
+	// the GPU columns hold width entries per slot, the first gpus[slot] of them are used
+	width        int
+	gpus         []uint8
+	gpuFlags     []uint8
+	gpuIndex     []int16
+	gpuMemory    []int64
+	gpuUtil      []int32
+	gpuUtilMilli []int32
+	gpuUtilMax   []int32
+	gpuPower     []int32
+	gpuTemp      []int16
+	gpuEnvelopes []Envelope
+
+	// cpu and memory envelopes by slot, allocated when the first envelope is stored
+	envelopes []Envelope
+}
+
+func newRecordColumns(size int) *recordColumns {
+	return &recordColumns{
+		size:     size,
+		offsets:  make([]int32, size),
+		flags:    make([]uint8, size),
+		cpu:      make([]int32, size),
+		cpuMilli: make([]int32, size),
+		memory:   make([]int64, size),
+		samples:  make([]int32, size),
+		gpus:     make([]uint8, size),
+	}
+}
+
+func (c *recordColumns) timestamp(slot int) int64 {
+	if c.wide != nil {
+		return c.wide[slot]
+	}
+	return c.base + int64(c.offsets[slot])
+}
+
+func (c *recordColumns) setTimestamp(slot int, timestamp int64) {
+	if c.wide != nil {
+		c.wide[slot] = timestamp
+		return
+	}
+	if !c.hasBase {
+		c.base = timestamp
+		c.hasBase = true
+	}
+	offset := timestamp - c.base
+	if offset >= math.MinInt32 && offset <= math.MaxInt32 {
+		c.offsets[slot] = int32(offset)
+		return
+	}
+
+	c.wide = make([]int64, c.size)
+	for i := range c.offsets {
+		c.wide[i] = c.base + int64(c.offsets[i])
+	}
+	c.offsets = nil
+	c.wide[slot] = timestamp
+}
+
+func (c *recordColumns) set(slot int, r Record) {
+	c.setTimestamp(slot, r.Timestamp)
+	c.cpu[slot] = int32(r.CpuUtilization)
+	c.cpuMilli[slot] = int32(r.CpuMillicores)
+	c.memory[slot] = r.MemoryUsed
+	c.samples[slot] = int32(r.Samples)
+
+	var flags uint8
+	if r.GPURecords != nil {
+		flags |= columnHasGPUs
+	}
+	if r.Gap {
+		flags |= columnGap
+	}
+	if r.CpuEnvelope != nil {
+		flags |= columnCpuEnvelope
+		c.setEnvelope(slot*2, *r.CpuEnvelope)
+	}
+	if r.MemoryEnvelope != nil {
+		flags |= columnMemoryEnvelope
+		c.setEnvelope(slot*2+1, *r.MemoryEnvelope)
+	}
+	c.flags[slot] = flags
+
+	if len(r.GPURecords) > c.width {
+		c.widen(len(r.GPURecords))
+	}
+	c.gpus[slot] = uint8(len(r.GPURecords))
+	for g, gpu := range r.GPURecords {
+		i := slot*c.width + g
+		c.gpuIndex[i] = int16(gpu.Index)
+		c.gpuMemory[i] = gpu.MemoryUsed
+		c.gpuUtil[i] = int32(gpu.GPUUtilization)
+		c.gpuUtilMilli[i] = int32(gpu.GPUUtilizationMilli)
+		c.gpuUtilMax[i] = int32(gpu.GPUUtilizationMax)
+		c.gpuPower[i] = int32(gpu.Power)
+		c.gpuTemp[i] = int16(gpu.Temperature)
+
+		var gpuFlags uint8
+		if gpu.GPUUtilizationEnvelope != nil {
+			gpuFlags |= gpuHasUtilizationEnvelope
+			c.setGPUEnvelope(i*2, *gpu.GPUUtilizationEnvelope)
+		}
+		if gpu.MemoryEnvelope != nil {
+			gpuFlags |= gpuHasMemoryEnvelope
+			c.setGPUEnvelope(i*2+1, *gpu.MemoryEnvelope)
+		}
+		c.gpuFlags[i] = gpuFlags
+	}
+}
+
+func (c *recordColumns) get(slot int) Record {
+	return c.decode(slot, &recordArena{})
+}
+
+// getRange decodes n records from the slot, wrapping around the ring,
+// the GPU records and the envelopes of the records share one backing array each
+func (c *recordColumns) getRange(slot int, n int) []Record {
+	gpus, envelopes := 0, 0
+	for i := 0; i < n; i++ {
+		s := (slot + i) % c.size
+		flags := c.flags[s]
+		if flags&columnCpuEnvelope != 0 {
+			envelopes++
+		}
+		if flags&columnMemoryEnvelope != 0 {
+			envelopes++
+		}
+		if flags&columnHasGPUs == 0 {
+			continue
+		}
+		gpus += int(c.gpus[s])
+		for g := 0; g < int(c.gpus[s]); g++ {
+			gpuFlags := c.gpuFlags[s*c.width+g]
+			if gpuFlags&gpuHasUtilizationEnvelope != 0 {
+				envelopes++
+			}
+			if gpuFlags&gpuHasMemoryEnvelope != 0 {
+				envelopes++
+			}
+		}
+	}
+
+	arena := recordArena{gpus: make([]GPURecord, gpus)}
+	if envelopes > 0 {
+		arena.envelopes = make([]Envelope, envelopes)
+	}
+	records := make([]Record, n)
+	for i := range records {
+		records[i] = c.decode((slot+i)%c.size, &arena)
+	}
+	return records
+}
+
+// recordArena backs the GPU records and the envelopes of the records decoded together,
+// a record decoded alone allocates its own
+type recordArena struct {
+	gpus      []GPURecord
+	envelopes []Envelope
+}
+
+func (a *recordArena) takeGPUs(n int) []GPURecord {
+	if n == 0 {
+		return []GPURecord{}
+	}
+	if len(a.gpus) < n {
+		return make([]GPURecord, n)
+	}
+	gpus := a.gpus[:n:n]
+	a.gpus = a.gpus[n:]
+	return gpus
+}
+
+func (a *recordArena) takeEnvelope(envelope Envelope) *Envelope {
+	if len(a.envelopes) == 0 {
+		p := new(Envelope)
+		*p = envelope
+		return p
+	}
+	a.envelopes[0] = envelope
+	p := &a.envelopes[0]
+	a.envelopes = a.envelopes[1:]
+	return p
+}
+
+func (c *recordColumns) decode(slot int, arena *recordArena) Record {
+	flags := c.flags[slot]
+	r := Record{
+		Timestamp:      c.timestamp(slot),
+		CpuUtilization: int(c.cpu[slot]),
+		CpuMillicores:  int64(c.cpuMilli[slot]),
+		MemoryUsed:     c.memory[slot],
+		Samples:        int(c.samples[slot]),
+		Gap:            flags&columnGap != 0,
+	}
+	if flags&columnCpuEnvelope != 0 {
+		r.CpuEnvelope = arena.takeEnvelope(c.envelopes[slot*2])
+	}
+	if flags&columnMemoryEnvelope != 0 {
+		r.MemoryEnvelope = arena.takeEnvelope(c.envelopes[slot*2+1])
+	}
+	if flags&columnHasGPUs == 0 {
+		return r
+	}
+
+	r.GPURecords = arena.takeGPUs(int(c.gpus[slot]))
+	for g := range r.GPURecords {
+		i := slot*c.width + g
+		gpu := &r.GPURecords[g]
+		gpu.Index = int(c.gpuIndex[i])
+		gpu.MemoryUsed = c.gpuMemory[i]
+		gpu.GPUUtilization = int(c.gpuUtil[i])
+		gpu.GPUUtilizationMilli = int64(c.gpuUtilMilli[i])
+		gpu.GPUUtilizationMax = int(c.gpuUtilMax[i])
+		gpu.Power = int64(c.gpuPower[i])
+		gpu.Temperature = int(c.gpuTemp[i])
+		if c.gpuFlags[i]&gpuHasUtilizationEnvelope != 0 {
+			gpu.GPUUtilizationEnvelope = arena.takeEnvelope(c.gpuEnvelopes[i*2])
+		}
+		if c.gpuFlags[i]&gpuHasMemoryEnvelope != 0 {
+			gpu.MemoryEnvelope = arena.takeEnvelope(c.gpuEnvelopes[i*2+1])
+		}
+	}
+	return r
+}
+
+func (c *recordColumns) setEnvelope(i int, envelope Envelope) {
+	if c.envelopes == nil {
+		c.envelopes = make([]Envelope, c.size*2)
+	}
+	c.envelopes[i] = envelope
+}
+
+func (c *recordColumns) setGPUEnvelope(i int, envelope Envelope) {
+	if c.gpuEnvelopes == nil {
+		c.gpuEnvelopes = make([]Envelope, c.size*c.width*2)
+	}
+	c.gpuEnvelopes[i] = envelope
+}
+
+// widen reallocates the GPU columns with width entries per slot, keeping the stored entries
+func (c *recordColumns) widen(width int) {
+	old := c.width
+	c.width = width
+	n := c.size * width
+
+	gpuFlags, gpuIndex, gpuMemory := make([]uint8, n), make([]int16, n), make([]int64, n)
+	gpuUtil, gpuUtilMilli, gpuUtilMax := make([]int32, n), make([]int32, n), make([]int32, n)
+	gpuPower, gpuTemp := make([]int32, n), make([]int16, n)
+	var gpuEnvelopes []Envelope
+	if c.gpuEnvelopes != nil {
+		gpuEnvelopes = make([]Envelope, n*2)
+	}
+	for slot := 0; slot < c.size && old > 0; slot++ {
+		from, to := slot*old, slot*width
+		copy(gpuFlags[to:to+old], c.gpuFlags[from:from+old])
+		copy(gpuIndex[to:to+old], c.gpuIndex[from:from+old])
+		copy(gpuMemory[to:to+old], c.gpuMemory[from:from+old])
+		copy(gpuUtil[to:to+old], c.gpuUtil[from:from+old])
+		copy(gpuUtilMilli[to:to+old], c.gpuUtilMilli[from:from+old])
+		copy(gpuUtilMax[to:to+old], c.gpuUtilMax[from:from+old])
+		copy(gpuPower[to:to+old], c.gpuPower[from:from+old])
+		copy(gpuTemp[to:to+old], c.gpuTemp[from:from+old])
+		if gpuEnvelopes != nil {
+			copy(gpuEnvelopes[to*2:(to+old)*2], c.gpuEnvelopes[from*2:(from+old)*2])
+		}
+	}
+	c.gpuFlags, c.gpuIndex, c.gpuMemory = gpuFlags, gpuIndex, gpuMemory
+	c.gpuUtil, c.gpuUtilMilli, c.gpuUtilMax = gpuUtil, gpuUtilMilli, gpuUtilMax
+	c.gpuPower, c.gpuTemp = gpuPower, gpuTemp
+	c.gpuEnvelopes = gpuEnvelopes
+}
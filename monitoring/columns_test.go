@@ -0,0 +1,183 @@
+package monitoring
+
+import (
+	"reflect"
+	"testing"
+)
+
+func newTestGPURecords(n int, value int) []GPURecord {
+	gpus := make([]GPURecord, n)
+	for g := range gpus {
+		gpus[g] = GPURecord{
+			Index:             g,
+			MemoryUsed:        int64(value) << 30,
+			GPUUtilization:    value % 100,
+			GPUUtilizationMax: value%100 + 1,
+			Power:             250000,
+			Temperature:       70,
+		}
+	}
+	return gpus
+}
+
+func TestRecordColumns(t *testing.T) {
+	t.Log("Give records with no GPU, 2 GPUs, 8 GPUs, envelopes and gaps")
+	records := []Record{
+		{Timestamp: 1000000000, CpuUtilization: 120, MemoryUsed: 1 << 30},
+		{Timestamp: 1000000010, CpuUtilization: 5, GPURecords: []GPURecord{}},
+		{Timestamp: 1000000020, GPURecords: newTestGPURecords(2, 42)},
+		NewGapRecord(1000000030),
+		{
+			Timestamp:      1000000040,
+			CpuUtilization: 80,
+			MemoryUsed:     2 << 30,
+			GPURecords:     newTestGPURecords(8, 99),
+			CpuEnvelope:    &Envelope{Min: 10, Max: 90, P95: 85},
+			MemoryEnvelope: &Envelope{Min: 1, Max: 3, P95: 3},
+			Samples:        30,
+		},
+	}
+	records[4].GPURecords[7].GPUUtilizationEnvelope = &Envelope{Min: 0, Max: 100, P95: 97}
+	records[4].GPURecords[7].MemoryEnvelope = &Envelope{Min: 5, Max: 7, P95: 7}
+
+	buffer := NewBuffer(10, 4)
+	for _, r := range records {
+		buffer.Add(r)
+	}
+	if got := buffer.LastAvailable(); !reflect.DeepEqual(got, records[1:]) {
+		t.Errorf("expected %+v, but got %+v", records[1:], got)
+	}
+	t.Log("The records are decoded as they were added, the GPU columns are widened for the 8 GPUs")
+
+	t.Log("Give a timestamp too far from the others for a 32-bit offset")
+	buffer.Add(Record{Timestamp: 1 << 40, GPURecords: newTestGPURecords(1, 1)})
+	if latest, _ := buffer.Latest(); latest.Timestamp != 1<<40 || buffer.At(0).Timestamp != 1000000020 {
+		t.Errorf("expected the timestamps kept in 64 bits, but got %v", buffer.LastAvailable())
+	}
+}
+
+func TestRecordColumnsShareBackingArray(t *testing.T) {
+	t.Log("Give 100 records of 8 GPUs with envelopes in a ring of 64")
+	buffer := NewBuffer(10, 64)
+	for i := 0; i < 100; i++ {
+		r := Record{Timestamp: int64(i) * 10, GPURecords: newTestGPURecords(8, i), CpuEnvelope: &Envelope{Max: int64(i)}}
+		r.GPURecords[0].MemoryEnvelope = &Envelope{Max: int64(i)}
+		buffer.Add(r)
+	}
+
+	allocs := testing.AllocsPerRun(10, func() { buffer.LastAvailable() })
+	if allocs > 3 {
+		t.Errorf("expected the records, the GPU records and the envelopes in 3 allocations, but got %v", allocs)
+	}
+	t.Log("The records read together share the backing arrays")
+
+	records := buffer.LastAvailable()
+	records[0].GPURecords = append(records[0].GPURecords, GPURecord{Index: 8})
+	if records[1].GPURecords[0].Index != 0 || len(records[1].GPURecords) != 8 || records[63].CpuEnvelope.Max != 99 {
+		t.Errorf("expected the records independent of each other, but got %+v", records[1])
+	}
+	if !reflect.DeepEqual(buffer.At(63), records[63]) || buffer.At(63).GPURecords[0].MemoryEnvelope.Max != 99 {
+		t.Errorf("expected the same record read alone, but got %+v", buffer.At(63))
+	}
+}
+
+// recordRing is the buffer of a Record slice the columns replace, as the baseline of the benchmarks
+type recordRing struct {
+	data      []Record
+	nextIndex int
+}
+
+func (r *recordRing) add(record Record) {
+	r.data[r.nextIndex%len(r.data)] = record
+	r.nextIndex++
+}
+
+// last copies the available records like Buffer.Last did, sharing their GPURecords
+func (r *recordRing) last() []Record {
+	n := r.nextIndex
+	if n > len(r.data) {
+		n = len(r.data)
+	}
+	records := make([]Record, n)
+	for i := range records {
+		records[i] = r.data[(r.nextIndex-n+i)%len(r.data)]
+	}
+	return records
+}
+
+// fill a lifetime tier of 8064 points on an 8-GPU node, every aggregated point comes with its GPURecords
+func BenchmarkLifetimeBuffer(b *testing.B) {
+	const points, gpus = 8064, 8
+
+	b.Run("records", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			ring := recordRing{data: make([]Record, points)}
+			for i := 0; i < points; i++ {
+				ring.add(Record{Timestamp: int64(i) * 300, CpuUtilization: i, GPURecords: newTestGPURecords(gpus, i)})
+			}
+		}
+	})
+
+	b.Run("columns", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			buffer := NewBuffer(300, points)
+			for i := 0; i < points; i++ {
+				buffer.Add(Record{Timestamp: int64(i) * 300, CpuUtilization: i, GPURecords: newTestGPURecords(gpus, i)})
+			}
+		}
+	})
+}
+
+func BenchmarkBufferAdd(b *testing.B) {
+	b.ReportAllocs()
+	buffer := NewBuffer(300, 8064)
+	record := Record{Timestamp: 1000000000, GPURecords: newTestGPURecords(8, 1)}
+	for n := 0; n < b.N; n++ {
+		record.Timestamp += 300
+		buffer.Add(record)
+	}
+}
+
+// read a full lifetime tier on an 8-GPU node, as every flush does
+func BenchmarkBufferLastAvailable(b *testing.B) {
+	const points, gpus = 8064, 8
+
+	b.Run("records", func(b *testing.B) {
+		ring := recordRing{data: make([]Record, points)}
+		for i := 0; i < points; i++ {
+			ring.add(Record{Timestamp: int64(i) * 300, GPURecords: newTestGPURecords(gpus, i)})
+		}
+		b.ReportAllocs()
+		b.ResetTimer()
+		for n := 0; n < b.N; n++ {
+			ring.last()
+		}
+	})
+
+	b.Run("columns", func(b *testing.B) {
+		buffer := NewBuffer(300, points)
+		for i := 0; i < points; i++ {
+			buffer.Add(Record{Timestamp: int64(i) * 300, GPURecords: newTestGPURecords(gpus, i)})
+		}
+		b.ReportAllocs()
+		b.ResetTimer()
+		for n := 0; n < b.N; n++ {
+			buffer.LastAvailable()
+		}
+	})
+}
+
+func BenchmarkBufferEachBetween(b *testing.B) {
+	b.ReportAllocs()
+	buffer := NewBuffer(300, 8064)
+	gpuRecords := newTestGPURecords(8, 1)
+	for i := 0; i < 8064; i++ {
+		buffer.Add(Record{Timestamp: int64(i) * 300, GPURecords: gpuRecords})
+	}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		buffer.EachBetween(8000*300, 8064*300, func(r Record) bool { return true })
+	}
+}
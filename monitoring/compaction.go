@@ -0,0 +1,53 @@
+package monitoring
+
+import log "github.com/sirupsen/logrus"
+
+// addCompacting adds the point of BaseInterval to an adaptive tier.
+// Once the tier has been compacted, the points are merged in Pending until a bucket of the Interval in effect is complete.
+func (m *Metrics) addCompacting(tier *Buffer, point Record) {
+	if tier.Interval != tier.BaseInterval {
+		if len(tier.Pending) > 0 && alignTimestamp(point.Timestamp, tier.Interval) != alignTimestamp(tier.Pending[0].Timestamp, tier.Interval) {
+			tier.Add(m.mergeBucket(tier.Pending, tier.Interval))
+			tier.Pending = nil
+		}
+		tier.Pending = append(tier.Pending, point)
+	} else {
+		tier.Add(point)
+	}
+
+	// the points straddling the buckets are not merged, compact again until there is room
+	for tier.NextIndex >= int64(tier.Max) {
+		m.compact(tier)
+	}
+}
+
+// compact merges the points of the full tier pairwise into the buckets of the doubled interval
+func (m *Metrics) compact(tier *Buffer) {
+	interval := tier.Interval * 2
+	records := tier.LastAvailable()
+
+	merged := make([]Record, 0, len(records)/2+1)
+	from := 0
+	for i := 1; i <= len(records); i++ {
+		if i < len(records) && alignTimestamp(records[i].Timestamp, interval) == alignTimestamp(records[from].Timestamp, interval) {
+			continue
+		}
+		merged = append(merged, m.mergeBucket(records[from:i], interval))
+		from = i
+	}
+
+	log.Infof("Compact tier %s from %d points of %ds to %d points of %ds",
+		tier.Name, len(records), tier.Interval, len(merged), interval)
+	tier.reset()
+	tier.Interval = interval
+	for _, r := range merged {
+		tier.Add(r)
+	}
+}
+
+// mergeBucket merges the points with their envelopes, the means are weighted by the samples of each point
+func (m *Metrics) mergeBucket(records []Record, interval int) Record {
+	point := aggregateRecords(records, m.Policies, m.Envelopes)
+	point.Timestamp = alignTimestamp(records[0].Timestamp, interval)
+	return point
+}
@@ -0,0 +1,96 @@
+package monitoring
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAdaptiveTier(t *testing.T) {
+	t.Log("Give an adaptive tier of 4 points at 20s, fed by 10s samples")
+	metrics, err := NewMetricsWithTiers([]TierConfig{
+		{Name: "10s", Resolution: 10 * time.Second, Retention: time.Minute},
+		{Name: "lifetime", Resolution: 20 * time.Second, Retention: 80 * time.Second, Adaptive: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := int64(1000000000)
+	for i := int64(0); i <= 18; i++ {
+		metrics.Add(Record{Timestamp: base + i*10, MemoryUsed: i})
+	}
+
+	// 9 buckets of 20s are closed: the 4th one fills the tier and compacts it to 2 points of 40s,
+	// the next 4 are merged into 2 points of 40s which fill the tier again, the 9th one is pending
+	lifetime := metrics.Tier("lifetime")
+	if lifetime.Interval != 80 {
+		t.Fatalf("expected the resolution halved twice to 80s, but got %ds", lifetime.Interval)
+	}
+	t.Log("The resolution is halved twice to 80s")
+
+	points := lifetime.LastAvailable()
+	if len(points) != 2 || points[0].Timestamp != base || points[1].Timestamp != base+80 {
+		t.Fatalf("expected 2 points of 80s covering the whole lifetime, but got %v", points)
+	}
+	if points[0].MemoryUsed != 7 || points[0].Samples != 8 {
+		t.Errorf("expected the max memory 7 of 8 samples, but got %+v", points[0])
+	}
+	t.Log("The points cover the whole lifetime with the merged samples")
+
+	spec := metrics.TierSpecs()[1]
+	if spec.Interval != 80 || !spec.Adaptive {
+		t.Errorf("the spec should report the resolution in effect, but got %+v", spec)
+	}
+}
+
+func TestAdaptiveTierKeepsSpike(t *testing.T) {
+	t.Log("Give an adaptive tier of 4 points at 20s with envelopes, fed by 10s samples from 1000000010")
+	metrics, err := NewMetricsWithTiers([]TierConfig{
+		{Name: "10s", Resolution: 10 * time.Second, Retention: time.Minute},
+		{Name: "lifetime", Resolution: 20 * time.Second, Retention: 80 * time.Second, Adaptive: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics.Envelopes = true
+
+	t.Log("The cpu is 10% with a spike of 90% at 1000000040")
+	base := int64(1000000000)
+	for i := int64(1); i <= 19; i++ {
+		cpu := int64(100)
+		if i == 4 {
+			cpu = 900
+		}
+		metrics.Add(Record{Timestamp: base + i*10, CpuMillicores: cpu})
+	}
+
+	lifetime := metrics.Tier("lifetime")
+	if lifetime.Interval != 80 {
+		t.Fatalf("expected the resolution halved twice to 80s, but got %ds", lifetime.Interval)
+	}
+	point := lifetime.LastAvailable()[0]
+	if point.Samples != 7 || *point.CpuEnvelope != (Envelope{Min: 10, Max: 90, P95: 90}) {
+		t.Errorf("expected the spike in the envelope of 7 samples, but got %+v and %+v", point, *point.CpuEnvelope)
+	}
+	t.Log("The spike survives two compactions")
+
+	if point.CpuMillicores != 214 {
+		t.Errorf("expected the mean of the 7 samples 214m, but got %dm", point.CpuMillicores)
+	}
+	t.Log("The mean is weighted by the samples of the merged points")
+}
+
+func TestAdaptiveTierShouldBeTheCoarsest(t *testing.T) {
+	_, err := ParseTiers("15m=10s/15m/adaptive,1h=30s/1h")
+	if err == nil {
+		t.Fatal("an adaptive tier in the middle should be invalid")
+	}
+
+	tiers, err := ParseTiers("15m=10s/15m,lifetime=5m/4w/adaptive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tiers[1].Adaptive {
+		t.Error("lifetime should be adaptive")
+	}
+}
@@ -2,12 +2,19 @@ package monitoring
 
 import (
 	log "github.com/sirupsen/logrus"
+	"math"
 	"os"
+	"sync"
 	"time"
 )
 
 const UnlimitedMemory = 9223372036854771712
 
+const DefaultCpuUpdateInterval = 5 * time.Second
+
+// the cpu usage is stale after 3 missed updates
+const cpuStaleUpdates = 3
+
 type CpuMemoryCollector struct {
 	// The path should be one of
 	// /sys/fs/cgroup/cpuacct/cpuacct.usage
@@ -17,17 +24,27 @@ type CpuMemoryCollector struct {
 	StartedTime      time.Time
 	CpuAcctValue     int64
 	CpuUsageValue    int
+	CpuMillicores    int64
 	MemoryUsage      int64
 	MemoryTotal      int64
 	StopFlag         chan int
+
+	// The cpu and memory usage are read every UpdateInterval, DefaultCpuUpdateInterval if it is 0
+	UpdateInterval time.Duration
+
+	// guards the values updated by the update goroutine
+	mutex sync.RWMutex
 }
 
 func (r *CpuMemoryCollector) Fetch() ResourceCollectorResult {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
 	return ResourceCollectorResult{
-		Utilization: r.CpuUsageValue,
-		Memory:      r.MemoryUsage,
-		Index:       0,
-		GPU:         nil,
+		Utilization:      r.CpuUsageValue,
+		UtilizationMilli: r.CpuMillicores,
+		Memory:           r.MemoryUsage,
+		Index:            0,
+		GPU:              nil,
 	}
 }
 
@@ -58,14 +75,15 @@ func (r *CpuMemoryCollector) Start() {
 }
 
 func (r *CpuMemoryCollector) update() {
-	ticker := time.NewTicker(time.Duration(5) * time.Second)
+	ticker := time.NewTicker(r.updateInterval())
 	for {
 		select {
 		case <-ticker.C:
 			r.updateCpuUsage()
 			r.updateMemoryUsage()
 		case <-r.StopFlag:
-			break
+			ticker.Stop()
+			return
 		}
 	}
 
@@ -73,14 +91,17 @@ func (r *CpuMemoryCollector) update() {
 
 func (r *CpuMemoryCollector) updateCpuUsage() {
 	number, err := ReadNumber(r.CpuAcctUsagePath)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
 	if err == nil {
 		if r.UpdateTime.IsZero() {
 			r.updateCpuCurrentValue(number)
 		} else {
 			// calculate usage before update current values
 			// CPU Usage = Δ cpuacct.usage / duration
-			duration := int(time.Now().Sub(r.UpdateTime).Nanoseconds())
-			r.CpuUsageValue = int(number-r.CpuAcctValue) * 100 / duration
+			duration := time.Now().Sub(r.UpdateTime).Nanoseconds()
+			r.CpuMillicores = int64(math.Round(float64(number-r.CpuAcctValue) * 1000 / float64(duration)))
+			r.CpuUsageValue = MillicoresToPercent(r.CpuMillicores)
 			r.updateCpuCurrentValue(number)
 		}
 	}
@@ -95,8 +116,34 @@ func (r *CpuMemoryCollector) updateMemoryUsage() {
 	usageInBytes, usageErr := ReadNumber("/sys/fs/cgroup/memory/memory.usage_in_bytes")
 	inactive, inactiveErr := ReadTotalInactiveFile("/sys/fs/cgroup/memory/memory.stat")
 	if usageErr == nil && inactiveErr == nil {
+		r.mutex.Lock()
 		r.MemoryUsage = usageInBytes - inactive
+		r.mutex.Unlock()
+	}
+}
+
+// IsStale reports the cpu usage hasn't been updated for a while, e.g., cpuacct.usage cannot be read anymore.
+// It is never stale if the cpu usage is not available at all.
+func (r *CpuMemoryCollector) IsStale() bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if r.UpdateTime.IsZero() {
+		return false
+	}
+	return r.UpdateTime.Before(time.Now().Add(-cpuStaleUpdates * r.updateInterval()))
+}
+
+func (r *CpuMemoryCollector) updateInterval() time.Duration {
+	if r.UpdateInterval <= 0 {
+		return DefaultCpuUpdateInterval
 	}
+	return r.UpdateInterval
+}
+
+func (r *CpuMemoryCollector) LastUpdated() time.Time {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.UpdateTime
 }
 
 func (r *CpuMemoryCollector) Stop() {
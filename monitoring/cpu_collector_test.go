@@ -0,0 +1,26 @@
+package monitoring
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCpuMemoryCollectorIsStale(t *testing.T) {
+	t.Log("Give a collector reading the usage every second, last updated 2s ago")
+	collector := CpuMemoryCollector{UpdateInterval: time.Second, UpdateTime: time.Now().Add(-2 * time.Second)}
+	if collector.IsStale() {
+		t.Fatal("expected not stale within 3 updates")
+	}
+
+	collector.UpdateTime = time.Now().Add(-4 * time.Second)
+	if !collector.IsStale() {
+		t.Fatal("expected stale after 3 missed updates")
+	}
+	t.Log("The usage is stale after 3 missed updates of the update interval")
+
+	t.Log("Give a collector of the default interval, last updated 4s ago")
+	collector.UpdateInterval = 0
+	if collector.IsStale() {
+		t.Error("expected not stale within 3 updates of 5s")
+	}
+}
@@ -0,0 +1,146 @@
+package monitoring
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultWriteRetries = 2
+	DefaultWriteBackoff = 500 * time.Millisecond
+)
+
+// FileSink writes the report as a JSON file atomically, a reader never sees a truncated file.
+// A failed write is retried with an exponential backoff, then the next path of the chain is tried.
+// Once on a fallback path, the earlier paths are tried once per write, so the sink moves back when they recover.
+type FileSink struct {
+	// the failed attempts, including the retried ones, and the bytes written,
+	// first for the 64-bit alignment of atomic
+	failures int64
+	written  int64
+
+	// Paths from the primary one
+	Paths   []string
+	Retries int
+	Backoff time.Duration
+
+	// Encode the report, json.Marshal by default
+	Encode func(report Monitoring) ([]byte, error)
+
+	name string
+
+	// index of the path written last time
+	current int32
+}
+
+func NewFileSink(paths ...string) *FileSink {
+	return &FileSink{Paths: paths, Retries: DefaultWriteRetries, Backoff: DefaultWriteBackoff, name: "file"}
+}
+
+// NewLegacyFileSink writes the legacy layout of version 1, e.g., for the readers during a migration
+func NewLegacyFileSink(paths ...string) *FileSink {
+	s := NewFileSink(paths...)
+	s.Encode = MarshalLegacy
+	s.name = "legacy"
+	return s
+}
+
+// NewBinaryFileSink writes the binary encoding, a fraction of the JSON size for the long tiers
+func NewBinaryFileSink(paths ...string) *FileSink {
+	s := NewFileSink(paths...)
+	s.Encode = MarshalBinary
+	s.name = "binary"
+	return s
+}
+
+func (s *FileSink) Name() string {
+	return s.name
+}
+
+func (s *FileSink) Write(report Monitoring) error {
+	encode := s.Encode
+	if encode == nil {
+		encode = func(report Monitoring) ([]byte, error) {
+			return json.Marshal(report)
+		}
+	}
+	data, err := encode(report)
+	if err != nil {
+		return err
+	}
+	return s.WriteData(data)
+}
+
+// WriteData writes the data to the first path of the chain that accepts it
+func (s *FileSink) WriteData(data []byte) error {
+	if len(s.Paths) == 0 {
+		return fmt.Errorf("no path to write")
+	}
+
+	var err error
+	current := int(atomic.LoadInt32(&s.current))
+	for i, path := range s.Paths {
+		attempts := 1
+		if i >= current {
+			attempts += s.Retries
+		}
+		if err = s.writeWithRetry(path, data, attempts); err != nil {
+			if i < current {
+				// still failing, it has been warned on the fallback
+				log.Debugf("Cannot write %s: %v", path, err)
+			} else {
+				log.Warnf("Cannot write %s: %v", path, err)
+			}
+			continue
+		}
+
+		if i < current {
+			log.Infof("Path %s is recovered, move back from %s", path, s.Paths[current])
+		} else if i > current {
+			log.Warnf("Fallback from %s to %s", s.Paths[current], path)
+		}
+		atomic.StoreInt32(&s.current, int32(i))
+		return nil
+	}
+	return err
+}
+
+func (s *FileSink) writeWithRetry(path string, data []byte, attempts int) error {
+	var err error
+	backoff := s.Backoff
+	for a := 0; a < attempts; a++ {
+		if a > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		if err = WriteFileAtomic(path, data, 0644); err == nil {
+			atomic.AddInt64(&s.written, int64(len(data)))
+			return nil
+		}
+		atomic.AddInt64(&s.failures, 1)
+	}
+	return err
+}
+
+// Current returns the path written last time
+func (s *FileSink) Current() string {
+	return s.Paths[atomic.LoadInt32(&s.current)]
+}
+
+// Failures returns the number of the failed attempts
+func (s *FileSink) Failures() int64 {
+	return atomic.LoadInt64(&s.failures)
+}
+
+// Written returns the bytes written
+func (s *FileSink) Written() int64 {
+	return atomic.LoadInt64(&s.written)
+}
+
+func (s *FileSink) Close() error {
+	return nil
+}
@@ -0,0 +1,136 @@
+package monitoring
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const amdVendorId = "0x1002"
+
+var drmCardPattern = regexp.MustCompile(`^card(\d+)$`)
+
+// AmdBackend reads the gpu usage from the amdgpu driver sysfs
+type AmdBackend struct {
+	// The path should be /sys/class/drm, overwritten by tests
+	SysfsRoot string
+
+	cards []amdCard
+}
+
+type amdCard struct {
+	Index int
+
+	// /sys/class/drm/cardN/device
+	DevicePath string
+
+	// /sys/class/drm/cardN/device/hwmon/hwmonM, empty if not found
+	HwmonPath string
+}
+
+func (a *AmdBackend) Name() string {
+	return GpuBackendAmd
+}
+
+func (a *AmdBackend) Init() error {
+	if a.SysfsRoot == "" {
+		a.SysfsRoot = "/sys/class/drm"
+	}
+
+	entries, err := ioutil.ReadDir(a.SysfsRoot)
+	if err != nil {
+		return err
+	}
+
+	a.cards = make([]amdCard, 0)
+	for _, entry := range entries {
+		match := drmCardPattern.FindStringSubmatch(entry.Name())
+		if match == nil {
+			continue
+		}
+
+		devicePath := filepath.Join(a.SysfsRoot, entry.Name(), "device")
+		vendor, err := ioutil.ReadFile(filepath.Join(devicePath, "vendor"))
+		if err != nil || strings.TrimSpace(string(vendor)) != amdVendorId {
+			continue
+		}
+
+		// only the amdgpu driver exposes the busy percent
+		if _, err := ReadNumber(filepath.Join(devicePath, "gpu_busy_percent")); err != nil {
+			continue
+		}
+
+		index, _ := strconv.Atoi(match[1])
+		card := amdCard{Index: index, DevicePath: devicePath}
+		if hwmons, _ := filepath.Glob(filepath.Join(devicePath, "hwmon", "hwmon*")); len(hwmons) > 0 {
+			sort.Strings(hwmons)
+			card.HwmonPath = hwmons[0]
+		}
+		a.cards = append(a.cards, card)
+	}
+
+	if len(a.cards) == 0 {
+		return errors.New("no amdgpu device found")
+	}
+	sort.Slice(a.cards, func(i, j int) bool { return a.cards[i].Index < a.cards[j].Index })
+	return nil
+}
+
+func (a *AmdBackend) Shutdown() {
+}
+
+func (a *AmdBackend) Devices() ([]GPUSpec, error) {
+	devices := make([]GPUSpec, len(a.cards))
+	for i, card := range a.cards {
+		total, err := ReadNumber(filepath.Join(card.DevicePath, "mem_info_vram_total"))
+		if err != nil {
+			log.Warn(err)
+		}
+		devices[i].Index = card.Index
+		devices[i].MemoryTotal = total
+		if uniqueId, err := ioutil.ReadFile(filepath.Join(card.DevicePath, "unique_id")); err == nil {
+			devices[i].UUID = strings.TrimSpace(string(uniqueId))
+		}
+	}
+	return devices, nil
+}
+
+// Sample fails if the busy percent or the vram used of a card cannot be read, the sensors are optional
+func (a *AmdBackend) Sample() ([]ResourceCollectorResult, error) {
+	results := make([]ResourceCollectorResult, len(a.cards))
+	var sampleErr error
+	for i, card := range a.cards {
+		results[i].Index = card.Index
+
+		busy, err := ReadNumber(filepath.Join(card.DevicePath, "gpu_busy_percent"))
+		if err != nil {
+			sampleErr = err
+			continue
+		}
+		used, err := ReadNumber(filepath.Join(card.DevicePath, "mem_info_vram_used"))
+		if err != nil {
+			sampleErr = err
+			continue
+		}
+		results[i].Utilization = int(busy)
+		results[i].Memory = used
+
+		if card.HwmonPath == "" {
+			continue
+		}
+		// power1_average is in microwatts, temp1_input is in millidegrees Celsius
+		if power, err := ReadNumber(filepath.Join(card.HwmonPath, "power1_average")); err == nil {
+			results[i].Power = power / 1000
+		}
+		if temperature, err := ReadNumber(filepath.Join(card.HwmonPath, "temp1_input")); err == nil {
+			results[i].Temperature = int(temperature / 1000)
+		}
+	}
+	return results, sampleErr
+}
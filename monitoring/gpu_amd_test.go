@@ -0,0 +1,101 @@
+package monitoring
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeSysfs(t *testing.T, root string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAmdBackend(t *testing.T) {
+	root, err := ioutil.TempDir("", "fake-drm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	t.Log("Give a fake sysfs with an amdgpu card1, an intel card0 and a connector card1-DP-1")
+	writeSysfs(t, root, map[string]string{
+		"card0/device/vendor":                      "0x8086\n",
+		"card1/device/vendor":                      "0x1002\n",
+		"card1/device/gpu_busy_percent":            "37\n",
+		"card1/device/mem_info_vram_total":         "17163091968\n",
+		"card1/device/mem_info_vram_used":          "1073741824\n",
+		"card1/device/hwmon/hwmon3/power1_average": "125000000\n",
+		"card1/device/hwmon/hwmon3/temp1_input":    "54000\n",
+		"card1-DP-1/status":                        "disconnected\n",
+	})
+
+	collector := GpuMemoryCollector{Backend: &AmdBackend{SysfsRoot: root}}
+	collector.Start()
+	defer collector.Stop()
+
+	if !collector.Available || collector.NumDevices != 1 {
+		t.Fatalf("collector should have 1 device, but got %d", collector.NumDevices)
+	}
+	if collector.Devices[0].Index != 0 || collector.Devices[0].MemoryTotal != 17163091968 {
+		t.Errorf("unexpected spec %+v", collector.Devices[0])
+	}
+	t.Log("Spec has job index 0 and memory total from mem_info_vram_total")
+
+	gpu := collector.Fetch().GPU[0]
+	if gpu.Utilization != 37 || gpu.Memory != 1073741824 {
+		t.Errorf("unexpected usage %+v", gpu)
+	}
+	t.Log("Usage has utilization 37 and memory from mem_info_vram_used")
+
+	if gpu.Power != 125000 || gpu.Temperature != 54 {
+		t.Errorf("unexpected sensors %+v", gpu)
+	}
+	t.Log("Sensors have power 125000 mW and temperature 54 C")
+}
+
+func TestAmdBackendFailedSample(t *testing.T) {
+	root, err := ioutil.TempDir("", "fake-drm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	t.Log("Give an amdgpu card whose vram used cannot be read")
+	writeSysfs(t, root, map[string]string{
+		"card0/device/vendor":           "0x1002\n",
+		"card0/device/gpu_busy_percent": "37\n",
+	})
+	collector := GpuMemoryCollector{Backend: &AmdBackend{SysfsRoot: root}}
+	collector.Start()
+	defer collector.Stop()
+
+	if _, err := collector.Backend.Sample(); err == nil {
+		t.Error("expected the sample failed")
+	}
+	if gpu := collector.Fetch().GPU; gpu != nil {
+		t.Errorf("expected no usage, but got %+v", gpu)
+	}
+	t.Log("The failed sample is not read as an idle gpu")
+}
+
+func TestAmdBackendWithoutDevices(t *testing.T) {
+	root, err := ioutil.TempDir("", "fake-drm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	backend := &AmdBackend{SysfsRoot: root}
+	if err := backend.Init(); err == nil {
+		t.Fatal("Init should fail without amdgpu devices")
+	}
+}
@@ -0,0 +1,42 @@
+package monitoring
+
+// GpuBackend is the source of the gpu devices and their usage
+type GpuBackend interface {
+	Name() string
+	Init() error
+	Shutdown()
+
+	// return the spec of the available devices
+	Devices() ([]GPUSpec, error)
+
+	// return the usage of each device, in the same order as Devices()
+	Sample() ([]ResourceCollectorResult, error)
+}
+
+const (
+	GpuBackendAuto      = "auto"
+	GpuBackendNvml      = "nvml"
+	GpuBackendNvidiaSmi = "nvidia-smi"
+	GpuBackendAmd       = "amd"
+)
+
+// candidates in the order of preference, used by the auto selection
+func gpuBackendCandidates() []GpuBackend {
+	return []GpuBackend{
+		&NvmlBackend{},
+		&NvidiaSmiBackend{},
+		&AmdBackend{},
+	}
+}
+
+func NewGpuBackend(name string) GpuBackend {
+	switch name {
+	case GpuBackendNvml:
+		return &NvmlBackend{}
+	case GpuBackendNvidiaSmi:
+		return &NvidiaSmiBackend{}
+	case GpuBackendAmd:
+		return &AmdBackend{}
+	}
+	return nil
+}
@@ -1,100 +1,257 @@
 package monitoring
 
 import (
-	"github.com/mindprince/gonvml"
+	"sync"
+	"time"
+
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	DefaultGpuPollInterval = time.Second
+
+	// nvidia-smi starts a process on every sample, which is too heavy to poll every second
+	DefaultNvidiaSmiPollInterval = 5 * time.Second
+
+	// GpuPollIntervalDefault polls at the default interval of the backend
+	GpuPollIntervalDefault time.Duration = -1
+
+	// the gpu usage is stale after 3 missed samples
+	gpuStaleSamples = 3
+)
+
 type GpuMemoryCollector struct {
+	// The backend to use, selected automatically when it is nil
+	Backend    GpuBackend
 	Available  bool
 	NumDevices int
-	Devices    []GPUSpec
+
+	// The devices visible to the job, the Index is the index seen by the job
+	Devices []GPUSpec
+
+	// The utilization is polled at PollInterval and aggregated until the next Fetch,
+	// the polling is disabled when it is 0, then Fetch takes an instantaneous reading.
+	// GpuPollIntervalDefault is resolved by the backend selected.
+	PollInterval time.Duration
+	StopFlag     chan int
+
+	// The pace of Fetch, the usage is stale after 3 missed samples of PollInterval,
+	// or of UpdateInterval if the polling is disabled
+	UpdateInterval time.Duration
+
+	// positions of Devices in the devices enumerated by the backend
+	selected []int
+
+	mutex  sync.Mutex
+	window gpuUtilizationWindow
+
+	// the time of the latest successful sample, guarded by mutex
+	sampled time.Time
+
+	// serializes the backend sampling of the update goroutine and Fetch
+	sampleMutex sync.Mutex
+}
+
+// gpuUtilizationWindow aggregates the polled samples since the last Fetch
+type gpuUtilizationWindow struct {
+	count int
+	sum   []int
+	max   []int
+	last  []ResourceCollectorResult
 }
 
 func (g *GpuMemoryCollector) Start() {
-	err := gonvml.Initialize()
 	g.Available = false
 	g.Devices = make([]GPUSpec, 0)
 
-	if err != nil {
-		log.Warn(err)
+	if g.Backend == nil {
+		g.Backend = selectGpuBackend(gpuBackendCandidates())
+		if g.Backend == nil {
+			return
+		}
+	} else if err := g.Backend.Init(); err != nil {
+		log.Warnf("Cannot init gpu backend %s: %v", g.Backend.Name(), err)
 		return
 	}
 
-	numDevices, err := gonvml.DeviceCount()
-	log.Infof("Get %d gpu-devices", numDevices)
+	devices, err := g.Backend.Devices()
+	log.Infof("Get %d gpu-devices from %s", len(devices), g.Backend.Name())
 	if err != nil {
-		log.Printf("DeviceCount() error: %v", err)
-		defer gonvml.Shutdown()
+		log.Printf("Devices() error: %v", err)
+		defer g.Backend.Shutdown()
 		return
 	}
 
-	if numDevices == 0 {
+	g.selected = SelectVisibleDevices(devices)
+	if len(g.selected) == 0 {
 		return
 	}
 
-	g.NumDevices = int(numDevices)
-	g.Devices = make([]GPUSpec, numDevices)
-	for i := 0; i < int(g.NumDevices); i++ {
-		dev, err := gonvml.DeviceHandleByIndex(uint(i))
-		if err != nil {
-			log.Warn(err)
+	g.NumDevices = len(g.selected)
+	g.Devices = make([]GPUSpec, g.NumDevices)
+	for i, p := range g.selected {
+		g.Devices[i] = devices[p]
+		g.Devices[i].Index = i
+		log.Infof("Set device[%d] PhysicalIndex=%d, UUID=%s, Memory=%d",
+			i, devices[p].Index, g.Devices[i].UUID, g.Devices[i].MemoryTotal)
+	}
+	g.resetWindow()
+	g.sampled = time.Now()
+	g.Available = true
+
+	if g.PollInterval == GpuPollIntervalDefault {
+		g.PollInterval = DefaultGpuPollInterval
+		if g.Backend.Name() == GpuBackendNvidiaSmi {
+			g.PollInterval = DefaultNvidiaSmiPollInterval
 		}
-		deviceIndex, _ := dev.MinorNumber()
-		total, _, _ := dev.MemoryInfo()
+		log.Infof("Poll gpu utilization every %v", g.PollInterval)
+	}
+	if g.PollInterval > 0 {
+		g.StopFlag = make(chan int)
+		go g.update()
+	}
+}
 
-		g.Devices[i].Index = int(deviceIndex)
-		g.Devices[i].MemoryTotal = int64(total)
-		log.Infof("Set device[%d] Index=%d, Memory=%d", i, deviceIndex, g.Devices[i].MemoryTotal)
+func selectGpuBackend(candidates []GpuBackend) GpuBackend {
+	for _, backend := range candidates {
+		err := backend.Init()
+		if err == nil {
+			log.Infof("Use gpu backend %s", backend.Name())
+			return backend
+		}
+		log.Warnf("Gpu backend %s is not available: %v", backend.Name(), err)
 	}
-	g.Available = true
+	return nil
 }
 
-func (g *GpuMemoryCollector) Stop() {
-	if g.Available {
-		gonvml.Shutdown()
+func (g *GpuMemoryCollector) update() {
+	ticker := time.NewTicker(g.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			g.poll()
+		case <-g.StopFlag:
+			return
+		}
 	}
 }
 
-func (g *GpuMemoryCollector) Fetch() ResourceCollectorResult {
+// poll adds a reading to the window, a failed reading is skipped rather than counted as idle
+func (g *GpuMemoryCollector) poll() {
+	results, err := g.sample()
+	if err != nil {
+		log.Debugf("%s Sample() error: %v", g.Backend.Name(), err)
+		return
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.window.count++
+	for i, r := range results {
+		g.window.sum[i] += r.Utilization
+		if r.Utilization > g.window.max[i] {
+			g.window.max[i] = r.Utilization
+		}
+	}
+	g.window.last = results
+}
+
+func (g *GpuMemoryCollector) resetWindow() {
+	g.window = gpuUtilizationWindow{
+		sum: make([]int, g.NumDevices),
+		max: make([]int, g.NumDevices),
+	}
+}
+
+// IsStale reports no sample has succeeded for 3 sampling periods, e.g., the driver stops responding
+func (g *GpuMemoryCollector) IsStale() bool {
 	if !g.Available {
-		return ResourceCollectorResult{}
+		return false
+	}
+	period := g.PollInterval
+	if period <= 0 {
+		period = g.UpdateInterval
+	}
+	if period <= 0 {
+		return false
 	}
 
-	results := make([]ResourceCollectorResult, g.NumDevices)
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.sampled.Before(time.Now().Add(-gpuStaleSamples * period))
+}
+
+func (g *GpuMemoryCollector) LastSampled() time.Time {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.sampled
+}
 
-	for i := 0; i < int(g.NumDevices); i++ {
-		dev, err := gonvml.DeviceHandleByIndex(uint(i))
-		if err != nil {
-			log.Debugf("DeviceHandleByIndex() error: %v", err)
-			continue
+func (g *GpuMemoryCollector) Stop() {
+	if g.Available {
+		if g.StopFlag != nil {
+			g.StopFlag <- 1
 		}
+		g.Backend.Shutdown()
+	}
+}
 
-		minorNumber, err := dev.MinorNumber()
+// sample takes an instantaneous reading of the visible devices, the readings are not valid on an error
+func (g *GpuMemoryCollector) sample() ([]ResourceCollectorResult, error) {
+	results := make([]ResourceCollectorResult, g.NumDevices)
+	g.sampleMutex.Lock()
+	samples, err := g.Backend.Sample()
+	g.sampleMutex.Unlock()
+	if err == nil {
+		g.mutex.Lock()
+		g.sampled = time.Now()
+		g.mutex.Unlock()
+	}
 
-		if err != nil {
-			log.Debugf("dev.MinorNumber() error: %v", err)
-			continue
+	// keep the shape of the result stable, even if the devices changed after Start()
+	for i, p := range g.selected {
+		if p < len(samples) {
+			results[i] = samples[p]
 		}
+		results[i].Index = i
+		results[i].UtilizationMax = results[i].Utilization
+		results[i].UtilizationMilli = int64(results[i].Utilization) * 1000
+	}
+	return results, err
+}
 
-		gpuUtilization, _, err := dev.UtilizationRates()
-		if err != nil {
-			log.Debugf("dev.UtilizationRates() error: %v", err)
-			continue
-		}
+// Fetch returns the mean and max utilization of the polled samples since the last Fetch,
+// and the latest memory used. GPU is nil if no sample succeeded since the last Fetch.
+func (g *GpuMemoryCollector) Fetch() ResourceCollectorResult {
+	if !g.Available {
+		return ResourceCollectorResult{}
+	}
 
-		_, memoryUsed, err := dev.MemoryInfo()
-		if err != nil {
-			log.Debugf("dev.MemoryInfo() error: %v", err)
-			continue
-		}
+	g.mutex.Lock()
+	window := g.window
+	g.resetWindow()
+	g.mutex.Unlock()
 
-		results[i].Index = int(minorNumber)
-		results[i].Utilization = int(gpuUtilization)
-		results[i].Memory = int64(memoryUsed)
+	var results []ResourceCollectorResult
+	if window.count == 0 {
+		var err error
+		if results, err = g.sample(); err != nil {
+			log.Debugf("%s Sample() error: %v", g.Backend.Name(), err)
+			return ResourceCollectorResult{}
+		}
+	} else {
+		results = window.last
+		for i := range results {
+			results[i].UtilizationMilli = roundDiv(int64(window.sum[i])*1000, int64(window.count))
+			results[i].Utilization = UtilizationMilliToPercent(results[i].UtilizationMilli)
+			results[i].UtilizationMax = window.max[i]
+		}
+	}
 
-		log.Debugf("GPU::device [%d], Utilization: %d, Memory: %d",
-			minorNumber, gpuUtilization, memoryUsed)
+	for _, r := range results {
+		log.Debugf("GPU::device [%d], Utilization: %d, UtilizationMax: %d, Memory: %d",
+			r.Index, r.Utilization, r.UtilizationMax, r.Memory)
 	}
 
 	return ResourceCollectorResult{
@@ -0,0 +1,144 @@
+package monitoring
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// scriptedGpuBackend returns the utilizations in turn, a negative one fails the sample
+type scriptedGpuBackend struct {
+	utilizations []int
+	next         int
+}
+
+func (s *scriptedGpuBackend) Name() string { return "scripted" }
+func (s *scriptedGpuBackend) Init() error  { return nil }
+func (s *scriptedGpuBackend) Shutdown()    {}
+func (s *scriptedGpuBackend) Devices() ([]GPUSpec, error) {
+	return []GPUSpec{{Index: 0, MemoryTotal: 100}}, nil
+}
+func (s *scriptedGpuBackend) Sample() ([]ResourceCollectorResult, error) {
+	utilization := s.utilizations[s.next%len(s.utilizations)]
+	s.next++
+	if utilization < 0 {
+		return nil, errors.New("sample failed")
+	}
+	return []ResourceCollectorResult{{Utilization: utilization, Memory: int64(s.next)}}, nil
+}
+
+func TestGpuUtilizationWindow(t *testing.T) {
+	t.Log("Give a bursty gpu polled 4 times in an interval: 0, 100, 0, 100")
+	collector := GpuMemoryCollector{Backend: &scriptedGpuBackend{utilizations: []int{0, 100, 0, 100}}}
+	collector.Start()
+	defer collector.Stop()
+
+	for i := 0; i < 4; i++ {
+		collector.poll()
+	}
+
+	gpu := collector.Fetch().GPU[0]
+	if gpu.Utilization != 50 || gpu.UtilizationMilli != 50000 || gpu.UtilizationMax != 100 {
+		t.Fatalf("expected mean 50 and max 100, but got %+v", gpu)
+	}
+	t.Log("Fetch returns mean 50 and max 100")
+
+	if gpu.Memory != 4 {
+		t.Errorf("expected the latest memory used 4, but got %d", gpu.Memory)
+	}
+	t.Log("Fetch returns the latest memory used")
+
+	gpu = collector.Fetch().GPU[0]
+	if gpu.Utilization != 0 || gpu.UtilizationMax != 0 {
+		t.Errorf("expected an instantaneous reading 0, but got %+v", gpu)
+	}
+	t.Log("The window is reset, the next Fetch without polling takes an instantaneous reading")
+}
+
+func TestGpuUtilizationWindowWithFailedPolls(t *testing.T) {
+	t.Log("Give a gpu polled 4 times in an interval: 80, failed, 60, failed")
+	collector := GpuMemoryCollector{Backend: &scriptedGpuBackend{utilizations: []int{80, -1, 60, -1}}}
+	collector.Start()
+	defer collector.Stop()
+
+	for i := 0; i < 4; i++ {
+		collector.poll()
+	}
+
+	gpu := collector.Fetch().GPU[0]
+	if gpu.Utilization != 70 || gpu.UtilizationMax != 80 || gpu.Memory != 3 {
+		t.Fatalf("expected mean 70, max 80 and memory 3, but got %+v", gpu)
+	}
+	t.Log("The failed polls are skipped rather than counted as 0")
+}
+
+func TestGpuUtilizationWindowWithoutSample(t *testing.T) {
+	t.Log("Give a gpu failing every sample in an interval")
+	collector := GpuMemoryCollector{Backend: &scriptedGpuBackend{utilizations: []int{-1}}}
+	collector.Start()
+	defer collector.Stop()
+
+	collector.poll()
+	if gpu := collector.Fetch().GPU; gpu != nil {
+		t.Fatalf("expected no usage, but got %+v", gpu)
+	}
+	t.Log("Fetch returns no usage rather than zeros")
+}
+
+func TestGpuPollIntervalDefault(t *testing.T) {
+	defer installNvidiaSmiStub(t, nvidiaSmiStub)()
+
+	t.Log("Give the default poll interval with the nvidia-smi backend")
+	collector := GpuMemoryCollector{Backend: &NvidiaSmiBackend{}, PollInterval: GpuPollIntervalDefault}
+	collector.Start()
+	defer collector.Stop()
+
+	if collector.PollInterval != DefaultNvidiaSmiPollInterval {
+		t.Errorf("expected %v, but got %v", DefaultNvidiaSmiPollInterval, collector.PollInterval)
+	}
+	t.Log("nvidia-smi is polled at a coarser interval")
+}
+
+func TestGpuMemoryCollectorIsStale(t *testing.T) {
+	t.Log("Give a gpu polled every 10ms failing every sample")
+	collector := GpuMemoryCollector{Backend: &scriptedGpuBackend{utilizations: []int{-1}}, PollInterval: 10 * time.Millisecond}
+	collector.Start()
+	defer collector.Stop()
+
+	if collector.IsStale() {
+		t.Fatal("expected not stale right after start")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if !collector.IsStale() {
+		t.Fatal("expected stale after 3 failed polls")
+	}
+	t.Log("The usage is stale after 3 periods without a successful sample")
+}
+
+func TestGpuMemoryCollectorRecovers(t *testing.T) {
+	t.Log("Give a gpu without polling updated every 10ms, failing 4 samples before recovering")
+	collector := GpuMemoryCollector{Backend: &scriptedGpuBackend{utilizations: []int{-1, -1, -1, -1, 50}},
+		UpdateInterval: 10 * time.Millisecond}
+	collector.Start()
+	defer collector.Stop()
+
+	for i := 0; i < 4; i++ {
+		time.Sleep(10 * time.Millisecond)
+		if gpu := collector.Fetch().GPU; gpu != nil {
+			t.Fatalf("expected the sample %d failed, but got %+v", i, gpu)
+		}
+	}
+	if !collector.IsStale() {
+		t.Fatal("expected stale after 4 failed updates")
+	}
+	t.Log("The usage is stale after the failed updates")
+
+	gpu := collector.Fetch().GPU
+	if gpu == nil || gpu[0].Utilization != 50 {
+		t.Fatalf("expected the usage read again, but got %+v", gpu)
+	}
+	if collector.IsStale() {
+		t.Error("expected not stale once a sample succeeds")
+	}
+	t.Log("The next Fetch samples the backend again and the usage is no longer stale")
+}
@@ -0,0 +1,356 @@
+package monitoring
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	nvidiaSmiGpuQuery  = "index,uuid,memory.total,memory.used,utilization.gpu"
+	nvidiaSmiAppsQuery = "gpu_uuid,pid,used_memory"
+	mebibyte           = 1024 * 1024
+)
+
+// NvidiaSmiBackend reads the gpu usage by running nvidia-smi on each sample.
+// It is the fallback when libnvidia-ml.so cannot be loaded by the agent.
+//
+// The MIG devices of a MIG-enabled gpu are listed by nvidia-smi -L in place of the gpu, their instances and memory
+// are read from nvidia-smi -q -x, which doesn't report the utilization of MIG devices.
+type NvidiaSmiBackend struct {
+	// The command to run, "nvidia-smi" in the PATH by default
+	Command string
+
+	// whether MIG devices are found by Devices, then Sample reads them too
+	mig bool
+}
+
+type nvidiaSmiMigDevice struct {
+	// the index of the MIG device in the parent gpu
+	Device          int
+	UUID            string
+	GpuInstance     int
+	ComputeInstance int
+	MemoryTotal     int64
+	MemoryUsed      int64
+}
+
+type nvidiaSmiGpu struct {
+	Index       int
+	UUID        string
+	MemoryTotal int64
+	MemoryUsed  int64
+	Utilization int
+
+	// false when the driver reports [N/A] for memory.used
+	HasMemoryUsed bool
+}
+
+func (s *NvidiaSmiBackend) Name() string {
+	return GpuBackendNvidiaSmi
+}
+
+func (s *NvidiaSmiBackend) Init() error {
+	if s.Command == "" {
+		s.Command = "nvidia-smi"
+	}
+
+	path, err := exec.LookPath(s.Command)
+	if err != nil {
+		return err
+	}
+	s.Command = path
+
+	_, err = s.queryGpus()
+	return err
+}
+
+func (s *NvidiaSmiBackend) Shutdown() {
+}
+
+func (s *NvidiaSmiBackend) Devices() ([]GPUSpec, error) {
+	gpus, err := s.queryGpus()
+	if err != nil {
+		return nil, err
+	}
+
+	migs, err := s.queryMigDevices()
+	if err != nil {
+		log.Warnf("Cannot query MIG devices by nvidia-smi: %v", err)
+	}
+	s.mig = len(migs) > 0
+
+	devices := make([]GPUSpec, 0, len(gpus))
+	for _, gpu := range gpus {
+		if len(migs[gpu.UUID]) == 0 {
+			devices = append(devices, GPUSpec{Index: gpu.Index, UUID: gpu.UUID, MemoryTotal: gpu.MemoryTotal})
+			continue
+		}
+		for _, mig := range migs[gpu.UUID] {
+			devices = append(devices, GPUSpec{
+				Index:                  gpu.Index,
+				UUID:                   mig.UUID,
+				MemoryTotal:            mig.MemoryTotal,
+				MIG:                    true,
+				ParentUUID:             gpu.UUID,
+				MigInstance:            fmt.Sprintf("%d/%d", mig.GpuInstance, mig.ComputeInstance),
+				UtilizationUnsupported: true,
+			})
+		}
+	}
+	return devices, nil
+}
+
+func (s *NvidiaSmiBackend) Sample() ([]ResourceCollectorResult, error) {
+	gpus, err := s.queryGpus()
+	if err != nil {
+		return nil, err
+	}
+
+	// some drivers report [N/A] for memory.used, e.g., inside MIG-enabled containers,
+	// sum up the memory used by the compute apps on the device instead
+	var appsMemory map[string]int64
+	for _, gpu := range gpus {
+		if !gpu.HasMemoryUsed {
+			appsMemory, err = s.queryComputeApps()
+			if err != nil {
+				log.Debugf("nvidia-smi --query-compute-apps error: %v", err)
+			}
+			break
+		}
+	}
+
+	var migs map[string][]nvidiaSmiMigDevice
+	if s.mig {
+		migs, err = s.queryMigMemory()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	results := make([]ResourceCollectorResult, 0, len(gpus))
+	for _, gpu := range gpus {
+		if len(migs[gpu.UUID]) > 0 {
+			for _, mig := range migs[gpu.UUID] {
+				results = append(results, ResourceCollectorResult{Index: gpu.Index, Memory: mig.MemoryUsed})
+			}
+			continue
+		}
+
+		result := ResourceCollectorResult{Index: gpu.Index, Utilization: gpu.Utilization, Memory: gpu.MemoryUsed}
+		if !gpu.HasMemoryUsed {
+			result.Memory = appsMemory[gpu.UUID]
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (s *NvidiaSmiBackend) queryGpus() ([]nvidiaSmiGpu, error) {
+	output, err := s.run("--query-gpu="+nvidiaSmiGpuQuery, "--format=csv,noheader,nounits")
+	if err != nil {
+		return nil, err
+	}
+	return parseNvidiaSmiGpus(output)
+}
+
+func (s *NvidiaSmiBackend) queryComputeApps() (map[string]int64, error) {
+	output, err := s.run("--query-compute-apps="+nvidiaSmiAppsQuery, "--format=csv,noheader,nounits")
+	if err != nil {
+		return nil, err
+	}
+	return parseNvidiaSmiComputeApps(output)
+}
+
+// queryMigDevices returns the MIG devices by the uuid of the parent gpu, the ones listed by -L with the instances
+// and the memory of -q -x
+func (s *NvidiaSmiBackend) queryMigDevices() (map[string][]nvidiaSmiMigDevice, error) {
+	output, err := s.run("-L")
+	if err != nil {
+		return nil, err
+	}
+	uuids := parseNvidiaSmiList(output)
+	if len(uuids) == 0 {
+		return nil, nil
+	}
+
+	migs, err := s.queryMigMemory()
+	if err != nil {
+		return nil, err
+	}
+	for parent, devices := range migs {
+		for i := range devices {
+			d := &devices[i]
+			if uuid, ok := uuids[parent][d.Device]; ok {
+				d.UUID = uuid
+			} else {
+				// the identifier of MIG devices before driver R470
+				d.UUID = fmt.Sprintf("MIG-%s/%d/%d", parent, d.GpuInstance, d.ComputeInstance)
+			}
+		}
+	}
+	return migs, nil
+}
+
+func (s *NvidiaSmiBackend) queryMigMemory() (map[string][]nvidiaSmiMigDevice, error) {
+	output, err := s.run("-q", "-x")
+	if err != nil {
+		return nil, err
+	}
+	return parseNvidiaSmiMigDevices(output)
+}
+
+func (s *NvidiaSmiBackend) run(args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(s.Command, args...)
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %v %s", s.Command, strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return output, nil
+}
+
+func parseNvidiaSmiGpus(output []byte) ([]nvidiaSmiGpu, error) {
+	rows, err := readNvidiaSmiCsv(output, 5)
+	if err != nil {
+		return nil, err
+	}
+
+	gpus := make([]nvidiaSmiGpu, 0, len(rows))
+	for _, row := range rows {
+		index, err := strconv.Atoi(row[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid gpu index %q", row[0])
+		}
+
+		gpu := nvidiaSmiGpu{Index: index, UUID: row[1]}
+		if total, ok := parseNvidiaSmiNumber(row[2]); ok {
+			gpu.MemoryTotal = total * mebibyte
+		}
+		if used, ok := parseNvidiaSmiNumber(row[3]); ok {
+			gpu.MemoryUsed = used * mebibyte
+			gpu.HasMemoryUsed = true
+		}
+		if utilization, ok := parseNvidiaSmiNumber(row[4]); ok {
+			gpu.Utilization = int(utilization)
+		}
+		gpus = append(gpus, gpu)
+	}
+	return gpus, nil
+}
+
+func parseNvidiaSmiComputeApps(output []byte) (map[string]int64, error) {
+	rows, err := readNvidiaSmiCsv(output, 3)
+	if err != nil {
+		return nil, err
+	}
+
+	memory := make(map[string]int64)
+	for _, row := range rows {
+		if used, ok := parseNvidiaSmiNumber(row[2]); ok {
+			memory[row[0]] += used * mebibyte
+		}
+	}
+	return memory, nil
+}
+
+var (
+	nvidiaSmiListGpu = regexp.MustCompile(`^GPU \d+: .*\(UUID: (GPU-[^)]+)\)`)
+	nvidiaSmiListMig = regexp.MustCompile(`^\s+MIG .*Device\s+(\d+): \(UUID: (MIG-[^)]+)\)`)
+)
+
+// parseNvidiaSmiList returns the uuids of the MIG devices listed by nvidia-smi -L, by the parent gpu and the device
+//
+//	GPU 0: NVIDIA A100-SXM4-40GB (UUID: GPU-5d5ba0d6-d33d-2b2c-524d-9e3d8d2b8a77)
+//	  MIG 3g.20gb     Device  0: (UUID: MIG-c6d4f1ef-42e4-5de3-91c7-45d71c87eb3f)
+func parseNvidiaSmiList(output []byte) map[string]map[int]string {
+	uuids := make(map[string]map[int]string)
+	parent := ""
+	for _, line := range strings.Split(string(output), "\n") {
+		if m := nvidiaSmiListGpu.FindStringSubmatch(line); m != nil {
+			parent = m[1]
+			continue
+		}
+		if m := nvidiaSmiListMig.FindStringSubmatch(line); m != nil && parent != "" {
+			device, _ := strconv.Atoi(m[1])
+			if uuids[parent] == nil {
+				uuids[parent] = make(map[int]string)
+			}
+			uuids[parent][device] = m[2]
+		}
+	}
+	return uuids
+}
+
+type nvidiaSmiLog struct {
+	GPUs []struct {
+		UUID       string `xml:"uuid"`
+		MigDevices []struct {
+			Index             int `xml:"index"`
+			GpuInstanceID     int `xml:"gpu_instance_id"`
+			ComputeInstanceID int `xml:"compute_instance_id"`
+			Memory            struct {
+				Total string `xml:"total"`
+				Used  string `xml:"used"`
+			} `xml:"fb_memory_usage"`
+		} `xml:"mig_devices>mig_device"`
+	} `xml:"gpu"`
+}
+
+// parseNvidiaSmiMigDevices returns the MIG devices in nvidia-smi -q -x by the uuid of the parent gpu,
+// the memory is like "19968 MiB"
+func parseNvidiaSmiMigDevices(output []byte) (map[string][]nvidiaSmiMigDevice, error) {
+	var report nvidiaSmiLog
+	if err := xml.Unmarshal(output, &report); err != nil {
+		return nil, err
+	}
+
+	migs := make(map[string][]nvidiaSmiMigDevice)
+	for _, gpu := range report.GPUs {
+		for _, d := range gpu.MigDevices {
+			mig := nvidiaSmiMigDevice{Device: d.Index, GpuInstance: d.GpuInstanceID, ComputeInstance: d.ComputeInstanceID}
+			if total, ok := parseNvidiaSmiNumber(strings.TrimSuffix(strings.TrimSpace(d.Memory.Total), " MiB")); ok {
+				mig.MemoryTotal = total * mebibyte
+			}
+			if used, ok := parseNvidiaSmiNumber(strings.TrimSuffix(strings.TrimSpace(d.Memory.Used), " MiB")); ok {
+				mig.MemoryUsed = used * mebibyte
+			}
+			migs[strings.TrimSpace(gpu.UUID)] = append(migs[strings.TrimSpace(gpu.UUID)], mig)
+		}
+	}
+	return migs, nil
+}
+
+func readNvidiaSmiCsv(output []byte, fields int) ([][]string, error) {
+	reader := csv.NewReader(bytes.NewReader(output))
+	reader.TrimLeadingSpace = true
+	reader.FieldsPerRecord = fields
+
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		for i := range row {
+			row[i] = strings.TrimSpace(row[i])
+		}
+	}
+	return rows, nil
+}
+
+// values could be [N/A] or [Not Supported]
+func parseNvidiaSmiNumber(value string) (int64, bool) {
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, false
+	}
+	return int64(number), true
+}
@@ -0,0 +1,189 @@
+package monitoring
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const nvidiaSmiStub = `#!/bin/sh
+case "$1" in
+  --query-gpu=*)
+    echo "0, GPU-aaaa, 16160, 1024, 45"
+    echo "1, GPU-bbbb, 16160, [N/A], 100"
+    ;;
+  --query-compute-apps=*)
+    echo "GPU-bbbb, 100, 512"
+    echo "GPU-bbbb, 101, 256"
+    ;;
+  -L)
+    echo "GPU 0: Tesla V100-SXM2-16GB (UUID: GPU-aaaa)"
+    echo "GPU 1: Tesla V100-SXM2-16GB (UUID: GPU-bbbb)"
+    ;;
+  *)
+    exit 1
+    ;;
+esac
+`
+
+// the second gpu is MIG-enabled with 2 MIG devices
+const nvidiaSmiMigStub = `#!/bin/sh
+case "$1" in
+  --query-gpu=*)
+    echo "0, GPU-aaaa, 16160, 1024, 45"
+    echo "1, GPU-bbbb, 40536, [N/A], [N/A]"
+    ;;
+  -L)
+    echo "GPU 0: Tesla V100-SXM2-16GB (UUID: GPU-aaaa)"
+    echo "GPU 1: NVIDIA A100-SXM4-40GB (UUID: GPU-bbbb)"
+    echo "  MIG 3g.20gb     Device  0: (UUID: MIG-1111)"
+    echo "  MIG 1g.5gb      Device  1: (UUID: MIG-2222)"
+    ;;
+  -q)
+    cat <<EOF
+<?xml version="1.0" ?>
+<!DOCTYPE nvidia_smi_log SYSTEM "nvsmi_device_v11.dtd">
+<nvidia_smi_log>
+  <gpu id="00000000:07:00.0">
+    <uuid>GPU-aaaa</uuid>
+    <mig_devices>None</mig_devices>
+  </gpu>
+  <gpu id="00000000:0F:00.0">
+    <uuid>GPU-bbbb</uuid>
+    <mig_mode>
+      <current_mig>Enabled</current_mig>
+    </mig_mode>
+    <mig_devices>
+      <mig_device>
+        <index>0</index>
+        <gpu_instance_id>2</gpu_instance_id>
+        <compute_instance_id>0</compute_instance_id>
+        <fb_memory_usage>
+          <total>19968 MiB</total>
+          <used>1024 MiB</used>
+        </fb_memory_usage>
+      </mig_device>
+      <mig_device>
+        <index>1</index>
+        <gpu_instance_id>7</gpu_instance_id>
+        <compute_instance_id>0</compute_instance_id>
+        <fb_memory_usage>
+          <total>4864 MiB</total>
+          <used>13 MiB</used>
+        </fb_memory_usage>
+      </mig_device>
+    </mig_devices>
+  </gpu>
+</nvidia_smi_log>
+EOF
+    ;;
+  *)
+    exit 1
+    ;;
+esac
+`
+
+func installNvidiaSmiStub(t *testing.T, script string) func() {
+	dir, err := ioutil.TempDir("", "nvidia-smi-stub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "nvidia-smi"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	return func() {
+		os.Setenv("PATH", path)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestNvidiaSmiBackend(t *testing.T) {
+	defer installNvidiaSmiStub(t, nvidiaSmiStub)()
+
+	t.Log("Give a nvidia-smi stub with 2 devices, the second one without memory.used")
+	collector := GpuMemoryCollector{Backend: &NvidiaSmiBackend{}}
+	collector.Start()
+	defer collector.Stop()
+
+	if !collector.Available || collector.NumDevices != 2 {
+		t.Fatalf("collector should have 2 devices, but got %d", collector.NumDevices)
+	}
+	if collector.Devices[1].Index != 1 || collector.Devices[1].MemoryTotal != 16160*mebibyte {
+		t.Errorf("unexpected spec %+v", collector.Devices[1])
+	}
+	t.Log("Spec has index and memory total in bytes")
+
+	result := collector.Fetch()
+	if result.GPU[0].Utilization != 45 || result.GPU[0].Memory != 1024*mebibyte {
+		t.Errorf("unexpected gpu[0] %+v", result.GPU[0])
+	}
+	t.Log("GPU[0] has utilization 45 and memory 1024MiB")
+
+	if result.GPU[1].Utilization != 100 || result.GPU[1].Memory != 768*mebibyte {
+		t.Errorf("unexpected gpu[1] %+v", result.GPU[1])
+	}
+	t.Log("GPU[1] has utilization 100 and memory summed from compute apps")
+}
+
+func TestNvidiaSmiBackendWithMigDevices(t *testing.T) {
+	defer installNvidiaSmiStub(t, nvidiaSmiMigStub)()
+
+	t.Log("Give a nvidia-smi stub with a gpu and a MIG-enabled gpu with 2 MIG devices")
+	collector := GpuMemoryCollector{Backend: &NvidiaSmiBackend{}}
+	collector.Start()
+	defer collector.Stop()
+
+	if collector.NumDevices != 3 {
+		t.Fatalf("collector should have 3 devices, but got %d", collector.NumDevices)
+	}
+	expected := GPUSpec{Index: 2, UUID: "MIG-2222", MemoryTotal: 4864 * mebibyte, MIG: true, ParentUUID: "GPU-bbbb",
+		MigInstance: "7/0", UtilizationUnsupported: true}
+	if collector.Devices[2] != expected {
+		t.Errorf("unexpected spec %+v", collector.Devices[2])
+	}
+	t.Log("The MIG devices are listed in place of the parent gpu with the instances of nvidia-smi -q -x")
+
+	result := collector.Fetch()
+	if result.GPU[0].Utilization != 45 || result.GPU[0].Memory != 1024*mebibyte {
+		t.Errorf("unexpected gpu[0] %+v", result.GPU[0])
+	}
+	if result.GPU[1].Memory != 1024*mebibyte || result.GPU[2].Memory != 13*mebibyte || result.GPU[2].Utilization != 0 {
+		t.Errorf("unexpected MIG devices %+v", result.GPU[1:])
+	}
+	t.Log("The MIG devices have the memory used of nvidia-smi -q -x")
+}
+
+func TestParseNvidiaSmiListBeforeR470(t *testing.T) {
+	uuids := parseNvidiaSmiList([]byte("GPU 0: A100-SXM4-40GB (UUID: GPU-bbbb)\n" +
+		"  MIG 1g.5gb Device 0: (UUID: MIG-GPU-bbbb/7/0)\n"))
+	if uuids["GPU-bbbb"][0] != "MIG-GPU-bbbb/7/0" {
+		t.Errorf("expected the MIG identifier of the parent gpu, but got %v", uuids)
+	}
+}
+
+func TestSelectGpuBackend(t *testing.T) {
+	defer installNvidiaSmiStub(t, nvidiaSmiStub)()
+
+	t.Log("Give an unavailable backend and a nvidia-smi stub")
+	backend := selectGpuBackend([]GpuBackend{
+		&NvidiaSmiBackend{Command: "nvidia-smi-not-found"},
+		&NvidiaSmiBackend{},
+	})
+	if backend == nil {
+		t.Fatal("nvidia-smi should be selected")
+	}
+	if backend.(*NvidiaSmiBackend).Command == "nvidia-smi-not-found" {
+		t.Fatal("the unavailable backend should be skipped")
+	}
+	t.Log("The first available backend is selected")
+}
+
+func TestParseNvidiaSmiGpusWithInvalidOutput(t *testing.T) {
+	if _, err := parseNvidiaSmiGpus([]byte("0, GPU-aaaa, 16160\n")); err == nil {
+		t.Fatal("parse should fail with missing fields")
+	}
+}
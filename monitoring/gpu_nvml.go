@@ -0,0 +1,193 @@
+package monitoring
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/mindprince/gonvml"
+	log "github.com/sirupsen/logrus"
+)
+
+var ErrNvmlNotSupported = errors.New("nvml: not supported")
+
+// NvmlLibrary is the subset of NVML used by the NvmlBackend
+type NvmlLibrary interface {
+	Initialize() error
+	Shutdown() error
+	DeviceCount() (uint, error)
+	DeviceHandleByIndex(idx uint) (NvmlDevice, error)
+}
+
+type NvmlDevice interface {
+	MinorNumber() (uint, error)
+	UUID() (string, error)
+	MemoryInfo() (uint64, uint64, error)
+	UtilizationRates() (uint, uint, error)
+
+	// return the MIG devices of a MIG-enabled gpu, or an empty list if MIG is disabled
+	MigDevices() ([]NvmlDevice, error)
+
+	// only available on MIG devices
+	GpuInstanceId() (uint, error)
+	ComputeInstanceId() (uint, error)
+}
+
+type NvmlBackend struct {
+	// The NVML library, gonvml by default, overwritten by tests
+	Lib NvmlLibrary
+
+	// gpus, or the MIG devices in place of their MIG-enabled parent gpu
+	handles []NvmlDevice
+	specs   []GPUSpec
+}
+
+func (n *NvmlBackend) Name() string {
+	return GpuBackendNvml
+}
+
+func (n *NvmlBackend) Init() error {
+	if n.Lib == nil {
+		n.Lib = gonvmlLibrary{}
+	}
+
+	err := n.Lib.Initialize()
+	if err != nil {
+		return err
+	}
+
+	numDevices, err := n.Lib.DeviceCount()
+	if err != nil {
+		n.Lib.Shutdown()
+		return err
+	}
+
+	n.handles = make([]NvmlDevice, 0, numDevices)
+	n.specs = make([]GPUSpec, 0, numDevices)
+	for i := 0; i < int(numDevices); i++ {
+		dev, err := n.Lib.DeviceHandleByIndex(uint(i))
+		if err != nil {
+			log.Warnf("device[%d] DeviceHandleByIndex() error: %v", i, err)
+			continue
+		}
+		deviceIndex, _ := dev.MinorNumber()
+		uuid, _ := dev.UUID()
+		total, _, _ := dev.MemoryInfo()
+
+		migDevices, err := dev.MigDevices()
+		if err != nil && err != ErrNvmlNotSupported {
+			log.Warnf("device[%d] MigDevices() error: %v", i, err)
+		}
+		if len(migDevices) == 0 {
+			n.handles = append(n.handles, dev)
+			n.specs = append(n.specs, GPUSpec{
+				Index:       int(deviceIndex),
+				UUID:        uuid,
+				MemoryTotal: int64(total),
+			})
+			continue
+		}
+
+		for _, mig := range migDevices {
+			n.handles = append(n.handles, mig)
+			n.specs = append(n.specs, buildMigSpec(int(deviceIndex), uuid, mig))
+		}
+	}
+	return nil
+}
+
+// The utilization of MIG devices is not exposed by most drivers, mark it to let consumers skip the value
+func buildMigSpec(parentIndex int, parentUUID string, mig NvmlDevice) GPUSpec {
+	uuid, _ := mig.UUID()
+	total, _, _ := mig.MemoryInfo()
+	gi, _ := mig.GpuInstanceId()
+	ci, _ := mig.ComputeInstanceId()
+	_, _, err := mig.UtilizationRates()
+
+	return GPUSpec{
+		Index:                  parentIndex,
+		UUID:                   uuid,
+		MemoryTotal:            int64(total),
+		MIG:                    true,
+		ParentUUID:             parentUUID,
+		MigInstance:            fmt.Sprintf("%d/%d", gi, ci),
+		UtilizationUnsupported: err != nil,
+	}
+}
+
+func (n *NvmlBackend) Shutdown() {
+	n.Lib.Shutdown()
+}
+
+func (n *NvmlBackend) Devices() ([]GPUSpec, error) {
+	devices := make([]GPUSpec, len(n.specs))
+	copy(devices, n.specs)
+	return devices, nil
+}
+
+// Sample fails if any reading of a device fails, so the sample is skipped rather than read as idle
+func (n *NvmlBackend) Sample() ([]ResourceCollectorResult, error) {
+	results := make([]ResourceCollectorResult, len(n.handles))
+
+	var sampleErr error
+	for i, dev := range n.handles {
+		results[i].Index = n.specs[i].Index
+
+		if !n.specs[i].UtilizationUnsupported {
+			gpuUtilization, _, err := dev.UtilizationRates()
+			if err != nil {
+				sampleErr = fmt.Errorf("device[%d] UtilizationRates() error: %v", i, err)
+			}
+			results[i].Utilization = int(gpuUtilization)
+		}
+
+		_, memoryUsed, err := dev.MemoryInfo()
+		if err != nil {
+			sampleErr = fmt.Errorf("device[%d] MemoryInfo() error: %v", i, err)
+		}
+		results[i].Memory = int64(memoryUsed)
+	}
+
+	return results, sampleErr
+}
+
+// gonvmlLibrary adapts gonvml to NvmlLibrary, with the MIG API bound by nvmlMigDevices
+type gonvmlLibrary struct{}
+
+type gonvmlDevice struct {
+	gonvml.Device
+	index uint
+}
+
+func (gonvmlLibrary) Initialize() error {
+	return gonvml.Initialize()
+}
+
+func (gonvmlLibrary) Shutdown() error {
+	return gonvml.Shutdown()
+}
+
+func (gonvmlLibrary) DeviceCount() (uint, error) {
+	return gonvml.DeviceCount()
+}
+
+func (gonvmlLibrary) DeviceHandleByIndex(idx uint) (NvmlDevice, error) {
+	dev, err := gonvml.DeviceHandleByIndex(idx)
+	return gonvmlDevice{dev, idx}, err
+}
+
+func (d gonvmlDevice) MigDevices() ([]NvmlDevice, error) {
+	minor, err := d.MinorNumber()
+	if err != nil {
+		return nil, err
+	}
+	return nvmlMigDevices(d.index, minor)
+}
+
+// the instance ids are only available on MIG devices
+func (d gonvmlDevice) GpuInstanceId() (uint, error) {
+	return 0, ErrNvmlNotSupported
+}
+
+func (d gonvmlDevice) ComputeInstanceId() (uint, error) {
+	return 0, ErrNvmlNotSupported
+}
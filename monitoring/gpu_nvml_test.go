@@ -0,0 +1,142 @@
+package monitoring
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type fakeNvmlDevice struct {
+	minor       uint
+	uuid        string
+	memoryTotal uint64
+	memoryUsed  uint64
+	utilization uint
+	noUtil      bool
+	gi, ci      uint
+	migs        []NvmlDevice
+}
+
+func (d *fakeNvmlDevice) MinorNumber() (uint, error) { return d.minor, nil }
+func (d *fakeNvmlDevice) UUID() (string, error)      { return d.uuid, nil }
+func (d *fakeNvmlDevice) MemoryInfo() (uint64, uint64, error) {
+	return d.memoryTotal, d.memoryUsed, nil
+}
+func (d *fakeNvmlDevice) UtilizationRates() (uint, uint, error) {
+	if d.noUtil {
+		return 0, 0, ErrNvmlNotSupported
+	}
+	return d.utilization, 0, nil
+}
+func (d *fakeNvmlDevice) MigDevices() ([]NvmlDevice, error) { return d.migs, nil }
+func (d *fakeNvmlDevice) GpuInstanceId() (uint, error)      { return d.gi, nil }
+func (d *fakeNvmlDevice) ComputeInstanceId() (uint, error)  { return d.ci, nil }
+
+type fakeNvmlLibrary struct {
+	devices []*fakeNvmlDevice
+
+	// the devices failing DeviceHandleByIndex
+	failed map[uint]bool
+}
+
+func (l *fakeNvmlLibrary) Initialize() error          { return nil }
+func (l *fakeNvmlLibrary) Shutdown() error            { return nil }
+func (l *fakeNvmlLibrary) DeviceCount() (uint, error) { return uint(len(l.devices)), nil }
+func (l *fakeNvmlLibrary) DeviceHandleByIndex(idx uint) (NvmlDevice, error) {
+	if l.failed[idx] {
+		return nil, errors.New("nvml: unknown error")
+	}
+	return l.devices[idx], nil
+}
+
+func newFakeMigNode() *fakeNvmlLibrary {
+	return &fakeNvmlLibrary{devices: []*fakeNvmlDevice{
+		{minor: 0, uuid: "GPU-aaaa", memoryTotal: 16 << 30, memoryUsed: 4 << 30, utilization: 80},
+		{minor: 1, uuid: "GPU-bbbb", memoryTotal: 40 << 30, memoryUsed: 9 << 30, utilization: 100, migs: []NvmlDevice{
+			&fakeNvmlDevice{minor: 1, uuid: "MIG-1111", memoryTotal: 5 << 30, memoryUsed: 1 << 30, noUtil: true, gi: 7, ci: 0},
+			&fakeNvmlDevice{minor: 1, uuid: "MIG-2222", memoryTotal: 10 << 30, memoryUsed: 3 << 30, utilization: 30, gi: 3, ci: 0},
+		}},
+	}}
+}
+
+func TestNvmlBackendWithMigDevices(t *testing.T) {
+	t.Log("Give a node with a gpu and a MIG-enabled gpu with 2 MIG devices")
+	backend := &NvmlBackend{Lib: newFakeMigNode()}
+	if err := backend.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	devices, _ := backend.Devices()
+	expected := []GPUSpec{
+		{Index: 0, UUID: "GPU-aaaa", MemoryTotal: 16 << 30},
+		{Index: 1, UUID: "MIG-1111", MemoryTotal: 5 << 30, MIG: true, ParentUUID: "GPU-bbbb", MigInstance: "7/0", UtilizationUnsupported: true},
+		{Index: 1, UUID: "MIG-2222", MemoryTotal: 10 << 30, MIG: true, ParentUUID: "GPU-bbbb", MigInstance: "3/0"},
+	}
+	if !reflect.DeepEqual(devices, expected) {
+		t.Fatalf("unexpected devices %+v", devices)
+	}
+	t.Log("The MIG devices replace the parent gpu with their own memory total")
+
+	results, _ := backend.Sample()
+	if results[1].Memory != 1<<30 || results[1].Utilization != 0 {
+		t.Errorf("unexpected MIG device usage %+v", results[1])
+	}
+	if results[2].Memory != 3<<30 || results[2].Utilization != 30 {
+		t.Errorf("unexpected MIG device usage %+v", results[2])
+	}
+	t.Log("The MIG devices report their own memory used, and utilization when exposed")
+}
+
+func TestNvmlBackendSelectMigDevice(t *testing.T) {
+	t.Log("Give a job with NVIDIA_VISIBLE_DEVICES of a MIG device")
+	withVisibleDevices(env("MIG-GPU-bbbb/3/0"), nil, func() {
+		collector := GpuMemoryCollector{Backend: &NvmlBackend{Lib: newFakeMigNode()}}
+		collector.Start()
+
+		if collector.NumDevices != 1 || collector.Devices[0].UUID != "MIG-2222" || collector.Devices[0].Index != 0 {
+			t.Fatalf("unexpected devices %+v", collector.Devices)
+		}
+		t.Log("Only the MIG device is reported as device 0")
+
+		gpu := collector.Fetch().GPU[0]
+		if gpu.Memory != 3<<30 {
+			t.Errorf("unexpected usage %+v", gpu)
+		}
+	})
+}
+
+func TestNvmlBackendSkipFailedDevice(t *testing.T) {
+	t.Log("Give a node with 2 gpus, the handle of the first one failing")
+	lib := newFakeMigNode()
+	lib.failed = map[uint]bool{0: true}
+	backend := &NvmlBackend{Lib: lib}
+	if err := backend.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	devices, _ := backend.Devices()
+	if len(devices) != 2 || devices[0].UUID != "MIG-1111" || devices[1].UUID != "MIG-2222" {
+		t.Fatalf("unexpected devices %+v", devices)
+	}
+	t.Log("The failed gpu is skipped, only the MIG devices of the second one are listed")
+}
+
+func TestNvmlBackendFailedSample(t *testing.T) {
+	t.Log("Give a gpu whose utilization cannot be read")
+	lib := &fakeNvmlLibrary{devices: []*fakeNvmlDevice{
+		{minor: 0, uuid: "GPU-aaaa", memoryTotal: 16 << 30, memoryUsed: 4 << 30, noUtil: true},
+	}}
+	backend := &NvmlBackend{Lib: lib}
+	if err := backend.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := backend.Sample()
+	if err == nil {
+		t.Error("expected the sample failed")
+	}
+	if results[0].Memory != 4<<30 {
+		t.Errorf("expected the memory used read, but got %+v", results[0])
+	}
+	t.Log("The sample fails, and the memory used is still read")
+}
@@ -0,0 +1,242 @@
+package monitoring
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultJournalMaxSize = 64 << 20
+	DefaultJournalMaxAge  = 24 * time.Hour
+
+	journalSegmentTimeFormat = "20060102T150405Z"
+)
+
+// Journal appends every raw sample as a JSON line to Path, e.g., for loading the whole history by pandas.read_json(lines=True).
+// The file is rotated to a segment named <name>-<time>-<seq>.jsonl once it exceeds MaxSize bytes, or MaxAge since its first sample,
+// the segments are compressed by gzip if Compress is set, and only the latest MaxBackups segments are kept, 0 to keep all.
+type Journal struct {
+	Path       string
+	MaxSize    int64
+	MaxAge     time.Duration
+	Compress   bool
+	MaxBackups int
+
+	file *os.File
+	size int64
+
+	// the timestamp of the first sample in the file
+	first int64
+
+	lastGap bool
+
+	// the rotated segments are compressed and pruned in the background
+	maintenance sync.WaitGroup
+	mutex       sync.Mutex
+}
+
+func NewJournal(path string) *Journal {
+	return &Journal{Path: path, MaxSize: DefaultJournalMaxSize, MaxAge: DefaultJournalMaxAge}
+}
+
+// Append writes the record as a line, the consecutive gap markers are written once
+func (j *Journal) Append(record Record) error {
+	if record.Gap && j.lastGap {
+		return nil
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if j.file == nil {
+		if err := j.open(); err != nil {
+			return err
+		}
+	}
+	oversize := j.MaxSize > 0 && j.size+int64(len(line)) > j.MaxSize
+	overage := j.MaxAge > 0 && record.Timestamp-j.first >= int64(j.MaxAge.Seconds())
+	if j.size > 0 && (oversize || overage) {
+		if err := j.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := j.file.Write(line)
+	j.size += int64(n)
+	if err != nil {
+		return err
+	}
+	if j.size == int64(n) {
+		j.first = record.Timestamp
+	}
+	j.lastGap = record.Gap
+	return nil
+}
+
+// open continues the existing file, e.g., after the agent restarts
+func (j *Journal) open() error {
+	f, err := os.OpenFile(j.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	j.file = f
+	j.size = info.Size()
+	if j.size > 0 {
+		j.first = readFirstTimestamp(j.Path)
+	}
+	return nil
+}
+
+func readFirstTimestamp(path string) int64 {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	line, _ := bufio.NewReader(f).ReadBytes('\n')
+	record := Record{}
+	if err := json.Unmarshal(line, &record); err != nil {
+		return 0
+	}
+	return record.Timestamp
+}
+
+func (j *Journal) rotate() error {
+	if err := j.file.Sync(); err != nil {
+		return err
+	}
+	if err := j.file.Close(); err != nil {
+		return err
+	}
+	j.file = nil
+
+	segment := j.segmentPath(time.Now())
+	if err := os.Rename(j.Path, segment); err != nil {
+		return err
+	}
+	log.Infof("Rotate journal %s to %s", j.Path, segment)
+
+	j.maintenance.Add(1)
+	go func() {
+		defer j.maintenance.Done()
+		j.mutex.Lock()
+		defer j.mutex.Unlock()
+		if j.Compress {
+			if err := compressFile(segment); err != nil {
+				log.Warnf("Cannot compress journal segment %s: %v", segment, err)
+			}
+		}
+		j.prune()
+	}()
+	return j.open()
+}
+
+// segmentPath returns a name not used yet, the segments sort by the rotated time and a sequence within a second
+func (j *Journal) segmentPath(now time.Time) string {
+	ext := filepath.Ext(j.Path)
+	base := strings.TrimSuffix(j.Path, ext) + "-" + now.UTC().Format(journalSegmentTimeFormat)
+	for i := 0; ; i++ {
+		segment := fmt.Sprintf("%s-%03d%s", base, i, ext)
+		if !fileExists(segment) && !fileExists(segment+".gz") {
+			return segment
+		}
+	}
+}
+
+// Segments returns the rotated segments from the oldest,
+// only the names of segmentPath are matched so the other files in the directory are never pruned
+func (j *Journal) Segments() []string {
+	ext := filepath.Ext(j.Path)
+	pattern := regexp.MustCompile("^" + regexp.QuoteMeta(filepath.Base(strings.TrimSuffix(j.Path, ext))) +
+		`-\d{8}T\d{6}Z-\d{3,}` + regexp.QuoteMeta(ext) + `(\.gz)?$`)
+	files, err := ioutil.ReadDir(filepath.Dir(j.Path))
+	if err != nil {
+		return nil
+	}
+
+	segments := make([]string, 0)
+	for _, file := range files {
+		name := file.Name()
+		if !file.IsDir() && pattern.MatchString(name) {
+			segments = append(segments, filepath.Join(filepath.Dir(j.Path), name))
+		}
+	}
+	sort.Strings(segments)
+	return segments
+}
+
+func (j *Journal) prune() {
+	if j.MaxBackups <= 0 {
+		return
+	}
+	segments := j.Segments()
+	for len(segments) > j.MaxBackups {
+		if err := os.Remove(segments[0]); err != nil {
+			log.Warnf("Cannot remove journal segment %s: %v", segments[0], err)
+		}
+		segments = segments[1:]
+	}
+}
+
+// Close flushes the file and waits for the segments being compressed
+func (j *Journal) Close() error {
+	j.maintenance.Wait()
+	if j.file == nil {
+		return nil
+	}
+	if err := j.file.Sync(); err != nil {
+		j.file.Close()
+		return err
+	}
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
+
+// compressFile replaces the file by <file>.gz
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	err = WriteFileAtomicFunc(path+".gz", 0644, func(w io.Writer) error {
+		gz := gzip.NewWriter(w)
+		if _, err := io.Copy(gz, src); err != nil {
+			return err
+		}
+		return gz.Close()
+	})
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,131 @@
+package monitoring
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func countJournalLines(t *testing.T, path string) int {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var scanner *bufio.Scanner
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanner = bufio.NewScanner(gz)
+	} else {
+		scanner = bufio.NewScanner(f)
+	}
+
+	lines := 0
+	for scanner.Scan() {
+		r := Record{}
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		lines++
+	}
+	return lines
+}
+
+func TestJournalRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	t.Log("Give a journal rotated every 10 samples, compressed and keeping 2 segments")
+	path := filepath.Join(dir, "samples.jsonl")
+	line, _ := json.Marshal(Record{Timestamp: 1000000020})
+	journal := NewJournal(path)
+	journal.MaxSize = int64(len(line)+1) * 10
+	journal.Compress = true
+	journal.MaxBackups = 2
+	for i := int64(0); i < 35; i++ {
+		if err := journal.Append(Record{Timestamp: 1000000020 + i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	journal.Append(NewGapRecord(1000000055))
+	journal.Append(NewGapRecord(1000000056))
+	if err := journal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	segments := journal.Segments()
+	if len(segments) != 2 || !strings.HasSuffix(segments[0], ".jsonl.gz") {
+		t.Fatalf("expected 2 compressed segments, but got %v", segments)
+	}
+	for _, segment := range segments {
+		if lines := countJournalLines(t, segment); lines != 10 {
+			t.Errorf("expected 10 lines in %s, but got %d", segment, lines)
+		}
+	}
+	if lines := countJournalLines(t, path); lines != 6 {
+		t.Errorf("expected 5 samples and a gap in the journal, but got %d lines", lines)
+	}
+	t.Log("The journal is rotated by size, the oldest segment is removed")
+
+	t.Log("Give the journal reopened with a 30s age limit")
+	journal = NewJournal(path)
+	journal.MaxAge = 30 * time.Second
+	journal.Append(Record{Timestamp: 1000000079})
+	if lines := countJournalLines(t, path); lines != 7 {
+		t.Errorf("expected the journal continued, but got %d lines", lines)
+	}
+	journal.Append(Record{Timestamp: 1000000080})
+	journal.Close()
+	if lines := countJournalLines(t, path); lines != 1 || len(journal.Segments()) != 3 {
+		t.Errorf("expected the journal rotated 30s after the first sample, but got %d lines and %v", lines, journal.Segments())
+	}
+	t.Log("The journal is rotated by age")
+}
+
+func TestJournalSegmentsWithoutExtension(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	t.Log("Give a journal without extension next to monitoring-agent.log, rotated every sample keeping 1 segment")
+	path := filepath.Join(dir, "monitoring")
+	neighbours := []string{"monitoring-agent.log", "monitoring-20200101T000000Z-000.jsonl", "monitoring-old"}
+	for _, name := range neighbours {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("keep\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	journal := NewJournal(path)
+	journal.MaxSize = 1
+	journal.MaxBackups = 1
+	for i := int64(0); i < 3; i++ {
+		journal.Append(Record{Timestamp: 1000000020 + i})
+	}
+	journal.Close()
+
+	segments := journal.Segments()
+	if len(segments) != 1 || !strings.HasPrefix(filepath.Base(segments[0]), "monitoring-") {
+		t.Fatalf("expected 1 segment, but got %v", segments)
+	}
+	for _, name := range neighbours {
+		if !fileExists(filepath.Join(dir, name)) {
+			t.Errorf("expected %s kept", name)
+		}
+	}
+	t.Log("Only the segments of the journal are pruned")
+}
@@ -0,0 +1,118 @@
+package monitoring
+
+import "encoding/json"
+
+// The legacy layout of version 1, read by the PrimeHub UI before the schema version
+
+type LegacyGPUSpec struct {
+	Index       int   `json:"index"`
+	MemoryTotal int64 `json:"mem_total"`
+}
+
+type LegacySpec struct {
+	MemoryTotal int64           `json:"mem_total"`
+	GPUSpec     []LegacyGPUSpec `json:"GPU"`
+}
+
+type LegacyGPURecord struct {
+	Index          int   `json:"index"`
+	MemoryUsed     int64 `json:"mem_used"`
+	GPUUtilization int   `json:"gpu_util"`
+}
+
+type LegacyRecord struct {
+	Timestamp      int64             `json:"timestamp"`
+	CpuUtilization int               `json:"cpu_util"`
+	MemoryUsed     int64             `json:"mem_used"`
+	GPURecords     []LegacyGPURecord `json:"GPU"`
+}
+
+type LegacyDatasets struct {
+	FifteenMinutes []LegacyRecord `json:"15m"`
+	OneHour        []LegacyRecord `json:"1h"`
+	ThreeHours     []LegacyRecord `json:"3h"`
+	LifeTime       []LegacyRecord `json:"lifetime"`
+}
+
+type LegacyMonitoring struct {
+	Spec     LegacySpec     `json:"spec"`
+	Datasets LegacyDatasets `json:"datasets"`
+}
+
+// ToLegacy converts the document to the legacy layout.
+// A legacy dataset missing in the tiers is served by the finest tier holding its window, limited to the window,
+// and the lifetime is served by the coarsest tier. The gaps are dropped since the legacy readers don't know them.
+func ToLegacy(report Monitoring) LegacyMonitoring {
+	legacy := LegacyMonitoring{
+		Spec: LegacySpec{
+			MemoryTotal: report.Spec.MemoryTotal,
+			GPUSpec:     make([]LegacyGPUSpec, len(report.Spec.GPUSpec)),
+		},
+	}
+	for i, gpu := range report.Spec.GPUSpec {
+		legacy.Spec.GPUSpec[i] = LegacyGPUSpec{Index: gpu.Index, MemoryTotal: gpu.MemoryTotal}
+	}
+
+	legacy.Datasets.FifteenMinutes = toLegacyRecords(legacyDataset(report, "15m", 900))
+	legacy.Datasets.OneHour = toLegacyRecords(legacyDataset(report, "1h", 3600))
+	legacy.Datasets.ThreeHours = toLegacyRecords(legacyDataset(report, "3h", 10800))
+	legacy.Datasets.LifeTime = toLegacyRecords(legacyDataset(report, "lifetime", 0))
+	return legacy
+}
+
+func MarshalLegacy(report Monitoring) ([]byte, error) {
+	return json.Marshal(ToLegacy(report))
+}
+
+// legacyDataset returns the records of the tier by name, or the records of window seconds from the best tier,
+// the coarsest tier is used if the window is 0 or no tier holds the window
+func legacyDataset(report Monitoring, name string, window int) []Record {
+	if records, ok := report.Datasets[name]; ok {
+		return records
+	}
+	if len(report.Tiers) == 0 {
+		return nil
+	}
+
+	tier := report.Tiers[len(report.Tiers)-1]
+	if window > 0 {
+		for _, t := range report.Tiers {
+			if t.Retention >= window {
+				tier = t
+				break
+			}
+		}
+	}
+	records := report.Datasets[tier.Name]
+	if window == 0 || len(records) == 0 {
+		return records
+	}
+
+	from := records[len(records)-1].Timestamp - int64(window)
+	for i, r := range records {
+		if r.Timestamp > from {
+			return records[i:]
+		}
+	}
+	return nil
+}
+
+func toLegacyRecords(records []Record) []LegacyRecord {
+	legacy := make([]LegacyRecord, 0, len(records))
+	for _, r := range records {
+		if r.Gap {
+			continue
+		}
+		gpus := make([]LegacyGPURecord, len(r.GPURecords))
+		for g, gpu := range r.GPURecords {
+			gpus[g] = LegacyGPURecord{Index: gpu.Index, MemoryUsed: gpu.MemoryUsed, GPUUtilization: gpu.GPUUtilization}
+		}
+		legacy = append(legacy, LegacyRecord{
+			Timestamp:      r.Timestamp,
+			CpuUtilization: r.CpuUtilization,
+			MemoryUsed:     r.MemoryUsed,
+			GPURecords:     gpus,
+		})
+	}
+	return legacy
+}
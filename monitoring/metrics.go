@@ -1,52 +1,208 @@
 package monitoring
 
-import log "github.com/sirupsen/logrus"
+import (
+	"fmt"
+	"math"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
 
 type Metrics struct {
-	FifteenMinutes *Buffer
-	OneHour        *Buffer
-	ThreeHours     *Buffer
-	LifeTime       *Buffer
+	// Tiers from the finest resolution, the first one receives every record
+	Tiers []*Buffer
+
+	// Policies merges the samples into the coarser buffers, attaching the envelopes if Envelopes is set
+	Policies  AggregationPolicies
+	Envelopes bool
+
+	// guards the tiers, the records are decoded from the columns on read, so the copies share nothing with the tiers
+	mutex sync.RWMutex
+}
+
+// Snapshot is a consistent copy of all tiers at a point in time
+type Snapshot struct {
+	Tiers    []TierSpec
+	Datasets Datasets
 }
 
 func NewMetrics(lifetimeMax int) *Metrics {
 	log.Infof("New metrics with lifetime-max %d", lifetimeMax)
-	m := new(Metrics)
+	m, err := NewMetricsWithTiers(DefaultTiers(lifetimeMax))
+	if err != nil {
+		// the default tiers are always valid
+		panic(err)
+	}
+	return m
+}
+
+func NewMetricsWithTiers(tiers []TierConfig) (*Metrics, error) {
+	if err := ValidateTiers(tiers); err != nil {
+		return nil, err
+	}
 
-	// 15m: 10s → 15 * 60 / 10 = 90 points
-	m.FifteenMinutes = NewBuffer(10, 90)
+	m := new(Metrics)
+	m.Policies = DefaultAggregationPolicies()
+	m.Tiers = make([]*Buffer, len(tiers))
+	for i, tier := range tiers {
+		buffer := NewBuffer(int(tier.Resolution.Seconds()), tier.Capacity())
+		buffer.Name = tier.Name
+		buffer.Compact = tier.Adaptive
+		m.Tiers[i] = buffer
+		if i == 0 {
+			log.Debugf("%s: Interval=%d, Max=%d", buffer.Name, buffer.Interval, buffer.Max)
+			continue
+		}
 
-	// 1h: 30s → 60 * 60 / 30 = 120 points
-	m.OneHour = NewBuffer(30, 120)
-	m.OneHour.AverageByLast = m.OneHour.Interval / m.FifteenMinutes.Interval
-	log.Debugf("OneHour.AverageByLast=%d", m.OneHour.AverageByLast)
+		// aggregate from the finest tier still holding a whole bucket when the next one begins
+		for _, source := range m.Tiers[:i] {
+			if buffer.Interval%source.Interval == 0 && buffer.Interval/source.Interval < source.Max {
+				buffer.Source = source
+				buffer.AverageByLast = buffer.Interval / source.Interval
+				break
+			}
+		}
+		if buffer.Source == nil {
+			return nil, fmt.Errorf("no finer tier holds an interval of tier %s", tier.Name)
+		}
+		log.Debugf("%s: Interval=%d, Max=%d, Source=%s, AverageByLast=%d",
+			buffer.Name, buffer.Interval, buffer.Max, buffer.Source.Name, buffer.AverageByLast)
+	}
+	return m, nil
+}
 
-	// 3h: 2m → 3 * 60 * 60 / 120 = 90 points
-	m.ThreeHours = NewBuffer(2*60, 90)
-	m.ThreeHours.AverageByLast = m.ThreeHours.Interval / m.FifteenMinutes.Interval
-	log.Debugf("ThreeHours.AverageByLast=%d", m.ThreeHours.AverageByLast)
+// Tier returns the buffer of the tier by name, or nil if not found
+func (m *Metrics) Tier(name string) *Buffer {
+	for _, tier := range m.Tiers {
+		if tier.Name == name {
+			return tier
+		}
+	}
+	return nil
+}
 
-	// 4 week: 5m → 4 * 7 * 24 * 60 * 60 / 300 = 8064 points
-	m.LifeTime = NewBuffer(5*60, lifetimeMax)
-	m.LifeTime.AverageByLast = m.LifeTime.Interval / m.FifteenMinutes.Interval
-	log.Debugf("LifeTime.AverageByLast=%d", m.LifeTime.AverageByLast)
-	return m
+// Latest returns the latest record of the finest tier
+func (m *Metrics) Latest() (Record, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.Tiers[0].Latest()
 }
 
 func (m *Metrics) Add(record Record) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
 	// don't check IsTimeToUpdate here
 	// it is controlled by caller, just accept it
-	m.FifteenMinutes.Add(record)
+	finest := m.Tiers[0]
+	if last, ok := finest.Latest(); ok && !last.Gap && record.Timestamp-last.Timestamp > int64(2*finest.Interval) {
+		// the agent was paused or the node stalled
+		m.add(NewGapRecord(last.Timestamp + int64(finest.Interval)))
+	}
+	m.add(record)
+}
 
-	if m.FifteenMinutes.HasLast(m.OneHour.AverageByLast) && m.OneHour.IsTimeToUpdate() {
-		m.OneHour.Add(m.FifteenMinutes.LastAverage(m.OneHour.AverageByLast))
+// AddGap marks the samples are missing from the timestamp, e.g., a collector fails
+func (m *Metrics) AddGap(timestamp int64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if last, ok := m.Tiers[0].Latest(); ok && last.Gap {
+		return
 	}
+	m.add(NewGapRecord(timestamp))
+}
+
+func (m *Metrics) add(record Record) {
+	m.Tiers[0].Add(record)
+
+	// the timestamp of the latest record added to each buffer in this round
+	added := map[*Buffer]int64{m.Tiers[0]: record.Timestamp}
+	for _, tier := range m.Tiers[1:] {
+		timestamp, ok := added[tier.Source]
+		if !ok {
+			continue
+		}
+		for _, point := range m.closeBucket(tier, timestamp) {
+			if tier.Compact {
+				m.addCompacting(tier, point)
+				continue
+			}
+			tier.Add(point)
+			added[tier] = point.Timestamp
+		}
+	}
+}
 
-	if m.FifteenMinutes.HasLast(m.ThreeHours.AverageByLast) && m.ThreeHours.IsTimeToUpdate() {
-		m.ThreeHours.Add(m.FifteenMinutes.LastAverage(m.ThreeHours.AverageByLast))
+// closeBucket aggregates the open bucket of the tier once its source has moved to a later bucket,
+// followed by a gap if the buckets in between have no record.
+// The buckets are aligned to the wall clock by the timestamps, e.g., every :00 and :30 second for 30s,
+// so they stay the same regardless of the sampling jitter or restarts.
+func (m *Metrics) closeBucket(tier *Buffer, timestamp int64) []Record {
+	bucket := tier.BucketOf(timestamp)
+	open := tier.OpenBucket
+	if bucket <= open {
+		return nil
 	}
+	tier.OpenBucket = bucket
+
+	if open < 0 {
+		return nil
+	}
+	points := make([]Record, 0, 2)
+	next := open + int64(tier.BaseInterval)
+	if records := tier.Source.Between(open, next); len(records) > 0 {
+		point := aggregateRecords(records, m.Policies, m.Envelopes)
+		point.Timestamp = open
+		points = append(points, point)
+	}
+	if bucket > next && (len(points) == 0 || !points[0].Gap) {
+		points = append(points, NewGapRecord(next))
+	}
+	return points
+}
+
+// Snapshot copies the specs and the records of all tiers under the same lock,
+// so it can be read in parallel with the sampling
+func (m *Metrics) Snapshot() Snapshot {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return Snapshot{Tiers: m.tierSpecs(), Datasets: m.datasets()}
+}
+
+func (m *Metrics) TierSpecs() []TierSpec {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.tierSpecs()
+}
+
+func (m *Metrics) tierSpecs() []TierSpec {
+	specs := make([]TierSpec, len(m.Tiers))
+	for i, tier := range m.Tiers {
+		specs[i] = TierSpec{
+			Name:      tier.Name,
+			Interval:  tier.Interval,
+			Capacity:  tier.Max,
+			Adaptive:  tier.Compact,
+			Retention: tier.Interval * tier.Max,
+		}
+		if tier.Source != nil {
+			specs[i].Source = tier.Source.Name
+		}
+	}
+	return specs
+}
+
+func (m *Metrics) Datasets() Datasets {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.datasets()
+}
 
-	if m.FifteenMinutes.HasLast(m.LifeTime.AverageByLast) && m.LifeTime.IsTimeToUpdate() {
-		m.LifeTime.Add(m.FifteenMinutes.LastAverage(m.LifeTime.AverageByLast))
+// datasets reads the whole range of each tier by the query of the tier
+func (m *Metrics) datasets() Datasets {
+	datasets := make(Datasets, len(m.Tiers))
+	for _, tier := range m.Tiers {
+		datasets[tier.Name] = tier.Between(math.MinInt64, math.MaxInt64)
 	}
+	return datasets
 }
@@ -0,0 +1,250 @@
+//go:build cgo
+// +build cgo
+
+package monitoring
+
+// gonvml doesn't bind the MIG API, the calls are bound here to the libnvidia-ml.so.1 loaded and initialized by
+// gonvml. The library is reference counted by dlopen, and the device handles are valid until gonvml shuts it down.
+
+// #cgo LDFLAGS: -ldl
+/*
+#include <dlfcn.h>
+#include <stddef.h>
+
+typedef struct nvmlDevice_st *nvmlDevice_t;
+typedef int nvmlReturn_t;
+typedef struct {
+  unsigned long long total;
+  unsigned long long free;
+  unsigned long long used;
+} nvmlMemory_t;
+typedef struct {
+  unsigned int gpu;
+  unsigned int memory;
+} nvmlUtilization_t;
+
+#define MIG_NVML_ERROR_FUNCTION_NOT_FOUND 13
+
+static void *migNvml;
+static nvmlReturn_t (*migGetHandleByIndex)(unsigned int, nvmlDevice_t *);
+static nvmlReturn_t (*migGetMigMode)(nvmlDevice_t, unsigned int *, unsigned int *);
+static nvmlReturn_t (*migGetMaxMigDeviceCount)(nvmlDevice_t, unsigned int *);
+static nvmlReturn_t (*migGetMigDeviceHandleByIndex)(nvmlDevice_t, unsigned int, nvmlDevice_t *);
+static nvmlReturn_t (*migGetGpuInstanceId)(nvmlDevice_t, unsigned int *);
+static nvmlReturn_t (*migGetComputeInstanceId)(nvmlDevice_t, unsigned int *);
+static nvmlReturn_t (*migGetUUID)(nvmlDevice_t, char *, unsigned int);
+static nvmlReturn_t (*migGetMemoryInfo)(nvmlDevice_t, nvmlMemory_t *);
+static nvmlReturn_t (*migGetUtilizationRates)(nvmlDevice_t, nvmlUtilization_t *);
+static const char *(*migErrorString)(nvmlReturn_t);
+
+static int migNvmlLoad() {
+  if (migNvml != NULL) {
+    return 0;
+  }
+  migNvml = dlopen("libnvidia-ml.so.1", RTLD_LAZY);
+  if (migNvml == NULL) {
+    return -1;
+  }
+  migGetHandleByIndex = dlsym(migNvml, "nvmlDeviceGetHandleByIndex_v2");
+  migGetMigMode = dlsym(migNvml, "nvmlDeviceGetMigMode");
+  migGetMaxMigDeviceCount = dlsym(migNvml, "nvmlDeviceGetMaxMigDeviceCount");
+  migGetMigDeviceHandleByIndex = dlsym(migNvml, "nvmlDeviceGetMigDeviceHandleByIndex");
+  migGetGpuInstanceId = dlsym(migNvml, "nvmlDeviceGetGpuInstanceId");
+  migGetComputeInstanceId = dlsym(migNvml, "nvmlDeviceGetComputeInstanceId");
+  migGetUUID = dlsym(migNvml, "nvmlDeviceGetUUID");
+  migGetMemoryInfo = dlsym(migNvml, "nvmlDeviceGetMemoryInfo");
+  migGetUtilizationRates = dlsym(migNvml, "nvmlDeviceGetUtilizationRates");
+  migErrorString = dlsym(migNvml, "nvmlErrorString");
+  return 0;
+}
+
+static nvmlReturn_t migDeviceGetHandleByIndex(unsigned int index, nvmlDevice_t *device) {
+  if (migGetHandleByIndex == NULL) {
+    return MIG_NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return migGetHandleByIndex(index, device);
+}
+
+static nvmlReturn_t migDeviceGetMigMode(nvmlDevice_t device, unsigned int *current, unsigned int *pending) {
+  if (migGetMigMode == NULL) {
+    return MIG_NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return migGetMigMode(device, current, pending);
+}
+
+static nvmlReturn_t migDeviceGetMaxMigDeviceCount(nvmlDevice_t device, unsigned int *count) {
+  if (migGetMaxMigDeviceCount == NULL) {
+    return MIG_NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return migGetMaxMigDeviceCount(device, count);
+}
+
+static nvmlReturn_t migDeviceGetMigDeviceHandleByIndex(nvmlDevice_t device, unsigned int index, nvmlDevice_t *mig) {
+  if (migGetMigDeviceHandleByIndex == NULL) {
+    return MIG_NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return migGetMigDeviceHandleByIndex(device, index, mig);
+}
+
+static nvmlReturn_t migDeviceGetGpuInstanceId(nvmlDevice_t device, unsigned int *id) {
+  if (migGetGpuInstanceId == NULL) {
+    return MIG_NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return migGetGpuInstanceId(device, id);
+}
+
+static nvmlReturn_t migDeviceGetComputeInstanceId(nvmlDevice_t device, unsigned int *id) {
+  if (migGetComputeInstanceId == NULL) {
+    return MIG_NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return migGetComputeInstanceId(device, id);
+}
+
+static nvmlReturn_t migDeviceGetUUID(nvmlDevice_t device, char *uuid, unsigned int length) {
+  if (migGetUUID == NULL) {
+    return MIG_NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  return migGetUUID(device, uuid, length);
+}
+
+static nvmlReturn_t migDeviceGetMemoryInfo(nvmlDevice_t device, unsigned long long *total, unsigned long long *used) {
+  if (migGetMemoryInfo == NULL) {
+    return MIG_NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  nvmlMemory_t memory;
+  nvmlReturn_t r = migGetMemoryInfo(device, &memory);
+  *total = memory.total;
+  *used = memory.used;
+  return r;
+}
+
+static nvmlReturn_t migDeviceGetUtilizationRates(nvmlDevice_t device, unsigned int *gpu, unsigned int *memory) {
+  if (migGetUtilizationRates == NULL) {
+    return MIG_NVML_ERROR_FUNCTION_NOT_FOUND;
+  }
+  nvmlUtilization_t utilization;
+  nvmlReturn_t r = migGetUtilizationRates(device, &utilization);
+  *gpu = utilization.gpu;
+  *memory = utilization.memory;
+  return r;
+}
+
+static const char *migNvmlErrorString(nvmlReturn_t r) {
+  if (migErrorString == NULL) {
+    return "nvmlErrorString Function Not Found";
+  }
+  return migErrorString(r);
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	nvmlSuccess          = 0
+	nvmlNotSupported     = 3
+	nvmlNotFound         = 6
+	nvmlFunctionNotFound = 13
+
+	nvmlDeviceMigEnable = 1
+
+	// NVML_DEVICE_UUID_V2_BUFFER_SIZE
+	nvmlUUIDBufferSize = 96
+)
+
+// nvmlMigDevice is a MIG device, the minor number is the one of the parent gpu
+type nvmlMigDevice struct {
+	handle C.nvmlDevice_t
+	minor  uint
+}
+
+func nvmlError(r C.nvmlReturn_t) error {
+	switch r {
+	case nvmlSuccess:
+		return nil
+	case nvmlNotSupported, nvmlFunctionNotFound:
+		return ErrNvmlNotSupported
+	}
+	return fmt.Errorf("nvml: %s", C.GoString(C.migNvmlErrorString(r)))
+}
+
+// nvmlMigDevices returns the MIG devices of the gpu at the index, or an empty list if MIG is disabled
+func nvmlMigDevices(index uint, minor uint) ([]NvmlDevice, error) {
+	if C.migNvmlLoad() != 0 {
+		return nil, errors.New("nvml: cannot load libnvidia-ml.so.1")
+	}
+
+	var device C.nvmlDevice_t
+	if err := nvmlError(C.migDeviceGetHandleByIndex(C.uint(index), &device)); err != nil {
+		return nil, err
+	}
+	var current, pending C.uint
+	if err := nvmlError(C.migDeviceGetMigMode(device, &current, &pending)); err != nil {
+		return nil, err
+	}
+	if current != nvmlDeviceMigEnable {
+		return []NvmlDevice{}, nil
+	}
+
+	var count C.uint
+	if err := nvmlError(C.migDeviceGetMaxMigDeviceCount(device, &count)); err != nil {
+		return nil, err
+	}
+	devices := make([]NvmlDevice, 0, count)
+	for i := C.uint(0); i < count; i++ {
+		var mig C.nvmlDevice_t
+		r := C.migDeviceGetMigDeviceHandleByIndex(device, i, &mig)
+		if r == nvmlNotFound {
+			// the slot has no MIG device created
+			continue
+		}
+		if err := nvmlError(r); err != nil {
+			return nil, err
+		}
+		devices = append(devices, nvmlMigDevice{handle: mig, minor: minor})
+	}
+	return devices, nil
+}
+
+func (d nvmlMigDevice) MinorNumber() (uint, error) {
+	return d.minor, nil
+}
+
+func (d nvmlMigDevice) UUID() (string, error) {
+	var buffer [nvmlUUIDBufferSize]C.char
+	if err := nvmlError(C.migDeviceGetUUID(d.handle, &buffer[0], nvmlUUIDBufferSize)); err != nil {
+		return "", err
+	}
+	return C.GoString(&buffer[0]), nil
+}
+
+func (d nvmlMigDevice) MemoryInfo() (uint64, uint64, error) {
+	var total, used C.ulonglong
+	err := nvmlError(C.migDeviceGetMemoryInfo(d.handle, &total, &used))
+	return uint64(total), uint64(used), err
+}
+
+func (d nvmlMigDevice) UtilizationRates() (uint, uint, error) {
+	var gpu, memory C.uint
+	err := nvmlError(C.migDeviceGetUtilizationRates(d.handle, &gpu, &memory))
+	return uint(gpu), uint(memory), err
+}
+
+func (d nvmlMigDevice) MigDevices() ([]NvmlDevice, error) {
+	return []NvmlDevice{}, nil
+}
+
+func (d nvmlMigDevice) GpuInstanceId() (uint, error) {
+	var id C.uint
+	err := nvmlError(C.migDeviceGetGpuInstanceId(d.handle, &id))
+	return uint(id), err
+}
+
+func (d nvmlMigDevice) ComputeInstanceId() (uint, error) {
+	var id C.uint
+	err := nvmlError(C.migDeviceGetComputeInstanceId(d.handle, &id))
+	return uint(id), err
+}
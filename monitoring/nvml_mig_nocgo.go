@@ -0,0 +1,9 @@
+//go:build !cgo
+// +build !cgo
+
+package monitoring
+
+// the MIG API is bound by cgo like gonvml, which reports every call as failed without cgo
+func nvmlMigDevices(index uint, minor uint) ([]NvmlDevice, error) {
+	return nil, ErrNvmlNotSupported
+}
@@ -0,0 +1,248 @@
+package monitoring
+
+import (
+	"bytes"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	prometheusContentType  = "text/plain; version=0.0.4; charset=utf-8"
+	openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Exporter serves the latest record in the Prometheus text exposition format, or in OpenMetrics if the scraper
+// accepts it. The values are in the base units, e.g., cores and bytes, and Labels are attached to every series,
+// e.g., the PrimeHub job name. Nothing but the build info and the Spec is served before the first record,
+// and only the timestamp while the samples are missing.
+type Exporter struct {
+	Metrics *Metrics
+	Spec    Spec
+	Labels  map[string]string
+
+	// the write counters of the sinks are exported if it is set
+	Sinks *SinkPipeline
+}
+
+func NewExporter(metrics *Metrics, spec Spec, labels map[string]string) *Exporter {
+	return &Exporter{Metrics: metrics, Spec: spec, Labels: labels}
+}
+
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+	data := e.Exposition(openMetrics)
+	if openMetrics {
+		w.Header().Set("Content-Type", openMetricsContentType)
+	} else {
+		w.Header().Set("Content-Type", prometheusContentType)
+	}
+	w.Write(data)
+}
+
+// Exposition renders the metric families of the latest record
+func (e *Exporter) Exposition(openMetrics bool) []byte {
+	x := &exposition{constLabels: renderLabels(e.Labels)}
+
+	info := GetBuildInfo()
+	build := metricFamily{name: "primehub_monitoring_agent_build_info", kind: "gauge", help: "The build of the monitoring agent"}
+	if openMetrics {
+		build.name, build.kind = "primehub_monitoring_agent_build", "info"
+	}
+	build.add("primehub_monitoring_agent_build_info", 1,
+		"version", info.Version, "git_commit", info.GitCommit, "git_tree_state", info.GitTreeState, "go_version", info.GoVersion)
+	x.write(build)
+
+	for _, family := range specFamilies(e.Spec) {
+		x.write(family)
+	}
+	if latest, ok := e.Metrics.Latest(); ok {
+		for _, family := range recordFamilies(latest, e.Spec) {
+			x.write(family)
+		}
+	}
+	if e.Sinks != nil {
+		for _, family := range sinkFamilies(e.Sinks.Stats(), openMetrics) {
+			x.write(family)
+		}
+	}
+	if openMetrics {
+		x.buf.WriteString("# EOF\n")
+	}
+	return x.buf.Bytes()
+}
+
+// metricFamily holds the samples of a metric in the base units, e.g., cores and bytes
+type metricFamily struct {
+	name, kind, help string
+	samples          []metricSample
+}
+
+// metricSample is a value of a series, the labels are name and value pairs
+type metricSample struct {
+	name   string
+	labels []string
+	value  float64
+}
+
+func (f *metricFamily) add(name string, value float64, labels ...string) {
+	f.samples = append(f.samples, metricSample{name: name, labels: labels, value: value})
+}
+
+func gauge(name string, help string) metricFamily {
+	return metricFamily{name: name, kind: "gauge", help: help}
+}
+
+// counter names the family without the _total suffix of the samples in OpenMetrics
+func counter(name string, help string, openMetrics bool) metricFamily {
+	family := metricFamily{name: name + "_total", kind: "counter", help: help}
+	if openMetrics {
+		family.name = name
+	}
+	return family
+}
+
+// sinkFamilies returns the write counters of the sinks, labeled by the sink name
+func sinkFamilies(stats map[string]SinkStats, openMetrics bool) []metricFamily {
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	writes := counter("primehub_monitoring_agent_sink_writes", "The reports written by the sink, including the failed ones", openMetrics)
+	errors := counter("primehub_monitoring_agent_sink_errors", "The reports the sink failed to write", openMetrics)
+	dropped := counter("primehub_monitoring_agent_sink_dropped", "The reports replaced by a newer one before the sink wrote them", openMetrics)
+	attempts := counter("primehub_monitoring_agent_sink_failed_attempts", "The failed attempts of the sink including the retried ones", openMetrics)
+	success := gauge("primehub_monitoring_agent_sink_last_success_timestamp_seconds", "The time of the latest report written by the sink")
+	for _, name := range names {
+		s := stats[name]
+		writes.add("primehub_monitoring_agent_sink_writes_total", float64(s.Writes), "sink", name)
+		errors.add("primehub_monitoring_agent_sink_errors_total", float64(s.Errors), "sink", name)
+		dropped.add("primehub_monitoring_agent_sink_dropped_total", float64(s.Dropped), "sink", name)
+		attempts.add("primehub_monitoring_agent_sink_failed_attempts_total", float64(s.FailedAttempts), "sink", name)
+		if !s.LastSuccess.IsZero() {
+			success.add(success.name, float64(s.LastSuccess.UnixNano())/1e9, "sink", name)
+		}
+	}
+	return []metricFamily{writes, errors, dropped, attempts, success}
+}
+
+// specFamilies returns the limits of the job
+func specFamilies(spec Spec) []metricFamily {
+	memory := gauge("primehub_job_memory_limit_bytes", "The memory limit of the job")
+	if spec.MemoryTotal > 0 {
+		memory.add(memory.name, float64(spec.MemoryTotal))
+	}
+	gpuMemory := gauge("primehub_job_gpu_memory_total_bytes", "The memory of the gpu")
+	for _, gpu := range spec.GPUSpec {
+		gpuMemory.add(gpuMemory.name, float64(gpu.MemoryTotal), "index", strconv.Itoa(gpu.Index), "uuid", gpu.UUID)
+	}
+	return []metricFamily{memory, gpuMemory}
+}
+
+// recordFamilies returns the values of the record, only the timestamp is returned for a gap
+func recordFamilies(record Record, spec Spec) []metricFamily {
+	timestamp := gauge("primehub_job_last_sample_timestamp_seconds", "The time of the latest sample")
+	timestamp.add(timestamp.name, float64(record.Timestamp))
+	gap := gauge("primehub_job_sample_gap", "Whether the samples are missing since the latest sample time")
+	if record.Gap {
+		gap.add(gap.name, 1)
+		return []metricFamily{timestamp, gap}
+	}
+	gap.add(gap.name, 0)
+
+	cpu := gauge("primehub_job_cpu_usage_cores", "The cpu usage of the job")
+	cpu.add(cpu.name, float64(record.Millicores())/1000)
+	memory := gauge("primehub_job_memory_used_bytes", "The memory used by the job")
+	memory.add(memory.name, float64(record.MemoryUsed))
+	families := []metricFamily{timestamp, gap, cpu, memory}
+
+	uuids := make(map[int]string, len(spec.GPUSpec))
+	unsupported := make(map[int]bool)
+	for _, gpu := range spec.GPUSpec {
+		uuids[gpu.Index] = gpu.UUID
+		unsupported[gpu.Index] = gpu.UtilizationUnsupported
+	}
+	gpuFamilies := []struct {
+		metricFamily
+		value func(gpu GPURecord) (float64, bool)
+	}{
+		{gauge("primehub_job_gpu_utilization_percent", "The utilization of the gpu"), func(gpu GPURecord) (float64, bool) {
+			return float64(gpu.UtilizationMilli()) / 1000, !unsupported[gpu.Index]
+		}},
+		{gauge("primehub_job_gpu_memory_used_bytes", "The memory used on the gpu"), func(gpu GPURecord) (float64, bool) {
+			return float64(gpu.MemoryUsed), true
+		}},
+		{gauge("primehub_job_gpu_power_watts", "The power draw of the gpu"), func(gpu GPURecord) (float64, bool) {
+			return float64(gpu.Power) / 1000, gpu.Power > 0
+		}},
+		{gauge("primehub_job_gpu_temperature_celsius", "The temperature of the gpu"), func(gpu GPURecord) (float64, bool) {
+			return float64(gpu.Temperature), gpu.Temperature > 0
+		}},
+	}
+	for _, family := range gpuFamilies {
+		for _, gpu := range record.GPURecords {
+			if value, ok := family.value(gpu); ok {
+				family.add(family.name, value, "index", strconv.Itoa(gpu.Index), "uuid", uuids[gpu.Index])
+			}
+		}
+		families = append(families, family.metricFamily)
+	}
+	return families
+}
+
+// reportFamilies returns the limits and the values of the latest record in the finest tier of the report
+func reportFamilies(report Monitoring) []metricFamily {
+	families := specFamilies(report.Spec)
+	if len(report.Tiers) > 0 {
+		if records := report.Datasets[report.Tiers[0].Name]; len(records) > 0 {
+			families = append(families, recordFamilies(records[len(records)-1], report.Spec)...)
+		}
+	}
+	return families
+}
+
+// exposition writes the families in the text format, the families without samples are skipped
+type exposition struct {
+	buf         bytes.Buffer
+	constLabels string
+}
+
+func (x *exposition) write(family metricFamily) {
+	if len(family.samples) == 0 {
+		return
+	}
+	x.buf.WriteString("# HELP " + family.name + " " + family.help + "\n# TYPE " + family.name + " " + family.kind + "\n")
+	for _, sample := range family.samples {
+		x.buf.WriteString(sample.name)
+		rendered := x.constLabels
+		for i := 0; i+1 < len(sample.labels); i += 2 {
+			if rendered != "" {
+				rendered += ","
+			}
+			rendered += sample.labels[i] + `="` + labelValueEscaper.Replace(sample.labels[i+1]) + `"`
+		}
+		if rendered != "" {
+			x.buf.WriteString("{" + rendered + "}")
+		}
+		x.buf.WriteString(" " + strconv.FormatFloat(sample.value, 'f', -1, 64) + "\n")
+	}
+}
+
+func renderLabels(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + labelValueEscaper.Replace(labels[name]) + `"`
+	}
+	return strings.Join(pairs, ",")
+}
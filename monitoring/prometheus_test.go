@@ -0,0 +1,140 @@
+package monitoring
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func scrape(t *testing.T, url string, accept string) (string, string) {
+	request, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accept != "" {
+		request.Header.Set("Accept", accept)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response.Header.Get("Content-Type"), string(body)
+}
+
+func TestExporter(t *testing.T) {
+	t.Log("Give a job with 2 GPUs, the second is a MIG device")
+	metrics := NewMetrics(10)
+	spec := Spec{
+		MemoryTotal: 4 << 30,
+		GPUSpec: []GPUSpec{
+			{Index: 0, UUID: "GPU-0", MemoryTotal: 16 << 30},
+			{Index: 1, UUID: "MIG-1", MemoryTotal: 5 << 30, MIG: true, UtilizationUnsupported: true},
+		},
+	}
+	exporter := NewExporter(metrics, spec, map[string]string{"phjob_name": `job-"a"`})
+	server := httptest.NewServer(exporter)
+	defer server.Close()
+
+	contentType, body := scrape(t, server.URL, "")
+	if contentType != prometheusContentType || strings.Contains(body, "primehub_job_cpu_usage_cores") {
+		t.Errorf("expected only the spec before the first record, but got %s\n%s", contentType, body)
+	}
+	if !strings.Contains(body, `primehub_job_memory_limit_bytes{phjob_name="job-\"a\""} 4294967296`) {
+		t.Errorf("expected the memory limit with the escaped job name, but got\n%s", body)
+	}
+
+	metrics.Add(Record{
+		Timestamp:     1000000000,
+		CpuMillicores: 1500,
+		MemoryUsed:    1 << 30,
+		GPURecords: []GPURecord{
+			{Index: 0, MemoryUsed: 2 << 30, GPUUtilizationMilli: 42500, Power: 250000, Temperature: 70},
+			{Index: 1, MemoryUsed: 1 << 30},
+		},
+	})
+	_, body = scrape(t, server.URL, "")
+	for _, expected := range []string{
+		"# TYPE primehub_monitoring_agent_build_info gauge\n",
+		`primehub_monitoring_agent_build_info{phjob_name="job-\"a\"",version="` + GetBuildInfo().Version + `"`,
+		`primehub_job_last_sample_timestamp_seconds{phjob_name="job-\"a\""} 1000000000` + "\n",
+		`primehub_job_sample_gap{phjob_name="job-\"a\""} 0` + "\n",
+		"# HELP primehub_job_cpu_usage_cores The cpu usage of the job\n# TYPE primehub_job_cpu_usage_cores gauge\n",
+		`primehub_job_cpu_usage_cores{phjob_name="job-\"a\""} 1.5` + "\n",
+		`primehub_job_memory_used_bytes{phjob_name="job-\"a\""} 1073741824` + "\n",
+		`primehub_job_gpu_memory_total_bytes{phjob_name="job-\"a\"",index="1",uuid="MIG-1"} 5368709120` + "\n",
+		`primehub_job_gpu_utilization_percent{phjob_name="job-\"a\"",index="0",uuid="GPU-0"} 42.5` + "\n",
+		`primehub_job_gpu_memory_used_bytes{phjob_name="job-\"a\"",index="1",uuid="MIG-1"} 1073741824` + "\n",
+		`primehub_job_gpu_power_watts{phjob_name="job-\"a\"",index="0",uuid="GPU-0"} 250` + "\n",
+		`primehub_job_gpu_temperature_celsius{phjob_name="job-\"a\"",index="0",uuid="GPU-0"} 70` + "\n",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("expected %q in\n%s", expected, body)
+		}
+	}
+	if strings.Contains(body, `primehub_job_gpu_utilization_percent{phjob_name="job-\"a\"",index="1"`) ||
+		strings.Contains(body, `primehub_job_gpu_power_watts{phjob_name="job-\"a\"",index="1"`) {
+		t.Errorf("expected no utilization of the MIG device nor the power not reported, but got\n%s", body)
+	}
+	if strings.Count(body, "# TYPE primehub_job_gpu_utilization_percent") != 1 || strings.Contains(body, "# EOF") {
+		t.Errorf("expected each family once in the text format, but got\n%s", body)
+	}
+	t.Log("The latest record is exposed in the base units with the gpu labels")
+
+	contentType, body = scrape(t, server.URL, "application/openmetrics-text; version=1.0.0,text/plain;q=0.5")
+	if contentType != openMetricsContentType || !strings.HasSuffix(body, "# EOF\n") ||
+		!strings.Contains(body, "# TYPE primehub_monitoring_agent_build info\n") {
+		t.Errorf("expected the OpenMetrics format, but got %s\n%s", contentType, body)
+	}
+	t.Log("The OpenMetrics format is served if accepted")
+
+	metrics.AddGap(1000000010)
+	_, body = scrape(t, server.URL, "")
+	if !strings.Contains(body, `primehub_job_sample_gap{phjob_name="job-\"a\""} 1`) || strings.Contains(body, "primehub_job_cpu_usage_cores") {
+		t.Errorf("expected no values during the gap, but got\n%s", body)
+	}
+	t.Log("The values are not exposed while the samples are missing")
+}
+
+func TestExporterSinkStats(t *testing.T) {
+	t.Log("Give a working sink and a file sink retrying a write to a missing directory")
+	fileSink := NewFileSink("/nonexistent/monitoring")
+	fileSink.Retries = 1
+	fileSink.Backoff = time.Millisecond
+	pipeline := NewSinkPipeline(&recordingSink{name: "working"}, fileSink)
+	pipeline.Publish(Monitoring{})
+	pipeline.Close()
+
+	exporter := NewExporter(NewMetrics(10), Spec{}, nil)
+	exporter.Sinks = pipeline
+	body := string(exporter.Exposition(false))
+	for _, expected := range []string{
+		"# TYPE primehub_monitoring_agent_sink_errors_total counter\n",
+		`primehub_monitoring_agent_sink_errors_total{sink="file"} 1` + "\n",
+		`primehub_monitoring_agent_sink_failed_attempts_total{sink="file"} 2` + "\n",
+		`primehub_monitoring_agent_sink_writes_total{sink="working"} 1` + "\n",
+		`primehub_monitoring_agent_sink_last_success_timestamp_seconds{sink="working"}`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("expected %q in\n%s", expected, body)
+		}
+	}
+	if strings.Contains(body, `primehub_monitoring_agent_sink_last_success_timestamp_seconds{sink="file"}`) {
+		t.Errorf("expected no success of the file sink, but got\n%s", body)
+	}
+	t.Log("The write counters of the sinks are exported")
+
+	body = string(exporter.Exposition(true))
+	if !strings.Contains(body, "# TYPE primehub_monitoring_agent_sink_errors counter\n") ||
+		!strings.Contains(body, `primehub_monitoring_agent_sink_errors_total{sink="file"} 1`) {
+		t.Errorf("expected the counter family without the suffix in OpenMetrics, but got\n%s", body)
+	}
+	t.Log("The counter families are named without the _total suffix in OpenMetrics")
+}
@@ -0,0 +1,249 @@
+package monitoring
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultPushRetries = 2
+	DefaultPushBackoff = time.Second
+	DefaultPushTimeout = 10 * time.Second
+)
+
+// PushgatewaySink pushes the gauges of the latest record and the summary of the job to the group of Job in a
+// Prometheus Pushgateway, replacing the group on every report. On Close the last report is pushed a final time
+// marked completed, with Retries on failures, and the group is deleted in the background after DeleteAfter if it
+// is positive. WaitDelete holds the agent from exiting until the delete is done, within DeleteTimeout after the
+// delay and the shutdown deadline of the agent. The duration of the job is counted from Started, the start of the agent, if it is set.
+type PushgatewaySink struct {
+	URL           string
+	Job           string
+	Started       time.Time
+	DeleteAfter   time.Duration
+	DeleteTimeout time.Duration
+	Retries       int
+	Backoff       time.Duration
+
+	client *http.Client
+	last   *Monitoring
+
+	// closed once the delayed delete is done or given up
+	deleted  chan struct{}
+	deadline time.Time
+}
+
+func NewPushgatewaySink(url string, job string) *PushgatewaySink {
+	return &PushgatewaySink{
+		URL:           strings.TrimSuffix(url, "/"),
+		Job:           job,
+		DeleteTimeout: DefaultPushTimeout,
+		Retries:       DefaultPushRetries,
+		Backoff:       DefaultPushBackoff,
+		client:        &http.Client{Timeout: DefaultPushTimeout},
+	}
+}
+
+func (s *PushgatewaySink) Name() string {
+	return "pushgateway"
+}
+
+func (s *PushgatewaySink) Write(report Monitoring) error {
+	s.last = &report
+	return s.request(context.Background(), "PUT", PushgatewayExposition(report, s.Started, false))
+}
+
+// Close pushes the last report as completed, then deletes the group in the background after DeleteAfter
+func (s *PushgatewaySink) Close() error {
+	if s.last == nil {
+		return nil
+	}
+	body := PushgatewayExposition(*s.last, s.Started, true)
+	backoff := s.Backoff
+	var err error
+	for attempt := 0; attempt <= s.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		if err = s.request(context.Background(), "PUT", body); err == nil {
+			break
+		}
+	}
+	if err != nil || s.DeleteAfter <= 0 {
+		return err
+	}
+
+	log.Infof("Delete the pushgateway group of job %s in %v", s.Job, s.DeleteAfter)
+	s.deleted = make(chan struct{})
+	s.deadline = time.Now().Add(s.DeleteAfter + s.DeleteTimeout)
+	go func() {
+		defer close(s.deleted)
+		ctx, cancel := context.WithDeadline(context.Background(), s.deadline)
+		defer cancel()
+		select {
+		case <-time.After(s.DeleteAfter):
+		case <-ctx.Done():
+			return
+		}
+		if err := s.request(ctx, "DELETE", nil); err != nil {
+			log.Warnf("Cannot delete the pushgateway group of job %s: %v", s.Job, err)
+		}
+	}()
+	return nil
+}
+
+// WaitDelete waits for the delayed delete started by Close, at most until DeleteTimeout after the delay,
+// or the shutdown deadline if it is earlier, then the delete is abandoned
+func (s *PushgatewaySink) WaitDelete(shutdown time.Time) {
+	if s.deleted == nil {
+		return
+	}
+	deadline, reason := s.deadline, "the delete timed out"
+	if shutdown.Before(deadline) {
+		deadline, reason = shutdown, "the shutdown deadline is reached"
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-s.deleted:
+	case <-timer.C:
+		log.Warnf("Abandon deleting the pushgateway group of job %s, %s", s.Job, reason)
+	}
+}
+
+// groupURL encodes the job name by base64 since it may contain a slash
+func (s *PushgatewaySink) groupURL() string {
+	return s.URL + "/metrics/job@base64/" + base64.RawURLEncoding.EncodeToString([]byte(s.Job))
+}
+
+func (s *PushgatewaySink) request(ctx context.Context, method string, body []byte) error {
+	request, err := http.NewRequest(method, s.groupURL(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request = request.WithContext(ctx)
+	if body != nil {
+		request.Header.Set("Content-Type", prometheusContentType)
+	}
+	response, err := s.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 512))
+	if response.StatusCode/100 != 2 {
+		return fmt.Errorf("%s %s: %s: %s", method, s.groupURL(), response.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// PushgatewayExposition renders the gauges of the latest record in the finest tier and the summary of the job,
+// the duration is counted from started unless the report holds an earlier record, e.g., restored after a restart
+func PushgatewayExposition(report Monitoring, started time.Time, completed bool) []byte {
+	x := &exposition{}
+	for _, family := range reportFamilies(report) {
+		x.write(family)
+	}
+	for _, family := range summaryFamilies(report, started, completed) {
+		x.write(family)
+	}
+	return x.buf.Bytes()
+}
+
+// summaryFamilies returns the peak memory, the average gpu utilization and the duration of the job in the report.
+// The peak is the max of all tiers since the finer ones may hold a sample higher than the merged record.
+// The average is weighted by the samples merged into each record, the coarser tiers serve the range before the
+// finer ones like Metrics.Query, so every sample is counted once.
+// The duration doesn't rely on the first record only, which is dropped once the coarsest tier is full.
+func summaryFamilies(report Monitoring, started time.Time, completed bool) []metricFamily {
+	var first, last, peak int64
+	sums := make(map[int]int64)
+	weights := make(map[int]int64)
+	indexes := make([]int, 0)
+	covered := int64(math.MinInt64)
+	for i := len(report.Tiers) - 1; i >= 0; i-- {
+		tier := report.Tiers[i]
+		end := covered
+		for _, r := range report.Datasets[tier.Name] {
+			if r.Gap || r.Timestamp < covered {
+				continue
+			}
+			end = r.Timestamp + int64(tier.Interval)
+			if first == 0 || r.Timestamp < first {
+				first = r.Timestamp
+			}
+			if end > last {
+				last = end
+			}
+
+			weight := int64(r.Samples)
+			if weight == 0 {
+				weight = 1
+			}
+			for _, gpu := range r.GPURecords {
+				if _, ok := weights[gpu.Index]; !ok {
+					indexes = append(indexes, gpu.Index)
+				}
+				sums[gpu.Index] += gpu.UtilizationMilli() * weight
+				weights[gpu.Index] += weight
+			}
+		}
+		covered = end
+	}
+
+	for _, records := range report.Datasets {
+		for _, r := range records {
+			memory := r.MemoryUsed
+			if r.MemoryEnvelope != nil && r.MemoryEnvelope.Max > memory {
+				memory = r.MemoryEnvelope.Max
+			}
+			if memory > peak {
+				peak = memory
+			}
+		}
+	}
+
+	memory := gauge("primehub_job_memory_peak_bytes", "The peak memory used by the job")
+	duration := gauge("primehub_job_duration_seconds", "The time since the start of the job")
+	if first > 0 {
+		if !started.IsZero() && started.Unix() < first {
+			first = started.Unix()
+		}
+		memory.add(memory.name, float64(peak))
+		duration.add(duration.name, float64(last-first))
+	}
+
+	uuids := make(map[int]string, len(report.Spec.GPUSpec))
+	unsupported := make(map[int]bool)
+	for _, gpu := range report.Spec.GPUSpec {
+		uuids[gpu.Index] = gpu.UUID
+		unsupported[gpu.Index] = gpu.UtilizationUnsupported
+	}
+	utilization := gauge("primehub_job_gpu_utilization_average_percent", "The average utilization of the gpu over the job")
+	for _, index := range indexes {
+		if !unsupported[index] {
+			average := float64(roundDiv(sums[index], weights[index])) / 1000
+			utilization.add(utilization.name, average, "index", strconv.Itoa(index), "uuid", uuids[index])
+		}
+	}
+
+	done := gauge("primehub_job_completed", "Whether the job has completed, pushed by the agent on exit")
+	if completed {
+		done.add(done.name, 1)
+	} else {
+		done.add(done.name, 0)
+	}
+	return []metricFamily{memory, utilization, duration, done}
+}
@@ -0,0 +1,164 @@
+package monitoring
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type pushRequest struct {
+	method, path, body string
+}
+
+// pushgatewayStandIn records the requests, and answers 500 to the first failures ones
+type pushgatewayStandIn struct {
+	mutex    sync.Mutex
+	requests []pushRequest
+	failures int
+}
+
+func (s *pushgatewayStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	s.requests = append(s.requests, pushRequest{method: r.Method, path: r.URL.Path, body: string(body)})
+	if s.failures > 0 {
+		s.failures--
+		http.Error(w, "unavailable", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func TestPushgatewaySink(t *testing.T) {
+	standIn := &pushgatewayStandIn{}
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+
+	t.Log("Give a job of 2 tiers with a GPU, the coarse tier holds the oldest records and the fine tier the latest")
+	metrics, _ := NewMetricsWithTiers([]TierConfig{
+		{Name: "fine", Resolution: 10 * time.Second, Retention: 2 * time.Minute},
+		{Name: "coarse", Resolution: time.Minute, Retention: time.Hour},
+	})
+	base := int64(1000000200)
+	for i := int64(0); i < 30; i++ {
+		utilization := int64(20000)
+		if i >= 12 {
+			utilization = 80000
+		}
+		memory := int64(1 << 30)
+		if i == 3 {
+			memory = 3 << 30
+		}
+		metrics.Add(Record{
+			Timestamp:  base + i*10,
+			MemoryUsed: memory,
+			GPURecords: []GPURecord{{Index: 0, GPUUtilizationMilli: utilization}},
+		})
+	}
+	spec := Spec{MemoryTotal: 4 << 30, GPUSpec: []GPUSpec{{Index: 0, UUID: "GPU-0", MemoryTotal: 16 << 30}}}
+	report := NewMonitoring(spec, metrics.Snapshot())
+
+	sink := NewPushgatewaySink(server.URL+"/", "job/a")
+	sink.Backoff = time.Millisecond
+	if err := sink.Write(report); err != nil {
+		t.Fatal(err)
+	}
+	push := standIn.requests[0]
+	if push.method != "PUT" || push.path != "/metrics/job@base64/am9iL2E" {
+		t.Fatalf("expected PUT to the group of the base64 job name, but got %s %s", push.method, push.path)
+	}
+	for _, expected := range []string{
+		"primehub_job_memory_limit_bytes 4294967296\n",
+		`primehub_job_gpu_utilization_percent{index="0",uuid="GPU-0"} 80` + "\n",
+		"primehub_job_memory_peak_bytes 3221225472\n",
+		`primehub_job_gpu_utilization_average_percent{index="0",uuid="GPU-0"} 56` + "\n",
+		"primehub_job_duration_seconds 300\n",
+		"primehub_job_completed 0\n",
+	} {
+		if !strings.Contains(push.body, expected) {
+			t.Errorf("expected %q in\n%s", expected, push.body)
+		}
+	}
+	t.Log("The gauges and the summary are pushed to the group of the job")
+
+	t.Log("Give the final push failed once and a delete after 10ms")
+	standIn.failures = 1
+	sink.DeleteAfter = 10 * time.Millisecond
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	standIn.mutex.Lock()
+	if len(standIn.requests) != 3 {
+		t.Errorf("expected Close not waiting for the delete, but got %+v", standIn.requests[1:])
+	}
+	standIn.mutex.Unlock()
+	sink.WaitDelete(time.Now().Add(time.Minute))
+	if len(standIn.requests) != 4 || !strings.Contains(standIn.requests[2].body, "primehub_job_completed 1\n") ||
+		standIn.requests[3].method != "DELETE" || standIn.requests[3].path != push.path {
+		t.Errorf("expected the final push retried then the delete, but got %+v", standIn.requests[1:])
+	}
+	t.Log("The last report is pushed as completed, then the group is deleted in the background")
+
+	t.Log("Give the agent started 1h before the first record left in the tiers")
+	body := string(PushgatewayExposition(report, time.Unix(base-3600, 0), true))
+	if !strings.Contains(body, "primehub_job_duration_seconds 3900\n") {
+		t.Errorf("expected the duration since the start of the agent, but got\n%s", body)
+	}
+	t.Log("The duration is counted from the start of the agent")
+}
+
+func TestPushgatewaySinkDeleteTimeout(t *testing.T) {
+	block := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "DELETE" {
+			<-block
+		}
+	}))
+	defer server.Close()
+	defer close(block)
+
+	t.Log("Give a pushgateway never answering the delete, with a delete timeout of 50ms")
+	sink := NewPushgatewaySink(server.URL, "job-a")
+	sink.DeleteAfter = time.Millisecond
+	sink.DeleteTimeout = 50 * time.Millisecond
+	if err := sink.Write(Monitoring{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	sink.WaitDelete(time.Now().Add(time.Minute))
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the delete given up after the timeout, but took %v", elapsed)
+	}
+	t.Log("The exit waits for the delete within the timeout")
+}
+
+func TestPushgatewaySinkDeleteAfterShutdown(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	t.Log("Give the delete delayed 1h and the agent to exit within 50ms")
+	sink := NewPushgatewaySink(server.URL, "job-a")
+	sink.DeleteAfter = time.Hour
+	if err := sink.Write(Monitoring{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	sink.WaitDelete(time.Now().Add(50 * time.Millisecond))
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the delete abandoned at the shutdown deadline, but took %v", elapsed)
+	}
+	t.Log("The exit is not held past the shutdown deadline")
+}
@@ -0,0 +1,203 @@
+package monitoring
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// Segment is a part of a query result served by one tier
+type Segment struct {
+	Tier     string   `json:"tier"`
+	Interval int      `json:"interval"`
+	Records  []Record `json:"records"`
+}
+
+// QueryResult holds the segments of a query ordered by time, from the coarsest tier to the finest one
+type QueryResult []Segment
+
+// Records returns the records of all segments ordered by time
+func (q QueryResult) Records() []Record {
+	records := make([]Record, 0)
+	for _, segment := range q {
+		records = append(records, segment.Records...)
+	}
+	return records
+}
+
+// Query returns the records with from <= Timestamp < to at the best available resolution.
+// The finest tier serves the range as far back as it holds, and the coarser tiers serve the older part,
+// so a range spanning several tiers is stitched without overlapping buckets.
+func (m *Metrics) Query(from int64, to int64) QueryResult {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	result := make(QueryResult, 0)
+	for _, p := range m.parts(from, to) {
+		if records := p.tier.Between(p.from, p.to); len(records) > 0 {
+			result = append(result, Segment{Tier: p.tier.Name, Interval: p.tier.Interval, Records: records})
+		}
+	}
+	return result
+}
+
+// QueryTier returns the records of the tier with from <= Timestamp < to, or nil if the tier is not found
+func (m *Metrics) QueryTier(name string, from int64, to int64) []Record {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	tier := m.Tier(name)
+	if tier == nil {
+		return nil
+	}
+	return tier.Between(from, to)
+}
+
+// NewMetricsFromMonitoring loads the tiers of a monitoring document to query it, the tiers are not aggregated further
+func NewMetricsFromMonitoring(report Monitoring) *Metrics {
+	m := new(Metrics)
+	m.Policies = DefaultAggregationPolicies()
+	m.Tiers = make([]*Buffer, 0, len(report.Tiers))
+	for _, spec := range report.Tiers {
+		records := report.Datasets[spec.Name]
+		size := spec.Capacity
+		if len(records) > size {
+			size = len(records)
+		}
+		if size < 1 || spec.Interval < 1 {
+			continue
+		}
+		tier := NewBuffer(spec.Interval, size)
+		tier.Name = spec.Name
+		tier.Compact = spec.Adaptive
+		tier.restoreRecords(records)
+		m.Tiers = append(m.Tiers, tier)
+	}
+	return m
+}
+
+// QueryMonitoring restricts the datasets of the document to from <= Timestamp < to
+func QueryMonitoring(report Monitoring, from int64, to int64) Monitoring {
+	metrics := NewMetricsFromMonitoring(report)
+	report.Datasets = make(Datasets, len(metrics.Tiers))
+	for _, tier := range metrics.Tiers {
+		report.Datasets[tier.Name] = metrics.QueryTier(tier.Name, from, to)
+	}
+	return report
+}
+
+// QueryHandler serves the result of Query as JSON, e.g., /query?from=1600000000&to=1600003600,
+// the range is in unix seconds and unbounded on the omitted side
+type QueryHandler struct {
+	Metrics *Metrics
+}
+
+func (h *QueryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	from, to, err := ParseQueryRange(r.URL.Query().Get("from"), r.URL.Query().Get("to"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	data, err := json.Marshal(h.Metrics.Query(from, to))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// ParseQueryRange parses the range of a query in unix seconds, an empty bound is unbounded
+func ParseQueryRange(from string, to string) (int64, int64, error) {
+	start, end := int64(math.MinInt64), int64(math.MaxInt64)
+	var err error
+	if from != "" {
+		if start, err = strconv.ParseInt(from, 10, 64); err != nil {
+			return 0, 0, err
+		}
+	}
+	if to != "" {
+		if end, err = strconv.ParseInt(to, 10, 64); err != nil {
+			return 0, 0, err
+		}
+	}
+	return start, end, nil
+}
+
+// Each calls fn with the records of Query ordered by time until fn returns false, without copying the tiers.
+// The metrics are locked for reading during the iteration, so fn must not add records.
+func (m *Metrics) Each(from int64, to int64, fn func(tier string, r Record) bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	m.each(from, to, func(tier *Buffer, r Record) bool {
+		return fn(tier.Name, r)
+	})
+}
+
+func (m *Metrics) each(from int64, to int64, fn func(tier *Buffer, r Record) bool) {
+	for _, p := range m.parts(from, to) {
+		stopped := false
+		p.tier.EachBetween(p.from, p.to, func(r Record) bool {
+			stopped = !fn(p.tier, r)
+			return !stopped
+		})
+		if stopped {
+			return
+		}
+	}
+}
+
+// queryPart is the range of a query served by a tier
+type queryPart struct {
+	tier     *Buffer
+	from, to int64
+}
+
+// parts splits the range of a query by the tiers serving it, ordered by time
+func (m *Metrics) parts(from int64, to int64) []queryPart {
+	// walk from the finest tier, each coarser tier serves the range before the cut of the finer one
+	parts := make([]queryPart, 0, len(m.Tiers))
+	upper := to
+	for i, tier := range m.Tiers {
+		oldest, ok := tier.Oldest()
+		if !ok {
+			continue
+		}
+		cut := from
+		if oldest.Timestamp > from && i+1 < len(m.Tiers) {
+			cut = cutOver(m.Tiers[i+1], oldest.Timestamp)
+		}
+		if cut < upper {
+			parts = append(parts, queryPart{tier: tier, from: cut, to: upper})
+			upper = cut
+		}
+		if cut <= from {
+			break
+		}
+	}
+
+	for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+		parts[i], parts[j] = parts[j], parts[i]
+	}
+	return parts
+}
+
+// cutOver returns the timestamp the finer tier takes over from the coarser one,
+// it is the end of the coarser bucket the oldest finer record falls in if the coarser tier has closed it,
+// so none of the buckets are served twice
+func cutOver(coarser *Buffer, oldest int64) int64 {
+	latest, ok := coarser.Latest()
+	if !ok {
+		return oldest
+	}
+	cut := alignTimestamp(oldest+int64(coarser.Interval)-1, coarser.Interval)
+	if end := latest.Timestamp + int64(coarser.Interval); end < cut {
+		cut = end
+	}
+	if cut < oldest {
+		cut = oldest
+	}
+	return cut
+}
@@ -0,0 +1,126 @@
+package monitoring
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestQueryStitchesTiers(t *testing.T) {
+	t.Log("Give a fine tier holding 1m and a coarse tier holding 10m, with samples every 10s for 5m")
+	metrics, _ := NewMetricsWithTiers([]TierConfig{
+		{Name: "fine", Resolution: 10 * time.Second, Retention: time.Minute},
+		{Name: "coarse", Resolution: 30 * time.Second, Retention: 10 * time.Minute},
+	})
+	base := int64(1000000020)
+	for i := int64(0); i < 30; i++ {
+		metrics.Add(Record{Timestamp: base + i*10, MemoryUsed: i})
+	}
+
+	result := metrics.Query(base, base+300)
+	if len(result) != 2 || result[0].Tier != "coarse" || result[1].Tier != "fine" {
+		t.Fatalf("expected the coarse and fine segments, but got %v", result)
+	}
+	if len(result[0].Records) != 8 || len(result[1].Records) != 6 || result[1].Records[0].Timestamp != base+240 {
+		t.Errorf("expected 8 coarse points before 1000000260 and 6 fine points, but got %v", result)
+	}
+	t.Log("The fine tier serves the last minute and the coarse tier serves the older part")
+
+	t.Log("Give the oldest fine point in the middle of a coarse bucket")
+	metrics.Add(Record{Timestamp: base + 300, MemoryUsed: 30})
+	records := metrics.Query(base, base+310).Records()
+	if len(records) != 13 || records[8].Timestamp != base+240 || records[9].Timestamp != base+270 {
+		t.Fatalf("expected 9 coarse points followed by 4 fine points from 1000000290, but got %v", records)
+	}
+	for i := 1; i < len(records); i++ {
+		if records[i].Timestamp <= records[i-1].Timestamp {
+			t.Errorf("the records should be ordered by time without overlapping, but got %v", records)
+		}
+	}
+	t.Log("The fine points start at the next coarse bucket")
+
+	if records := metrics.Query(base+280, base+300).Records(); len(records) != 2 || records[0].Timestamp != base+280 {
+		t.Errorf("expected 2 fine points, but got %v", records)
+	}
+	if result := metrics.Query(base, base+60); len(result) != 1 || result[0].Tier != "coarse" || len(result[0].Records) != 2 {
+		t.Errorf("expected 2 coarse points, but got %v", result)
+	}
+	if records := metrics.QueryTier("fine", 0, base+280); len(records) != 3 {
+		t.Errorf("expected 3 fine points, but got %v", records)
+	}
+	t.Log("The ranges inside a tier are served by the tier alone")
+}
+
+func TestMetricsEach(t *testing.T) {
+	metrics := newTestMetrics(100)
+	base := int64(1000000020)
+	for i := int64(0); i < 200; i++ {
+		metrics.Add(Record{Timestamp: base + i*10})
+	}
+
+	t.Log("Give an iteration stopped at the third record")
+	visited := make([]int64, 0)
+	metrics.Each(0, base+2000, func(tier string, r Record) bool {
+		visited = append(visited, r.Timestamp)
+		return len(visited) < 3
+	})
+	if len(visited) != 3 || visited[0] != base || visited[2] != base+60 {
+		t.Errorf("expected 3 lifetime points from 1000000020, but got %v", visited)
+	}
+
+	t.Log("Give a range before the first record")
+	count := 0
+	metrics.Tier("15m").EachBetween(0, base, func(r Record) bool {
+		count++
+		return true
+	})
+	if count != 0 {
+		t.Errorf("expected no record, but got %d", count)
+	}
+}
+
+func TestQueryHandler(t *testing.T) {
+	metrics := newTestMetrics(100)
+	base := int64(1000000020)
+	for i := int64(0); i < 10; i++ {
+		metrics.Add(Record{Timestamp: base + i*10})
+	}
+
+	t.Log("Give a query of the records from 1000000040 to 1000000070")
+	w := httptest.NewRecorder()
+	(&QueryHandler{Metrics: metrics}).ServeHTTP(w, httptest.NewRequest("GET", "/query?from=1000000040&to=1000000070", nil))
+	result := QueryResult{}
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if records := result.Records(); len(records) != 3 || records[0].Timestamp != base+20 {
+		t.Errorf("expected 3 records from 1000000040, but got %v", result)
+	}
+	t.Log("The records of the range are served as JSON")
+
+	w = httptest.NewRecorder()
+	(&QueryHandler{Metrics: metrics}).ServeHTTP(w, httptest.NewRequest("GET", "/query?from=yesterday", nil))
+	if w.Code != 400 {
+		t.Errorf("expected bad request, but got %d", w.Code)
+	}
+}
+
+func TestQueryMonitoring(t *testing.T) {
+	t.Log("Give a document of 10 records in the 15m tier")
+	metrics := newTestMetrics(100)
+	base := int64(1000000020)
+	for i := int64(0); i < 10; i++ {
+		metrics.Add(Record{Timestamp: base + i*10})
+	}
+	report := NewMonitoring(Spec{}, metrics.Snapshot())
+
+	report = QueryMonitoring(report, base+50, base+1000)
+	if records := report.Datasets["15m"]; len(records) != 5 || records[0].Timestamp != base+50 {
+		t.Errorf("expected 5 records from 1000000070, but got %v", records)
+	}
+	if len(report.Tiers) != 2 || len(report.Datasets) != 2 {
+		t.Errorf("expected the tiers kept, but got %v", report.Tiers)
+	}
+	t.Log("The datasets are restricted to the range")
+}
@@ -0,0 +1,74 @@
+package monitoring
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// legacyTiers are the tiers of the version 1 documents, which have no tier metadata
+var legacyTiers = []TierSpec{
+	{Name: "15m", Interval: 10, Capacity: 90, Retention: 900},
+	{Name: "1h", Interval: 30, Capacity: 120, Retention: 3600, Source: "15m"},
+	{Name: "3h", Interval: 120, Capacity: 90, Retention: 10800, Source: "15m"},
+	{Name: "lifetime", Interval: 300, Capacity: 8064, Retention: 2419200, Source: "15m"},
+}
+
+// ReadMonitoring decodes a Monitoring document of any version, in JSON or the binary encoding, and upgrades it to SchemaVersion
+func ReadMonitoring(data []byte) (Monitoring, error) {
+	report := Monitoring{}
+	if IsBinaryMonitoring(data) {
+		decoded, err := UnmarshalBinary(data)
+		if err != nil {
+			return report, err
+		}
+		report = decoded
+	} else if err := json.Unmarshal(data, &report); err != nil {
+		return report, err
+	}
+	if report.Version > SchemaVersion {
+		return report, fmt.Errorf("unsupported monitoring version %d, the latest known is %d", report.Version, SchemaVersion)
+	}
+	if report.Version < SchemaVersion {
+		upgradeMonitoring(&report)
+	}
+	return report, nil
+}
+
+func LoadMonitoring(path string) (Monitoring, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Monitoring{}, err
+	}
+	return ReadMonitoring(data)
+}
+
+// upgradeMonitoring fills the tier metadata and the scaled utilizations missing in the older documents
+func upgradeMonitoring(report *Monitoring) {
+	report.Version = SchemaVersion
+	if report.Datasets == nil {
+		report.Datasets = make(Datasets)
+	}
+
+	if len(report.Tiers) == 0 {
+		report.Tiers = make([]TierSpec, 0, len(legacyTiers))
+		for _, tier := range legacyTiers {
+			if records := report.Datasets[tier.Name]; len(records) > tier.Capacity {
+				// the lifetime tier might be kept longer by -lifetime-max
+				tier.Capacity = len(records)
+				tier.Retention = tier.Interval * tier.Capacity
+			}
+			report.Tiers = append(report.Tiers, tier)
+		}
+	}
+
+	for _, records := range report.Datasets {
+		for i := range records {
+			r := &records[i]
+			r.CpuMillicores = r.Millicores()
+			for g := range r.GPURecords {
+				r.GPURecords[g].GPUUtilizationMilli = r.GPURecords[g].UtilizationMilli()
+			}
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package monitoring
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+const legacyDocument = `{
+  "spec": {"mem_total": 1024, "GPU": [{"index": 0, "mem_total": 2048}]},
+  "datasets": {
+    "15m": [{"timestamp": 1000000020, "cpu_util": 150, "mem_used": 512, "GPU": [{"index": 0, "mem_used": 100, "gpu_util": 42}]}],
+    "1h": [],
+    "3h": null,
+    "lifetime": []
+  }
+}`
+
+func TestReadLegacyMonitoring(t *testing.T) {
+	t.Log("Give a document of the legacy layout without a version")
+	report, err := ReadMonitoring([]byte(legacyDocument))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Version != SchemaVersion || len(report.Tiers) != 4 || report.Tiers[3] != legacyTiers[3] {
+		t.Errorf("expected the legacy tiers of version %d, but got %+v", SchemaVersion, report)
+	}
+	r := report.Datasets["15m"][0]
+	if r.CpuMillicores != 1500 || r.GPURecords[0].GPUUtilizationMilli != 42000 {
+		t.Errorf("expected the scaled utilizations, but got %+v", r)
+	}
+	t.Log("The document is upgraded with the tier metadata and the scaled utilizations")
+
+	if _, err := ReadMonitoring([]byte(`{"version": 99}`)); err == nil {
+		t.Error("a newer version should not be read")
+	}
+}
+
+func TestToLegacy(t *testing.T) {
+	t.Log("Give tiers without the legacy names and a gap")
+	metrics, _ := NewMetricsWithTiers([]TierConfig{
+		{Name: "10s", Resolution: 10 * time.Second, Retention: 20 * time.Minute},
+		{Name: "1m", Resolution: time.Minute, Retention: 24 * time.Hour},
+	})
+	base := int64(1000000020)
+	for i := int64(0); i < 100; i++ {
+		if i == 50 {
+			metrics.AddGap(base + i*10)
+			continue
+		}
+		metrics.Add(Record{Timestamp: base + i*10, CpuUtilization: 50, GPURecords: newTestGPURecords(1, 42)})
+	}
+	report := NewMonitoring(Spec{MemoryTotal: 1024, GPUSpec: []GPUSpec{{Index: 0, UUID: "GPU-aaaa", MemoryTotal: 2048}}}, metrics.Snapshot())
+
+	data, err := MarshalLegacy(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := LegacyMonitoring{}
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(legacy.Datasets.FifteenMinutes); n != 89 {
+		t.Errorf("expected 15m served by the 10s tier without the gap, but got %d records", n)
+	}
+	if n := len(legacy.Datasets.OneHour); n != 16 {
+		t.Errorf("expected 1h served by the 1m tier, but got %d records", n)
+	}
+	if n := len(legacy.Datasets.LifeTime); n != 16 || legacy.Datasets.LifeTime[0].GPURecords[0].GPUUtilization != 42 {
+		t.Errorf("expected lifetime served by the 1m tier, but got %+v", legacy.Datasets.LifeTime)
+	}
+	if legacy.Spec.GPUSpec[0].MemoryTotal != 2048 {
+		t.Errorf("unexpected spec %+v", legacy.Spec)
+	}
+	t.Log("The legacy datasets are served by the tiers holding their windows")
+
+	t.Log("Give the legacy document read back")
+	upgraded, err := ReadMonitoring(data)
+	if err != nil || len(upgraded.Datasets["lifetime"]) != 16 || upgraded.Datasets["lifetime"][0].CpuMillicores != 500 {
+		t.Errorf("unexpected upgraded document %+v: %v", upgraded, err)
+	}
+}
+
+// walkSchema checks every key of the value is defined in the schema
+func walkSchema(t *testing.T, definitions map[string]interface{}, schema map[string]interface{}, value interface{}, path string) {
+	if ref, ok := schema["$ref"].(string); ok {
+		schema = definitions[ref[len("#/definitions/"):]].(map[string]interface{})
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		properties, _ := schema["properties"].(map[string]interface{})
+		additional, _ := schema["additionalProperties"].(map[string]interface{})
+		for key, child := range v {
+			childSchema, ok := properties[key].(map[string]interface{})
+			if !ok && additional == nil {
+				t.Errorf("%s.%s is not defined in the schema", path, key)
+				continue
+			}
+			if !ok {
+				childSchema = additional
+			}
+			walkSchema(t, definitions, childSchema, child, path+"."+key)
+		}
+		required, _ := schema["required"].([]interface{})
+		for _, key := range required {
+			if _, ok := v[key.(string)]; !ok {
+				t.Errorf("%s.%s is required by the schema", path, key)
+			}
+		}
+	case []interface{}:
+		items, _ := schema["items"].(map[string]interface{})
+		for _, child := range v {
+			walkSchema(t, definitions, items, child, path+"[]")
+		}
+	}
+}
+
+func TestJsonSchema(t *testing.T) {
+	data, err := ioutil.ReadFile("../schema/monitoring.schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := make(map[string]interface{})
+	if err := json.Unmarshal(data, &schema); err != nil {
+		t.Fatal(err)
+	}
+	version := schema["properties"].(map[string]interface{})["version"].(map[string]interface{})["const"]
+	if version != float64(SchemaVersion) {
+		t.Errorf("the schema should be version %d, but got %v", SchemaVersion, version)
+	}
+
+	t.Log("Give a document with every field set")
+	metrics := newTestMetrics(10)
+	metrics.Envelopes = true
+	metrics.Tiers[1].Compact = true
+	for i := int64(0); i < 10; i++ {
+		gpus := newTestGPURecords(1, 42)
+		metrics.Add(Record{Timestamp: 1000000020 + i*10, CpuUtilization: 50, CpuMillicores: 500, GPURecords: gpus})
+	}
+	metrics.AddGap(1000000120)
+	report := NewMonitoring(Spec{MemoryTotal: 1024, GPUSpec: []GPUSpec{{
+		Index: 0, UUID: "MIG-aaaa", MemoryTotal: 2048, MIG: true, ParentUUID: "GPU-aaaa", MigInstance: "1/0", UtilizationUnsupported: true,
+	}}}, metrics.Snapshot())
+
+	document := make(map[string]interface{})
+	data, _ = json.Marshal(report)
+	json.Unmarshal(data, &document)
+	walkSchema(t, schema["definitions"].(map[string]interface{}), schema, document, "$")
+	t.Log("Every field of the document is defined in the schema")
+}
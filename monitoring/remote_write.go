@@ -0,0 +1,352 @@
+package monitoring
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultRemoteWriteBatchSize     = 100
+	DefaultRemoteWriteBatchDeadline = 15 * time.Second
+	DefaultRemoteWriteQueueSize     = 1000
+	DefaultRemoteWriteRetries       = 3
+	DefaultRemoteWriteBackoff       = time.Second
+	DefaultRemoteWriteTimeout       = 30 * time.Second
+	DefaultRemoteWriteCloseTimeout  = 10 * time.Second
+)
+
+// RemoteWriter pushes the records to a Prometheus remote_write endpoint, e.g., for the short-lived jobs scraped
+// unreliably. The records are queued and sent in batches of BatchSize, or once BatchDeadline passes since the last
+// send, as the series of Exporter with the ExternalLabels attached. A batch failed by a network error, 429 or 5xx
+// is retried Retries times with an exponential backoff, and the oldest records are dropped when the queue of
+// QueueSize is full while the endpoint is down. Close gives up the records not sent within CloseTimeout, so a down
+// endpoint doesn't hold the agent from exiting. The fields are read by Start.
+type RemoteWriter struct {
+	sent, failed, dropped int64
+
+	URL            string
+	Spec           Spec
+	ExternalLabels map[string]string
+	BatchSize      int
+	BatchDeadline  time.Duration
+	QueueSize      int
+	Retries        int
+	Backoff        time.Duration
+	Timeout        time.Duration
+	CloseTimeout   time.Duration
+
+	client *http.Client
+	queue  chan Record
+	done   chan struct{}
+
+	// cancels the requests and the backoff once CloseTimeout passes
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// guards closing the queue
+	mutex  sync.Mutex
+	closed bool
+}
+
+func NewRemoteWriter(url string, spec Spec) *RemoteWriter {
+	return &RemoteWriter{
+		URL:           url,
+		Spec:          spec,
+		BatchSize:     DefaultRemoteWriteBatchSize,
+		BatchDeadline: DefaultRemoteWriteBatchDeadline,
+		QueueSize:     DefaultRemoteWriteQueueSize,
+		Retries:       DefaultRemoteWriteRetries,
+		Backoff:       DefaultRemoteWriteBackoff,
+		Timeout:       DefaultRemoteWriteTimeout,
+		CloseTimeout:  DefaultRemoteWriteCloseTimeout,
+	}
+}
+
+func (w *RemoteWriter) Start() {
+	w.client = &http.Client{Timeout: w.Timeout}
+	w.queue = make(chan Record, w.QueueSize)
+	w.done = make(chan struct{})
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+	go w.run()
+}
+
+// Append queues the record without blocking, the oldest queued record is dropped if the queue is full
+func (w *RemoteWriter) Append(record Record) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.closed || w.queue == nil {
+		return
+	}
+	for {
+		select {
+		case w.queue <- record:
+			return
+		default:
+		}
+		select {
+		case <-w.queue:
+			atomic.AddInt64(&w.dropped, 1)
+		default:
+		}
+	}
+}
+
+// Close sends the queued records and waits for the last batch within CloseTimeout,
+// then the records not sent yet are counted as failed
+func (w *RemoteWriter) Close() {
+	w.mutex.Lock()
+	if w.closed || w.queue == nil {
+		w.mutex.Unlock()
+		return
+	}
+	w.closed = true
+	close(w.queue)
+	w.mutex.Unlock()
+
+	timer := time.NewTimer(w.CloseTimeout)
+	defer timer.Stop()
+	select {
+	case <-w.done:
+	case <-timer.C:
+		log.Warnf("Give up the remote write of the queued records to %s after %v", w.URL, w.CloseTimeout)
+		w.cancel()
+		<-w.done
+	}
+	w.cancel()
+}
+
+// Sent returns the number of records accepted by the endpoint
+func (w *RemoteWriter) Sent() int64 {
+	return atomic.LoadInt64(&w.sent)
+}
+
+// Failed returns the number of records given up after the retries
+func (w *RemoteWriter) Failed() int64 {
+	return atomic.LoadInt64(&w.failed)
+}
+
+// Dropped returns the number of records dropped from the full queue
+func (w *RemoteWriter) Dropped() int64 {
+	return atomic.LoadInt64(&w.dropped)
+}
+
+func (w *RemoteWriter) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.BatchDeadline)
+	defer ticker.Stop()
+
+	batch := make([]Record, 0, w.BatchSize)
+	for {
+		select {
+		case record, ok := <-w.queue:
+			if !ok {
+				if len(batch) > 0 {
+					w.send(batch)
+				}
+				return
+			}
+			batch = append(batch, record)
+			if len(batch) < w.BatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		w.send(batch)
+		batch = make([]Record, 0, w.BatchSize)
+	}
+}
+
+func (w *RemoteWriter) send(batch []Record) {
+	body := snappyEncode(w.encode(batch))
+	backoff := w.Backoff
+	for attempt := 0; ; attempt++ {
+		retryable, err := w.post(body)
+		if err == nil {
+			atomic.AddInt64(&w.sent, int64(len(batch)))
+			return
+		}
+		if !retryable || attempt >= w.Retries || w.ctx.Err() != nil {
+			atomic.AddInt64(&w.failed, int64(len(batch)))
+			log.Warnf("Cannot remote write %d records to %s: %v", len(batch), w.URL, err)
+			return
+		}
+		log.Debugf("Retry remote write to %s in %v: %v", w.URL, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-w.ctx.Done():
+		}
+		backoff *= 2
+	}
+}
+
+// post returns whether the failure is worth a retry, the endpoint rejects a bad request by 4xx for good
+func (w *RemoteWriter) post(body []byte) (bool, error) {
+	request, err := http.NewRequest("POST", w.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	request = request.WithContext(w.ctx)
+	request.Header.Set("Content-Encoding", "snappy")
+	request.Header.Set("Content-Type", "application/x-protobuf")
+	request.Header.Set("User-Agent", "primehub-monitoring-agent/"+GetBuildInfo().Version)
+	request.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	response, err := w.client.Do(request)
+	if err != nil {
+		return true, err
+	}
+	defer response.Body.Close()
+	message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 512))
+	if response.StatusCode/100 == 2 {
+		return false, nil
+	}
+	err = fmt.Errorf("%s: %s", response.Status, strings.TrimSpace(string(message)))
+	return response.StatusCode == http.StatusTooManyRequests || response.StatusCode/100 == 5, err
+}
+
+var labelNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// ParseLabels parses the labels like cluster=a,team=b
+func ParseLabels(value string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid label %q, should be like %q", pair, "cluster=a")
+		}
+		name := strings.TrimSpace(kv[0])
+		if !labelNamePattern.MatchString(name) || strings.HasPrefix(name, "__") {
+			return nil, fmt.Errorf("invalid label name %q", name)
+		}
+		labels[name] = strings.TrimSpace(kv[1])
+	}
+	return labels, nil
+}
+
+type remoteLabel struct {
+	name, value string
+}
+
+type remoteSeries struct {
+	labels     []remoteLabel
+	values     []float64
+	timestamps []int64
+}
+
+// encode returns the WriteRequest of the batch, each series holds its samples of the batch ordered by time
+func (w *RemoteWriter) encode(batch []Record) []byte {
+	series := make([]*remoteSeries, 0)
+	index := make(map[string]*remoteSeries)
+	for _, record := range batch {
+		families := append(specFamilies(w.Spec), recordFamilies(record, w.Spec)...)
+		for _, family := range families {
+			for _, sample := range family.samples {
+				labels := w.labels(sample)
+				key := labelsKey(labels)
+				s, ok := index[key]
+				if !ok {
+					s = &remoteSeries{labels: labels}
+					index[key] = s
+					series = append(series, s)
+				}
+				s.values = append(s.values, sample.value)
+				s.timestamps = append(s.timestamps, record.Timestamp*1000)
+			}
+		}
+	}
+
+	// message WriteRequest { repeated TimeSeries timeseries = 1; }
+	// message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+	// message Label { string name = 1; string value = 2; }
+	// message Sample { double value = 1; int64 timestamp = 2; }
+	request := make([]byte, 0, 4096)
+	var message, field []byte
+	for _, s := range series {
+		message = message[:0]
+		for _, label := range s.labels {
+			field = appendProtoString(field[:0], 1, label.name)
+			field = appendProtoString(field, 2, label.value)
+			message = appendProtoBytes(message, 1, field)
+		}
+		for i, value := range s.values {
+			field = appendUvarint(field[:0], 1<<3|1)
+			field = appendFixed64(field, math.Float64bits(value))
+			field = appendUvarint(field, 2<<3|0)
+			field = appendUvarint(field, uint64(s.timestamps[i]))
+			message = appendProtoBytes(message, 2, field)
+		}
+		request = appendProtoBytes(request, 1, message)
+	}
+	return request
+}
+
+// labels returns the labels of the sample sorted by name, the external labels don't override the sample labels
+func (w *RemoteWriter) labels(sample metricSample) []remoteLabel {
+	labels := make([]remoteLabel, 0, 1+len(sample.labels)/2+len(w.ExternalLabels))
+	labels = append(labels, remoteLabel{"__name__", sample.name})
+	seen := make(map[string]bool, len(sample.labels)/2)
+	for i := 0; i+1 < len(sample.labels); i += 2 {
+		labels = append(labels, remoteLabel{sample.labels[i], sample.labels[i+1]})
+		seen[sample.labels[i]] = true
+	}
+	for name, value := range w.ExternalLabels {
+		if !seen[name] {
+			labels = append(labels, remoteLabel{name, value})
+		}
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].name < labels[j].name
+	})
+	return labels
+}
+
+func labelsKey(labels []remoteLabel) string {
+	var key strings.Builder
+	for _, label := range labels {
+		key.WriteString(label.name)
+		key.WriteByte(0xff)
+		key.WriteString(label.value)
+		key.WriteByte(0xff)
+	}
+	return key.String()
+}
+
+func appendProtoBytes(buf []byte, field int, data []byte) []byte {
+	buf = appendUvarint(buf, uint64(field<<3|2))
+	buf = appendUvarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+func appendProtoString(buf []byte, field int, value string) []byte {
+	buf = appendUvarint(buf, uint64(field<<3|2))
+	buf = appendUvarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
+
+func appendFixed64(buf []byte, v uint64) []byte {
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], v)
+	return append(buf, tmp[:]...)
+}
@@ -0,0 +1,280 @@
+package monitoring
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type writtenSeries struct {
+	labels     map[string]string
+	names      []string
+	values     []float64
+	timestamps []int64
+}
+
+// decodeProtoFields splits a protobuf message into the fields, only the wire types of WriteRequest are known
+func decodeProtoFields(data []byte, fn func(field int, wire int, value uint64, bytes []byte)) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errors.New("bad key")
+		}
+		data = data[n:]
+		field, wire := int(key>>3), int(key&7)
+		switch wire {
+		case 0:
+			value, n := binary.Uvarint(data)
+			if n <= 0 {
+				return errors.New("bad varint")
+			}
+			data = data[n:]
+			fn(field, wire, value, nil)
+		case 1:
+			if len(data) < 8 {
+				return errors.New("bad fixed64")
+			}
+			fn(field, wire, binary.LittleEndian.Uint64(data), nil)
+			data = data[8:]
+		case 2:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return errors.New("bad length")
+			}
+			fn(field, wire, 0, data[n:n+int(length)])
+			data = data[n+int(length):]
+		default:
+			return errors.New("unknown wire type")
+		}
+	}
+	return nil
+}
+
+func decodeWriteRequest(data []byte) ([]writtenSeries, error) {
+	series := make([]writtenSeries, 0)
+	err := decodeProtoFields(data, func(field int, wire int, value uint64, message []byte) {
+		s := writtenSeries{labels: make(map[string]string)}
+		decodeProtoFields(message, func(field int, wire int, value uint64, bytes []byte) {
+			if field == 1 {
+				var name, labelValue string
+				decodeProtoFields(bytes, func(field int, wire int, value uint64, bytes []byte) {
+					if field == 1 {
+						name = string(bytes)
+					} else {
+						labelValue = string(bytes)
+					}
+				})
+				s.labels[name] = labelValue
+				s.names = append(s.names, name)
+				return
+			}
+			decodeProtoFields(bytes, func(field int, wire int, value uint64, bytes []byte) {
+				if field == 1 {
+					s.values = append(s.values, math.Float64frombits(value))
+				} else {
+					s.timestamps = append(s.timestamps, int64(value))
+				}
+			})
+		})
+		series = append(series, s)
+	})
+	return series, err
+}
+
+// remoteWriteStandIn decodes the requests, and answers the queued status codes before 204
+type remoteWriteStandIn struct {
+	mutex    sync.Mutex
+	requests [][]writtenSeries
+	statuses []int
+	attempts int
+	block    chan struct{}
+}
+
+func (s *remoteWriteStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.block != nil {
+		<-s.block
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.attempts++
+	if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("Content-Type") != "application/x-protobuf" ||
+		r.Header.Get("X-Prometheus-Remote-Write-Version") != "0.1.0" {
+		http.Error(w, "bad headers", http.StatusBadRequest)
+		return
+	}
+	if len(s.statuses) > 0 {
+		status := s.statuses[0]
+		s.statuses = s.statuses[1:]
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	compressed, _ := ioutil.ReadAll(r.Body)
+	data, err := snappyDecode(compressed)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	series, err := decodeWriteRequest(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.requests = append(s.requests, series)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func findSeries(series []writtenSeries, name string, index string) *writtenSeries {
+	for i := range series {
+		if series[i].labels["__name__"] == name && series[i].labels["index"] == index {
+			return &series[i]
+		}
+	}
+	return nil
+}
+
+func TestRemoteWriter(t *testing.T) {
+	standIn := &remoteWriteStandIn{}
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+
+	t.Log("Give 7 records with a GPU in batches of 3, and the external labels")
+	writer := NewRemoteWriter(server.URL, Spec{MemoryTotal: 4 << 30, GPUSpec: []GPUSpec{{Index: 0, UUID: "GPU-0", MemoryTotal: 16 << 30}}})
+	writer.ExternalLabels = map[string]string{"phjob_name": "job-a", "index": "ignored"}
+	writer.BatchSize = 3
+	writer.BatchDeadline = time.Hour
+	writer.Start()
+	for i := int64(0); i < 7; i++ {
+		writer.Append(Record{
+			Timestamp:     1000000000 + i*10,
+			CpuMillicores: 1000 + i,
+			MemoryUsed:    1 << 30,
+			GPURecords:    []GPURecord{{Index: 0, GPUUtilizationMilli: 42500}},
+		})
+	}
+	writer.Close()
+
+	if len(standIn.requests) != 3 || writer.Sent() != 7 || writer.Failed() != 0 || writer.Dropped() != 0 {
+		t.Fatalf("expected 3 requests of 7 records, but got %d requests, sent %d", len(standIn.requests), writer.Sent())
+	}
+	cpu := findSeries(standIn.requests[0], "primehub_job_cpu_usage_cores", "ignored")
+	if cpu == nil || len(cpu.values) != 3 || cpu.values[2] != 1.002 || cpu.timestamps[2] != 1000000020000 {
+		t.Fatalf("expected 3 cpu samples in the first batch, but got %+v", cpu)
+	}
+	if cpu.labels["phjob_name"] != "job-a" || len(cpu.names) != 3 || cpu.names[0] != "__name__" || cpu.names[2] != "phjob_name" {
+		t.Errorf("expected the external labels sorted by name, but got %v", cpu.names)
+	}
+	gpu := findSeries(standIn.requests[2], "primehub_job_gpu_utilization_percent", "0")
+	if gpu == nil || gpu.labels["uuid"] != "GPU-0" || len(gpu.values) != 1 || gpu.values[0] != 42.5 {
+		t.Errorf("expected the gpu utilization with its own index label, but got %+v", gpu)
+	}
+	limit := findSeries(standIn.requests[1], "primehub_job_memory_limit_bytes", "ignored")
+	if limit == nil || limit.values[0] != 4<<30 {
+		t.Errorf("expected the memory limit sent with the samples, but got %+v", limit)
+	}
+	t.Log("The records are sent in batches as the series of the exporter")
+}
+
+func TestRemoteWriterRetry(t *testing.T) {
+	standIn := &remoteWriteStandIn{statuses: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusBadRequest}}
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+
+	t.Log("Give an endpoint answering 503, 429, then 400 for the first batch")
+	writer := NewRemoteWriter(server.URL, Spec{})
+	writer.BatchSize = 1
+	writer.Backoff = time.Millisecond
+	writer.Start()
+	writer.Append(Record{Timestamp: 1000000000})
+	writer.Append(Record{Timestamp: 1000000010})
+	writer.Close()
+
+	if standIn.attempts != 4 || writer.Failed() != 1 || writer.Sent() != 1 || len(standIn.requests) != 1 {
+		t.Errorf("expected 503 and 429 retried and 400 given up, but got %d attempts, failed %d, sent %d",
+			standIn.attempts, writer.Failed(), writer.Sent())
+	}
+	t.Log("The batch is retried on 5xx and 429, and given up on 4xx")
+
+	t.Log("Give an endpoint always answering 500")
+	standIn.statuses = []int{500, 500, 500, 500, 500}
+	standIn.attempts = 0
+	writer = NewRemoteWriter(server.URL, Spec{})
+	writer.Retries = 2
+	writer.Backoff = time.Millisecond
+	writer.Start()
+	writer.Append(Record{Timestamp: 1000000000})
+	writer.Close()
+	if standIn.attempts != 3 || writer.Failed() != 1 {
+		t.Errorf("expected 3 attempts, but got %d", standIn.attempts)
+	}
+	t.Log("The batch is given up after the retries")
+}
+
+func TestRemoteWriterQueue(t *testing.T) {
+	standIn := &remoteWriteStandIn{block: make(chan struct{})}
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+
+	t.Log("Give an endpoint blocked while 10 records are appended to a queue of 2")
+	writer := NewRemoteWriter(server.URL, Spec{})
+	writer.BatchSize = 1
+	writer.QueueSize = 2
+	writer.Start()
+	for i := int64(0); i < 10; i++ {
+		writer.Append(Record{Timestamp: 1000000000 + i*10})
+	}
+	close(standIn.block)
+	writer.Close()
+
+	if writer.Dropped() == 0 || writer.Sent()+writer.Dropped() != 10 {
+		t.Fatalf("expected the records sent or dropped, but got sent %d, dropped %d", writer.Sent(), writer.Dropped())
+	}
+	last := standIn.requests[len(standIn.requests)-1]
+	if s := findSeries(last, "primehub_job_last_sample_timestamp_seconds", ""); s == nil || s.values[0] != 1000000090 {
+		t.Errorf("expected the latest record kept, but got %+v", s)
+	}
+	t.Log("The oldest records are dropped when the queue is full")
+}
+
+func TestRemoteWriterCloseTimeout(t *testing.T) {
+	standIn := &remoteWriteStandIn{block: make(chan struct{})}
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+	defer close(standIn.block)
+
+	t.Log("Give an endpoint never answering while 3 records are queued, and a close timeout of 50ms")
+	writer := NewRemoteWriter(server.URL, Spec{})
+	writer.BatchSize = 1
+	writer.CloseTimeout = 50 * time.Millisecond
+	writer.Start()
+	for i := int64(0); i < 3; i++ {
+		writer.Append(Record{Timestamp: 1000000000 + i*10})
+	}
+
+	start := time.Now()
+	writer.Close()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected Close given up after the timeout, but took %v", elapsed)
+	}
+	if writer.Sent() != 0 || writer.Failed() != 3 {
+		t.Errorf("expected the records not sent counted as failed, but got sent %d, failed %d", writer.Sent(), writer.Failed())
+	}
+	t.Log("Close gives up the records not sent within the timeout")
+}
+
+func TestParseLabels(t *testing.T) {
+	labels, err := ParseLabels(" cluster=a, team = b ,")
+	if err != nil || len(labels) != 2 || labels["cluster"] != "a" || labels["team"] != "b" {
+		t.Errorf("expected cluster=a and team=b, but got %v, %v", labels, err)
+	}
+	for _, value := range []string{"cluster", "1st=a", "__name__=a", "a-b=c"} {
+		if _, err := ParseLabels(value); err == nil {
+			t.Errorf("expected an error of %q", value)
+		}
+	}
+}
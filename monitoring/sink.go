@@ -0,0 +1,129 @@
+package monitoring
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Sink writes the reports of the metrics, e.g., the monitoring file
+type Sink interface {
+	Name() string
+	Write(report Monitoring) error
+	Close() error
+}
+
+// SinkStats counts the writes of a sink in the pipeline
+type SinkStats struct {
+	Writes int64
+	Errors int64
+
+	// the reports replaced by a newer one before the sink could write them
+	Dropped int64
+
+	// the failed attempts including the retried ones, for the sinks retrying a write like FileSink
+	FailedAttempts int64
+
+	LastError   string
+	LastSuccess time.Time
+}
+
+// SinkPipeline runs the sinks in parallel, each sink writes the latest report published
+// so a slow sink neither blocks the sampling nor the other sinks
+type SinkPipeline struct {
+	workers []*sinkWorker
+	wg      sync.WaitGroup
+}
+
+type sinkWorker struct {
+	sink    Sink
+	reports chan Monitoring
+
+	mutex sync.Mutex
+	stats SinkStats
+}
+
+func NewSinkPipeline(sinks ...Sink) *SinkPipeline {
+	p := new(SinkPipeline)
+	for _, sink := range sinks {
+		w := &sinkWorker{sink: sink, reports: make(chan Monitoring, 1)}
+		p.workers = append(p.workers, w)
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			w.run()
+		}()
+	}
+	return p
+}
+
+// Publish hands the report to every sink without waiting for the writes,
+// a report still waiting for a busy sink is replaced by the new one
+func (p *SinkPipeline) Publish(report Monitoring) {
+	for _, w := range p.workers {
+		select {
+		case w.reports <- report:
+			continue
+		default:
+		}
+
+		select {
+		case <-w.reports:
+			w.mutex.Lock()
+			w.stats.Dropped++
+			w.mutex.Unlock()
+		default:
+		}
+		w.reports <- report
+	}
+}
+
+// Close writes the reports already published, then closes the sinks
+func (p *SinkPipeline) Close() {
+	for _, w := range p.workers {
+		close(w.reports)
+	}
+	p.wg.Wait()
+	for _, w := range p.workers {
+		if err := w.sink.Close(); err != nil {
+			log.Warnf("Cannot close sink %s: %v", w.sink.Name(), err)
+		}
+	}
+}
+
+// Stats returns the counters by sink name
+func (p *SinkPipeline) Stats() map[string]SinkStats {
+	stats := make(map[string]SinkStats, len(p.workers))
+	for _, w := range p.workers {
+		w.mutex.Lock()
+		s := w.stats
+		w.mutex.Unlock()
+		if retrying, ok := w.sink.(interface{ Failures() int64 }); ok {
+			s.FailedAttempts = retrying.Failures()
+		}
+		stats[w.sink.Name()] = s
+	}
+	return stats
+}
+
+func (w *sinkWorker) run() {
+	for report := range w.reports {
+		err := w.sink.Write(report)
+
+		w.mutex.Lock()
+		w.stats.Writes++
+		if err != nil {
+			w.stats.Errors++
+			w.stats.LastError = err.Error()
+		} else {
+			w.stats.LastSuccess = time.Now()
+		}
+		errors := w.stats.Errors
+		w.mutex.Unlock()
+
+		if err != nil {
+			log.Errorf("Sink %s cannot write the report (%d errors): %v", w.sink.Name(), errors, err)
+		}
+	}
+}
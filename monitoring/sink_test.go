@@ -0,0 +1,114 @@
+package monitoring
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestFileSinkFallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	t.Log("Give a primary path in a missing directory and a fallback path")
+	primary := filepath.Join(dir, "phfs", "monitoring")
+	fallback := filepath.Join(dir, "monitoring")
+	sink := NewFileSink(primary, fallback)
+	sink.Backoff = 0
+
+	report := Monitoring{Spec: Spec{MemoryTotal: 100}, Datasets: Datasets{}}
+	if err := sink.Write(report); err != nil {
+		t.Fatal(err)
+	}
+	if sink.Current() != fallback || sink.Failures() != 3 {
+		t.Errorf("expected the fallback written after 3 attempts, but got %s after %d failures", sink.Current(), sink.Failures())
+	}
+	written := Monitoring{}
+	data, _ := ioutil.ReadFile(fallback)
+	if err := json.Unmarshal(data, &written); err != nil || written.Spec.MemoryTotal != 100 {
+		t.Errorf("unexpected fallback file %s: %v", data, err)
+	}
+	t.Log("The report is written to the fallback after the retries")
+
+	if err := sink.Write(report); err != nil || sink.Failures() != 4 {
+		t.Errorf("expected the primary tried once, but got %d failures: %v", sink.Failures(), err)
+	}
+	t.Log("The primary is tried once while on the fallback")
+
+	t.Log("Give the primary directory recovered")
+	os.MkdirAll(filepath.Dir(primary), 0755)
+	if err := sink.Write(report); err != nil || sink.Current() != primary {
+		t.Errorf("expected to move back to the primary, but got %s: %v", sink.Current(), err)
+	}
+	files, _ := ioutil.ReadDir(filepath.Dir(primary))
+	if len(files) != 1 || files[0].Name() != "monitoring" {
+		t.Errorf("expected no temp file left, but got %v", files)
+	}
+	t.Log("The sink moves back to the primary")
+
+	t.Log("Give no writable path")
+	sink = NewFileSink(filepath.Join(dir, "missing", "monitoring"))
+	sink.Backoff = 0
+	if err := sink.Write(report); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+type recordingSink struct {
+	name    string
+	err     error
+	mutex   sync.Mutex
+	reports []Monitoring
+	closed  bool
+}
+
+func (s *recordingSink) Name() string {
+	return s.name
+}
+
+func (s *recordingSink) Write(report Monitoring) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.reports = append(s.reports, report)
+	return s.err
+}
+
+func (s *recordingSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestSinkPipeline(t *testing.T) {
+	t.Log("Give a working sink and a failing sink")
+	working := &recordingSink{name: "working"}
+	failing := &recordingSink{name: "failing", err: errors.New("disk full")}
+	pipeline := NewSinkPipeline(working, failing)
+
+	for i := int64(1); i <= 3; i++ {
+		pipeline.Publish(Monitoring{Spec: Spec{MemoryTotal: i}})
+	}
+	pipeline.Close()
+
+	for _, sink := range []*recordingSink{working, failing} {
+		if len(sink.reports) == 0 || sink.reports[len(sink.reports)-1].Spec.MemoryTotal != 3 || !sink.closed {
+			t.Errorf("sink %s should write the last report before closed, but got %v", sink.name, sink.reports)
+		}
+	}
+	t.Log("Both sinks write the last report on Close")
+
+	stats := pipeline.Stats()
+	if s := stats["working"]; s.Errors != 0 || s.Writes+s.Dropped != 3 {
+		t.Errorf("unexpected stats of working %+v", s)
+	}
+	if s := stats["failing"]; s.Errors != s.Writes || s.LastError != "disk full" {
+		t.Errorf("unexpected stats of failing %+v", s)
+	}
+	t.Log("The errors are counted by sink")
+}
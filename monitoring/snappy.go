@@ -0,0 +1,160 @@
+package monitoring
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// The snappy block format required by the remote_write protocol, see
+// https://github.com/google/snappy/blob/main/format_description.txt.
+// The encoder finds the repeats of 4 bytes within a window of 64KB by a hash table, which is enough for the
+// label names and values repeated in every series.
+
+const (
+	snappyTagLiteral = 0x00
+	snappyTagCopy1   = 0x01
+	snappyTagCopy2   = 0x02
+	snappyTagCopy4   = 0x03
+
+	snappyMaxOffset = 1 << 16
+	snappyTableBits = 14
+)
+
+var errSnappyCorrupt = errors.New("corrupt snappy block")
+
+func snappyEncode(src []byte) []byte {
+	dst := appendUvarint(make([]byte, 0, len(src)/2+16), uint64(len(src)))
+	if len(src) < 4 {
+		return appendSnappyLiteral(dst, src)
+	}
+
+	var table [1 << snappyTableBits]int32
+	hash := func(u uint32) uint32 {
+		return (u * 0x1e35a7bd) >> (32 - snappyTableBits)
+	}
+
+	literal := 0
+	for i := 0; i+4 <= len(src); {
+		u := binary.LittleEndian.Uint32(src[i:])
+		h := hash(u)
+		// the table holds the position + 1, 0 for empty
+		candidate := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if candidate < 0 || i-candidate >= snappyMaxOffset || binary.LittleEndian.Uint32(src[candidate:]) != u {
+			i++
+			continue
+		}
+
+		dst = appendSnappyLiteral(dst, src[literal:i])
+		length := 4
+		for i+length < len(src) && src[candidate+length] == src[i+length] {
+			length++
+		}
+		dst = appendSnappyCopy(dst, i-candidate, length)
+		i += length
+		literal = i
+	}
+	return appendSnappyLiteral(dst, src[literal:])
+}
+
+func appendSnappyLiteral(dst []byte, literal []byte) []byte {
+	n := len(literal)
+	if n == 0 {
+		return dst
+	}
+	switch {
+	case n <= 60:
+		dst = append(dst, byte(n-1)<<2|snappyTagLiteral)
+	case n <= 1<<8:
+		dst = append(dst, 60<<2|snappyTagLiteral, byte(n-1))
+	case n <= 1<<16:
+		dst = append(dst, 61<<2|snappyTagLiteral, byte(n-1), byte((n-1)>>8))
+	case n <= 1<<24:
+		dst = append(dst, 62<<2|snappyTagLiteral, byte(n-1), byte((n-1)>>8), byte((n-1)>>16))
+	default:
+		dst = append(dst, 63<<2|snappyTagLiteral, byte(n-1), byte((n-1)>>8), byte((n-1)>>16), byte((n-1)>>24))
+	}
+	return append(dst, literal...)
+}
+
+// appendSnappyCopy writes the copies of at most 64 bytes each with a 2-byte offset
+func appendSnappyCopy(dst []byte, offset int, length int) []byte {
+	for length > 0 {
+		n := length
+		if n > 64 {
+			n = 64
+		}
+		dst = append(dst, byte(n-1)<<2|snappyTagCopy2, byte(offset), byte(offset>>8))
+		length -= n
+	}
+	return dst
+}
+
+func snappyDecode(src []byte) ([]byte, error) {
+	length, n := binary.Uvarint(src)
+	if n <= 0 || length > uint64(len(src))*64 {
+		return nil, errSnappyCorrupt
+	}
+	src = src[n:]
+	dst := make([]byte, 0, length)
+
+	for len(src) > 0 {
+		tag := src[0]
+		var offset, size int
+		switch tag & 0x03 {
+		case snappyTagLiteral:
+			size = int(tag >> 2)
+			src = src[1:]
+			if size >= 60 {
+				extra := size - 59
+				if len(src) < extra {
+					return nil, errSnappyCorrupt
+				}
+				size = 0
+				for i := extra - 1; i >= 0; i-- {
+					size = size<<8 | int(src[i])
+				}
+				src = src[extra:]
+			}
+			size++
+			if size > len(src) || uint64(len(dst)+size) > length {
+				return nil, errSnappyCorrupt
+			}
+			dst = append(dst, src[:size]...)
+			src = src[size:]
+			continue
+		case snappyTagCopy1:
+			if len(src) < 2 {
+				return nil, errSnappyCorrupt
+			}
+			size = 4 + int(tag>>2&0x07)
+			offset = int(tag&0xe0)<<3 | int(src[1])
+			src = src[2:]
+		case snappyTagCopy2:
+			if len(src) < 3 {
+				return nil, errSnappyCorrupt
+			}
+			size = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[1:]))
+			src = src[3:]
+		case snappyTagCopy4:
+			if len(src) < 5 {
+				return nil, errSnappyCorrupt
+			}
+			size = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[1:]))
+			src = src[5:]
+		}
+		if offset <= 0 || offset > len(dst) || uint64(len(dst)+size) > length {
+			return nil, errSnappyCorrupt
+		}
+		// the copy may overlap the bytes it writes, e.g., a run of a byte
+		for i := 0; i < size; i++ {
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+	if uint64(len(dst)) != length {
+		return nil, errSnappyCorrupt
+	}
+	return dst, nil
+}
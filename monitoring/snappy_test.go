@@ -0,0 +1,53 @@
+package monitoring
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestSnappy(t *testing.T) {
+	t.Log("Give empty, short, repeated, random and long inputs")
+	random := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(random)
+	inputs := [][]byte{
+		{},
+		[]byte("abc"),
+		bytes.Repeat([]byte("a"), 1000),
+		bytes.Repeat([]byte(`primehub_job_gpu_memory_used_bytes{index="0"}`), 3000),
+		random,
+		append(append([]byte{}, random[:70000]...), random[:70000]...),
+	}
+	for i, input := range inputs {
+		encoded := snappyEncode(input)
+		decoded, err := snappyDecode(encoded)
+		if err != nil || !bytes.Equal(input, decoded) {
+			t.Fatalf("input %d: expected the same bytes, but got %d bytes and %v", i, len(decoded), err)
+		}
+	}
+	if encoded := snappyEncode(inputs[3]); len(encoded)*20 > len(inputs[3]) {
+		t.Errorf("expected the repeats compressed, but got %d bytes of %d", len(encoded), len(inputs[3]))
+	}
+	t.Log("The inputs are decoded as they were")
+
+	t.Log("Give a block encoded by github.com/golang/snappy and a block with a 1-byte offset copy")
+	// snappy.Encode(nil, bytes.Repeat([]byte("abcdefgh"), 40))
+	reference := []byte{0xc0, 0x2, 0x1c, 'a', 'b', 'c', 'd', 'e', 'f', 'g', 'h', 0xfe, 0x8, 0x0, 0xfe, 0x8, 0x0, 0xfe, 0x8, 0x0, 0xfe, 0x8, 0x0, 0xde, 0x8, 0x0}
+	decoded, err := snappyDecode(reference)
+	if err != nil || !bytes.Equal(decoded, bytes.Repeat([]byte("abcdefgh"), 40)) {
+		t.Errorf("expected abcdefgh repeated 40 times, but got %q, %v", decoded, err)
+	}
+	decoded, err = snappyDecode([]byte{0x0c, 0x0c, 'a', 'b', 'c', 'd', 0x11, 0x04})
+	if err != nil || string(decoded) != "abcdabcdabcd" {
+		t.Errorf("expected abcdabcdabcd, but got %q, %v", decoded, err)
+	}
+	t.Log("The blocks of other encoders are decoded")
+
+	encoded := snappyEncode(inputs[3])
+	for n := 0; n < len(encoded); n += 97 {
+		if _, err := snappyDecode(encoded[:n]); err == nil {
+			t.Fatalf("expected an error for the block truncated to %d bytes", n)
+		}
+	}
+	t.Log("The truncated blocks are rejected")
+}
@@ -0,0 +1,50 @@
+package monitoring
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// TextfileSink writes the gauges of the latest record into a *.prom file in Dir, the directory of the textfile
+// collector of node_exporter, so the job is scraped by the node_exporter of the node without a port opened in the
+// job container. The file is replaced atomically by a temporary file not matching *.prom, and removed on Close
+// since the collector keeps exporting the file of a finished job otherwise.
+type TextfileSink struct {
+	Dir    string
+	Labels map[string]string
+
+	path string
+}
+
+var textfileNamePattern = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+
+// NewTextfileSink writes primehub-job-<job>.prom in dir, the samples are labeled by labels, e.g., phjob_name and pod
+func NewTextfileSink(dir string, job string, labels map[string]string) *TextfileSink {
+	name := "primehub-job-" + textfileNamePattern.ReplaceAllString(job, "_") + ".prom"
+	return &TextfileSink{Dir: dir, Labels: labels, path: filepath.Join(dir, name)}
+}
+
+func (s *TextfileSink) Name() string {
+	return "textfile"
+}
+
+// Path returns the path of the file written
+func (s *TextfileSink) Path() string {
+	return s.path
+}
+
+func (s *TextfileSink) Write(report Monitoring) error {
+	x := &exposition{constLabels: renderLabels(s.Labels)}
+	for _, family := range reportFamilies(report) {
+		x.write(family)
+	}
+	return WriteFileAtomic(s.path, x.buf.Bytes(), 0644)
+}
+
+func (s *TextfileSink) Close() error {
+	if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package monitoring
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTextfileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "textfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	t.Log("Give a job name with a slash, labeled by the job and the pod")
+	metrics, _ := NewMetricsWithTiers([]TierConfig{{Name: "fine", Resolution: 10 * time.Second, Retention: time.Hour}})
+	metrics.Add(Record{
+		Timestamp:     1000000000,
+		CpuMillicores: 1500,
+		MemoryUsed:    1 << 30,
+		GPURecords:    []GPURecord{{Index: 0, GPUUtilizationMilli: 42500}},
+	})
+	spec := Spec{MemoryTotal: 4 << 30, GPUSpec: []GPUSpec{{Index: 0, UUID: "GPU-0", MemoryTotal: 16 << 30}}}
+	sink := NewTextfileSink(dir, "job/a", map[string]string{"phjob_name": "job/a", "pod": "job-a-xyz"})
+	if err := sink.Write(NewMonitoring(spec, metrics.Snapshot())); err != nil {
+		t.Fatal(err)
+	}
+
+	if sink.Path() != filepath.Join(dir, "primehub-job-job_a.prom") {
+		t.Fatalf("expected the job name sanitized in the file name, but got %s", sink.Path())
+	}
+	data, err := ioutil.ReadFile(sink.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"# TYPE primehub_job_cpu_usage_cores gauge\n",
+		`primehub_job_cpu_usage_cores{phjob_name="job/a",pod="job-a-xyz"} 1.5` + "\n",
+		`primehub_job_memory_limit_bytes{phjob_name="job/a",pod="job-a-xyz"} 4294967296` + "\n",
+		`primehub_job_gpu_utilization_percent{phjob_name="job/a",pod="job-a-xyz",index="0",uuid="GPU-0"} 42.5` + "\n",
+	} {
+		if !strings.Contains(string(data), expected) {
+			t.Errorf("expected %q in\n%s", expected, data)
+		}
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("expected only the prom file left, but got %d files", len(files))
+	}
+	t.Log("The gauges of the latest record are written with the labels")
+
+	t.Log("Give the sink closed")
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(sink.Path()); !os.IsNotExist(err) {
+		t.Errorf("expected the file removed, but got %v", err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Errorf("expected closing twice ok, but got %v", err)
+	}
+	t.Log("The file is removed so the collector stops exporting the finished job")
+}
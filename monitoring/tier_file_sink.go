@@ -0,0 +1,227 @@
+package monitoring
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+const (
+	tierSpecFile = "spec.json"
+
+	// an append-only tier file is rewritten once it holds more lines than the ratio of the tier capacity
+	appendRewriteRatio = 2
+)
+
+// TierFileSink writes each tier to its own file in Dir and skips the tiers unchanged since the last write.
+// The records are encoded one by one into the file instead of building the whole document in memory.
+//
+// The layout of Dir:
+//
+//	spec.json      the spec and the tiers of the report
+//	<tier>.json    the records of the tier as a JSON array
+//	<tier>.jsonl   the records of an append-only tier, one JSON record per line
+type TierFileSink struct {
+	// the bytes written, first for the 64-bit alignment of atomic
+	written int64
+
+	Dir string
+
+	// the tiers written as append-only JSON lines, the new records are appended instead of rewriting the file
+	Append map[string]bool
+
+	spec   []byte
+	states map[string]tierFileState
+}
+
+// tierFileState identifies the records of a tier written last time, the records are never modified once added
+type tierFileState struct {
+	interval int
+	count    int
+	first    int64
+	last     int64
+
+	// lines of the append-only file
+	lines int
+}
+
+func NewTierFileSink(dir string, appendTiers ...string) *TierFileSink {
+	s := &TierFileSink{Dir: dir, Append: make(map[string]bool), states: make(map[string]tierFileState)}
+	for _, name := range appendTiers {
+		s.Append[name] = true
+	}
+	return s
+}
+
+func (s *TierFileSink) Name() string {
+	return "tiers"
+}
+
+func (s *TierFileSink) Write(report Monitoring) error {
+	// the parent should exist, e.g., the mounted phfs
+	if err := os.Mkdir(s.Dir, 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+
+	spec, err := json.Marshal(struct {
+		Spec  Spec       `json:"spec"`
+		Tiers []TierSpec `json:"tiers"`
+	}{report.Spec, report.Tiers})
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(spec, s.spec) {
+		if err := s.writeFile(tierSpecFile, func(w io.Writer) error {
+			_, err := w.Write(spec)
+			return err
+		}); err != nil {
+			return err
+		}
+		s.spec = spec
+	}
+
+	for _, tier := range report.Tiers {
+		records := report.Datasets[tier.Name]
+		state := newTierFileState(tier, records)
+		last, ok := s.states[tier.Name]
+		if ok && last.unchanged(state) {
+			continue
+		}
+
+		if s.Append[tier.Name] {
+			err = s.appendTier(tier, records, state, last, ok)
+		} else {
+			err = s.writeFile(tier.Name+".json", func(w io.Writer) error {
+				return encodeRecords(w, records)
+			})
+		}
+		if err != nil {
+			// write the tier again next time
+			delete(s.states, tier.Name)
+			return err
+		}
+		if !s.Append[tier.Name] {
+			s.states[tier.Name] = state
+		}
+	}
+	return nil
+}
+
+// appendTier appends the records after the last written one, the file is rewritten
+// if the resolution is changed, the records are restored or the file grows too long
+func (s *TierFileSink) appendTier(tier TierSpec, records []Record, state tierFileState, last tierFileState, ok bool) error {
+	filename := tier.Name + ".jsonl"
+	from := 0
+	if ok && last.interval == state.interval && last.last <= state.last {
+		for from < len(records) && records[from].Timestamp <= last.last {
+			from++
+		}
+	}
+
+	if from == 0 || last.lines+len(records)-from > appendRewriteRatio*tier.Capacity {
+		state.lines = len(records)
+		s.states[tier.Name] = state
+		return s.writeFile(filename, func(w io.Writer) error {
+			return encodeLines(w, records)
+		})
+	}
+
+	f, err := os.OpenFile(filepath.Join(s.Dir, filename), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	counter := &countingWriter{w: f}
+	if err := encodeLines(counter, records[from:]); err != nil {
+		f.Close()
+		return err
+	}
+	atomic.AddInt64(&s.written, counter.n)
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	state.lines = last.lines + len(records) - from
+	s.states[tier.Name] = state
+	return nil
+}
+
+func (s *TierFileSink) writeFile(name string, write func(w io.Writer) error) error {
+	return WriteFileAtomicFunc(filepath.Join(s.Dir, name), 0644, func(w io.Writer) error {
+		counter := &countingWriter{w: w}
+		err := write(counter)
+		atomic.AddInt64(&s.written, counter.n)
+		return err
+	})
+}
+
+// Written returns the bytes written
+func (s *TierFileSink) Written() int64 {
+	return atomic.LoadInt64(&s.written)
+}
+
+func (s *TierFileSink) Close() error {
+	return nil
+}
+
+func newTierFileState(tier TierSpec, records []Record) tierFileState {
+	state := tierFileState{interval: tier.Interval, count: len(records)}
+	if len(records) > 0 {
+		state.first = records[0].Timestamp
+		state.last = records[len(records)-1].Timestamp
+	}
+	return state
+}
+
+func (s tierFileState) unchanged(other tierFileState) bool {
+	return s.interval == other.interval && s.count == other.count && s.first == other.first && s.last == other.last
+}
+
+var jsonArrayStart, jsonComma, jsonArrayEnd = []byte("["), []byte(","), []byte("]")
+
+// encodeRecords writes the records as a JSON array, one record at a time
+func encodeRecords(w io.Writer, records []Record) error {
+	if _, err := w.Write(jsonArrayStart); err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(w)
+	for i := range records {
+		if i > 0 {
+			if _, err := w.Write(jsonComma); err != nil {
+				return err
+			}
+		}
+		if err := encoder.Encode(&records[i]); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(jsonArrayEnd)
+	return err
+}
+
+// encodeLines writes the records as JSON lines
+func encodeLines(w io.Writer, records []Record) error {
+	encoder := json.NewEncoder(w)
+	for i := range records {
+		if err := encoder.Encode(&records[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
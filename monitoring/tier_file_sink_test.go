@@ -0,0 +1,154 @@
+package monitoring
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestReport(metrics *Metrics) Monitoring {
+	return NewMonitoring(Spec{MemoryTotal: 100}, metrics.Snapshot())
+}
+
+func readLines(t *testing.T, filename string) []Record {
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	records := make([]Record, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		r := Record{}
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestTierFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tiers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	t.Log("Give a fine tier written as append-only lines and a coarse tier")
+	metrics, _ := NewMetricsWithTiers([]TierConfig{
+		{Name: "fine", Resolution: 10 * time.Second, Retention: 40 * time.Second},
+		{Name: "coarse", Resolution: 30 * time.Second, Retention: time.Hour},
+	})
+	sink := NewTierFileSink(dir, "fine")
+	base := int64(1000000020)
+	for i := int64(0); i < 3; i++ {
+		metrics.Add(Record{Timestamp: base + i*10, MemoryUsed: i})
+	}
+	if err := sink.Write(newTestReport(metrics)); err != nil {
+		t.Fatal(err)
+	}
+
+	coarse := make([]Record, 0)
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "coarse.json"))
+	if err := json.Unmarshal(data, &coarse); err != nil || len(coarse) != 0 {
+		t.Errorf("expected an empty coarse tier, but got %s: %v", data, err)
+	}
+	if lines := readLines(t, filepath.Join(dir, "fine.jsonl")); len(lines) != 3 {
+		t.Errorf("expected 3 lines, but got %v", lines)
+	}
+	if _, err := os.Stat(filepath.Join(dir, tierSpecFile)); err != nil {
+		t.Error(err)
+	}
+	t.Log("Each tier is written to its own file with the spec")
+
+	written := sink.Written()
+	if err := sink.Write(newTestReport(metrics)); err != nil || sink.Written() != written {
+		t.Errorf("expected nothing written for the unchanged tiers, but got %d bytes: %v", sink.Written()-written, err)
+	}
+	t.Log("The unchanged tiers are skipped")
+
+	metrics.Add(Record{Timestamp: base + 30, MemoryUsed: 3})
+	if err := sink.Write(newTestReport(metrics)); err != nil {
+		t.Fatal(err)
+	}
+	if lines := readLines(t, filepath.Join(dir, "fine.jsonl")); len(lines) != 4 || lines[3].MemoryUsed != 3 {
+		t.Errorf("expected the new record appended, but got %v", lines)
+	}
+	data, _ = ioutil.ReadFile(filepath.Join(dir, "coarse.json"))
+	if err := json.Unmarshal(data, &coarse); err != nil || len(coarse) != 1 || coarse[0].Timestamp != base {
+		t.Errorf("expected the coarse point 1000000020, but got %s: %v", data, err)
+	}
+	t.Log("The new record is appended, and the changed coarse tier is rewritten")
+
+	t.Log("Give the append-only file growing over twice the capacity")
+	for i := int64(4); i < 9; i++ {
+		metrics.Add(Record{Timestamp: base + i*10, MemoryUsed: i})
+		if err := sink.Write(newTestReport(metrics)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if lines := readLines(t, filepath.Join(dir, "fine.jsonl")); len(lines) > 8 || lines[len(lines)-1].MemoryUsed != 8 {
+		t.Errorf("expected the file rewritten within 8 lines, but got %v", lines)
+	}
+	t.Log("The append-only file is rewritten with the available records")
+}
+
+// flush 100 times with a new record each time, as the agent does every 10 seconds
+func benchmarkFlush(b *testing.B, newSink func(dir string) Sink) {
+	dir, err := ioutil.TempDir("", "flush")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	metrics := NewMetrics(8064)
+	base := int64(1000000020)
+	gpuRecords := newTestGPURecords(8, 1)
+	for i := int64(0); i < 8064*30; i++ {
+		metrics.Add(Record{Timestamp: base + i*10, GPURecords: gpuRecords})
+	}
+	base += 8064 * 30 * 10
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		sink := newSink(dir)
+		for i := int64(0); i < 100; i++ {
+			metrics.Add(Record{Timestamp: base, GPURecords: gpuRecords})
+			base += 10
+			if err := sink.Write(newTestReport(metrics)); err != nil {
+				b.Fatal(err)
+			}
+		}
+		switch s := sink.(type) {
+		case *FileSink:
+			b.Logf("%d bytes written in 100 flushes", s.Written())
+		case *TierFileSink:
+			b.Logf("%d bytes written in 100 flushes", s.Written())
+		}
+	}
+}
+
+func BenchmarkFlushFile(b *testing.B) {
+	benchmarkFlush(b, func(dir string) Sink {
+		return NewFileSink(filepath.Join(dir, "monitoring"))
+	})
+}
+
+func BenchmarkFlushTierFiles(b *testing.B) {
+	benchmarkFlush(b, func(dir string) Sink {
+		return NewTierFileSink(dir)
+	})
+}
+
+func BenchmarkFlushTierFilesAppend(b *testing.B) {
+	benchmarkFlush(b, func(dir string) Sink {
+		return NewTierFileSink(dir, "15m")
+	})
+}
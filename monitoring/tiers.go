@@ -0,0 +1,172 @@
+package monitoring
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TierConfig defines a buffer of the metrics, the capacity is Retention / Resolution
+type TierConfig struct {
+	Name       string
+	Resolution time.Duration
+	Retention  time.Duration
+
+	// Adaptive halves the resolution instead of dropping the oldest points when the tier is full
+	Adaptive bool
+}
+
+// TierSpec is the metadata of a tier in the output, the Interval is the resolution in effect
+type TierSpec struct {
+	Name     string `json:"name"`
+	Interval int    `json:"interval"`
+	Capacity int    `json:"capacity"`
+	Adaptive bool   `json:"adaptive,omitempty"`
+
+	// Retention is the seconds the tier holds when full, and Source is the tier it is aggregated from
+	Retention int    `json:"retention"`
+	Source    string `json:"source,omitempty"`
+}
+
+func (t TierConfig) Capacity() int {
+	return int(t.Retention / t.Resolution)
+}
+
+func (t TierConfig) String() string {
+	if t.Adaptive {
+		return fmt.Sprintf("%s=%v/%v/adaptive", t.Name, t.Resolution, t.Retention)
+	}
+	return fmt.Sprintf("%s=%v/%v", t.Name, t.Resolution, t.Retention)
+}
+
+func DefaultTiers(lifetimeMax int) []TierConfig {
+	return []TierConfig{
+		// 15m: 10s → 15 * 60 / 10 = 90 points
+		{Name: "15m", Resolution: 10 * time.Second, Retention: 15 * time.Minute},
+		// 1h: 30s → 60 * 60 / 30 = 120 points
+		{Name: "1h", Resolution: 30 * time.Second, Retention: time.Hour},
+		// 3h: 2m → 3 * 60 * 60 / 120 = 90 points
+		{Name: "3h", Resolution: 2 * time.Minute, Retention: 3 * time.Hour},
+		// 4 week: 5m → 4 * 7 * 24 * 60 * 60 / 300 = 8064 points
+		{Name: "lifetime", Resolution: 5 * time.Minute, Retention: time.Duration(lifetimeMax) * 5 * time.Minute},
+	}
+}
+
+// DefaultTiersAt returns the default tiers with the finest one at the resolution of the updates.
+// The coarser tiers are dropped unless their resolution is a coarser multiple of it,
+// except the lifetime tier, whose resolution is rounded up to one.
+func DefaultTiersAt(lifetimeMax int, resolution time.Duration) []TierConfig {
+	defaults := DefaultTiers(lifetimeMax)
+	finest := defaults[0]
+	finest.Resolution = resolution
+	tiers := []TierConfig{finest}
+	for i, tier := range defaults[1:] {
+		if tier.Resolution > resolution && tier.Resolution%resolution == 0 {
+			tiers = append(tiers, tier)
+			continue
+		}
+		if i == len(defaults)-2 && resolution > 0 {
+			points := tier.Capacity()
+			tier.Resolution = (tier.Resolution/resolution + 1) * resolution
+			tier.Retention = time.Duration(points) * tier.Resolution
+			tiers = append(tiers, tier)
+		}
+	}
+	return tiers
+}
+
+// ParseTiers parses tiers like "15m=10s/15m,1h=30s/1h,lifetime=1h/1w/adaptive",
+// the durations accept the "d" and "w" units in addition to the ones of time.ParseDuration
+func ParseTiers(value string) ([]TierConfig, error) {
+	tiers := make([]TierConfig, 0)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid tier %q, should be name=resolution/retention", item)
+		}
+		durations := strings.Split(kv[1], "/")
+		if len(durations) != 2 && (len(durations) != 3 || strings.TrimSpace(durations[2]) != "adaptive") {
+			return nil, fmt.Errorf("invalid tier %q, should be name=resolution/retention[/adaptive]", item)
+		}
+
+		resolution, err := parseTierDuration(durations[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid resolution of tier %q: %v", item, err)
+		}
+		retention, err := parseTierDuration(durations[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid retention of tier %q: %v", item, err)
+		}
+		tiers = append(tiers, TierConfig{
+			Name:       strings.TrimSpace(kv[0]),
+			Resolution: resolution,
+			Retention:  retention,
+			Adaptive:   len(durations) == 3,
+		})
+	}
+
+	if err := ValidateTiers(tiers); err != nil {
+		return nil, err
+	}
+	return tiers, nil
+}
+
+func parseTierDuration(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	units := map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour}
+	for suffix, unit := range units {
+		if strings.HasSuffix(value, suffix) {
+			n, err := strconv.Atoi(strings.TrimSuffix(value, suffix))
+			if err != nil {
+				return 0, err
+			}
+			return time.Duration(n) * unit, nil
+		}
+	}
+	return time.ParseDuration(value)
+}
+
+// ValidateTiers checks the tiers are ordered from the finest resolution,
+// and each resolution is a multiple of the finest one in whole seconds
+func ValidateTiers(tiers []TierConfig) error {
+	if len(tiers) == 0 {
+		return fmt.Errorf("at least one tier is required")
+	}
+
+	names := make(map[string]bool)
+	for i, tier := range tiers {
+		if tier.Name == "" {
+			return fmt.Errorf("tier %d has no name", i)
+		}
+		if names[tier.Name] {
+			return fmt.Errorf("duplicated tier %s", tier.Name)
+		}
+		names[tier.Name] = true
+
+		if tier.Resolution < time.Second || tier.Resolution%time.Second != 0 {
+			return fmt.Errorf("resolution of tier %s should be whole seconds", tier.Name)
+		}
+		if tier.Capacity() < 1 {
+			return fmt.Errorf("retention of tier %s should not be shorter than the resolution", tier.Name)
+		}
+		if tier.Adaptive && (i != len(tiers)-1 || i == 0 || tier.Capacity() < 2) {
+			return fmt.Errorf("adaptive tier %s should be the coarsest one with at least 2 points", tier.Name)
+		}
+		if i == 0 {
+			continue
+		}
+		if tier.Resolution <= tiers[i-1].Resolution {
+			return fmt.Errorf("resolution of tier %s should be coarser than tier %s", tier.Name, tiers[i-1].Name)
+		}
+		if tier.Resolution%tiers[0].Resolution != 0 {
+			return fmt.Errorf("resolution of tier %s should be a multiple of tier %s", tier.Name, tiers[0].Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+package monitoring
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTiers(t *testing.T) {
+	t.Log("Give tiers 1s for 1m, 1m for 1d and 1h for 2w")
+	tiers, err := ParseTiers("1s=1s/1m, 1d=1m/1d, 2w=1h/2w")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []TierConfig{
+		{Name: "1s", Resolution: time.Second, Retention: time.Minute},
+		{Name: "1d", Resolution: time.Minute, Retention: 24 * time.Hour},
+		{Name: "2w", Resolution: time.Hour, Retention: 14 * 24 * time.Hour},
+	}
+	for i := range expected {
+		if tiers[i] != expected[i] {
+			t.Errorf("expected %v, but got %v", expected[i], tiers[i])
+		}
+	}
+	if tiers[2].Capacity() != 336 {
+		t.Errorf("capacity of 2w should be 336, but got %d", tiers[2].Capacity())
+	}
+	t.Log("The tiers are parsed with d and w units")
+
+	for _, invalid := range []string{
+		"",
+		"15m=10s",
+		"15m=10s/15m,1h=5s/1h",
+		"15m=10s/15m,1h=15s/1h",
+		"15m=10s/15m,15m=30s/1h",
+		"15m=500ms/15m",
+		"15m=10s/5s",
+	} {
+		if _, err := ParseTiers(invalid); err == nil {
+			t.Errorf("%q should be invalid", invalid)
+		}
+	}
+}
+
+func TestNewMetricsWithTiers(t *testing.T) {
+	t.Log("Give the default tiers")
+	metrics := NewMetrics(8064)
+
+	specs := metrics.TierSpecs()
+	expected := []TierSpec{
+		{Name: "15m", Interval: 10, Capacity: 90, Retention: 900},
+		{Name: "1h", Interval: 30, Capacity: 120, Retention: 3600, Source: "15m"},
+		{Name: "3h", Interval: 120, Capacity: 90, Retention: 10800, Source: "15m"},
+		{Name: "lifetime", Interval: 300, Capacity: 8064, Retention: 2419200, Source: "15m"},
+	}
+	for i := range expected {
+		if specs[i] != expected[i] {
+			t.Errorf("expected %v, but got %v", expected[i], specs[i])
+		}
+	}
+	if metrics.Tier("lifetime").Source != metrics.Tier("15m") || metrics.Tier("lifetime").AverageByLast != 30 {
+		t.Error("lifetime should be aggregated from 30 points of 15m")
+	}
+	t.Log("The tiers keep the hard-coded layout")
+
+	t.Log("Give a 1d tier which cannot be aggregated from the 15m tier")
+	tiers := append(DefaultTiers(8064), TierConfig{Name: "year", Resolution: 24 * time.Hour, Retention: 365 * 24 * time.Hour})
+	metrics, err := NewMetricsWithTiers(tiers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metrics.Tier("year").Source != metrics.Tier("lifetime") || metrics.Tier("year").AverageByLast != 288 {
+		t.Error("year should be aggregated from 288 points of lifetime")
+	}
+	t.Log("The year tier is aggregated from the lifetime tier")
+
+	t.Log("Give a 1d tier without any tier holding a day")
+	_, err = NewMetricsWithTiers([]TierConfig{
+		{Name: "1m", Resolution: time.Second, Retention: time.Minute},
+		{Name: "1d", Resolution: 24 * time.Hour, Retention: 7 * 24 * time.Hour},
+	})
+	if err == nil {
+		t.Error("the tiers should be invalid")
+	}
+}
+
+func TestDefaultTiersAt(t *testing.T) {
+	t.Log("Give the updates every 10s")
+	tiers := DefaultTiersAt(8064, 10*time.Second)
+	if !reflect.DeepEqual(tiers, DefaultTiers(8064)) {
+		t.Errorf("expected the default tiers, but got %v", tiers)
+	}
+
+	t.Log("Give the updates every 60s")
+	tiers = DefaultTiersAt(8064, time.Minute)
+	expected := []TierConfig{
+		{Name: "15m", Resolution: time.Minute, Retention: 15 * time.Minute},
+		{Name: "3h", Resolution: 2 * time.Minute, Retention: 3 * time.Hour},
+		{Name: "lifetime", Resolution: 5 * time.Minute, Retention: 8064 * 5 * time.Minute},
+	}
+	if !reflect.DeepEqual(tiers, expected) {
+		t.Errorf("expected %v, but got %v", expected, tiers)
+	}
+	t.Log("The 1h tier finer than the updates is dropped")
+
+	t.Log("Give the updates every 7s")
+	tiers = DefaultTiersAt(8064, 7*time.Second)
+	if len(tiers) != 2 || tiers[1].Name != "lifetime" || tiers[1].Resolution != 301*time.Second || tiers[1].Capacity() != 8064 {
+		t.Errorf("unexpected tiers %v", tiers)
+	}
+	if err := ValidateTiers(tiers); err != nil {
+		t.Error(err)
+	}
+	t.Log("The lifetime resolution is rounded up to a multiple of 7s, keeping the points")
+}
+
+func TestMetricsDatasets(t *testing.T) {
+	metrics, _ := NewMetricsWithTiers([]TierConfig{
+		{Name: "fine", Resolution: time.Second, Retention: 3 * time.Second},
+		{Name: "coarse", Resolution: 2 * time.Second, Retention: 10 * time.Second},
+	})
+	for i := 0; i < 5; i++ {
+		metrics.Add(Record{Timestamp: int64(i), MemoryUsed: int64(i)})
+	}
+
+	datasets := metrics.Datasets()
+	if len(datasets) != 2 || len(datasets["fine"]) != 3 || len(datasets["coarse"]) != 2 {
+		t.Fatalf("unexpected datasets %v", datasets)
+	}
+	if datasets["fine"][0].Timestamp != 2 || datasets["coarse"][1].Timestamp != 2 || datasets["coarse"][1].MemoryUsed != 3 {
+		t.Errorf("unexpected datasets %v", datasets)
+	}
+}
+
+func TestTimeAlignedDownsampling(t *testing.T) {
+	t.Log("Give jittery samples around 10s, starting 3s before the aligned time 1000000020")
+	metrics, _ := NewMetricsWithTiers([]TierConfig{
+		{Name: "10s", Resolution: 10 * time.Second, Retention: 15 * time.Minute},
+		{Name: "30s", Resolution: 30 * time.Second, Retention: time.Hour},
+	})
+	base := int64(1000000020)
+	for _, offset := range []int64{-3, 9, 21, 24, 33, 46, 52, 57, 69} {
+		metrics.Add(Record{Timestamp: base + offset, CpuUtilization: int(offset)})
+	}
+
+	points := metrics.Tier("30s").LastAvailable()
+	if len(points) != 3 {
+		t.Fatalf("expected 3 closed buckets, but got %v", points)
+	}
+	t.Log("The bucket starting at 1000000080 is still open")
+
+	if points[0].Timestamp != base-30 {
+		t.Errorf("expected the partial bucket 999999990, but got %+v", points[0])
+	}
+	if points[1].Timestamp != base || points[1].CpuUtilization != 18 {
+		t.Errorf("expected bucket 1000000020 with mean cpu of 9, 21, 24, but got %+v", points[1])
+	}
+	if points[2].Timestamp != base+30 || points[2].CpuUtilization != 47 {
+		t.Errorf("expected bucket 1000000050 with mean cpu of 33, 46, 52, 57, but got %+v", points[2])
+	}
+	t.Log("The points are aligned to :20 and :50 of the wall clock, using the samples in the bucket")
+}
+
+func TestGapMarkers(t *testing.T) {
+	t.Log("Give samples every 10s with a pause between 1000000050 and 1000000200")
+	metrics, _ := NewMetricsWithTiers([]TierConfig{
+		{Name: "10s", Resolution: 10 * time.Second, Retention: 15 * time.Minute},
+		{Name: "30s", Resolution: 30 * time.Second, Retention: time.Hour},
+	})
+	for _, timestamp := range []int64{1000000020, 1000000030, 1000000040, 1000000050, 1000000200, 1000000210} {
+		metrics.Add(Record{Timestamp: timestamp, MemoryUsed: 100})
+	}
+
+	raw := metrics.Tier("10s").LastAvailable()
+	if len(raw) != 7 || !raw[4].Gap || raw[4].Timestamp != 1000000060 {
+		t.Fatalf("expected a gap at 1000000060 in the raw samples, but got %v", raw)
+	}
+	t.Log("A gap marker is added after the last sample before the pause")
+
+	points := metrics.Tier("30s").LastAvailable()
+	if len(points) != 3 {
+		t.Fatalf("expected 3 points, but got %v", points)
+	}
+	if points[0].Timestamp != 1000000020 || points[0].Samples != 3 {
+		t.Errorf("expected 3 samples in bucket 1000000020, but got %+v", points[0])
+	}
+	if points[1].Timestamp != 1000000050 || points[1].Samples != 1 || points[1].Gap {
+		t.Errorf("expected 1 sample in bucket 1000000050, but got %+v", points[1])
+	}
+	if points[2].Timestamp != 1000000080 || !points[2].Gap {
+		t.Errorf("expected a gap from 1000000080, but got %+v", points[2])
+	}
+	t.Log("The downsampled points carry the sample counts, and the empty buckets are marked as a gap")
+
+	t.Log("Give a collector failure")
+	metrics.AddGap(1000000220)
+	metrics.AddGap(1000000230)
+	raw = metrics.Tier("10s").LastAvailable()
+	if len(raw) != 8 || !raw[7].Gap {
+		t.Errorf("expected a single gap marker, but got %v", raw)
+	}
+
+	for _, gap := range []Record{raw[7], points[2]} {
+		data, _ := json.Marshal(gap)
+		if !strings.Contains(string(data), `"GPU":[]`) {
+			t.Errorf("expected an empty GPU array of the gap, but got %s", data)
+		}
+	}
+	t.Log("The gaps have an empty GPU array for the readers iterating it")
+}
+
+func TestMetricsConcurrentSnapshot(t *testing.T) {
+	t.Log("Give samples added while the snapshots and checkpoints are read in parallel")
+	metrics, _ := NewMetricsWithTiers([]TierConfig{
+		{Name: "fine", Resolution: time.Second, Retention: 10 * time.Second},
+		{Name: "coarse", Resolution: 2 * time.Second, Retention: 10 * time.Second},
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			metrics.Add(Record{Timestamp: int64(i), MemoryUsed: int64(i)})
+		}
+	}()
+
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		snapshot := metrics.Snapshot()
+		fine := snapshot.Datasets["fine"]
+		coarse := snapshot.Datasets["coarse"]
+		if len(fine) == 0 || len(coarse) == 0 {
+			continue
+		}
+		if latest := fine[len(fine)-1].Timestamp; coarse[len(coarse)-1].Timestamp > latest-2 {
+			t.Fatalf("the coarse tier is ahead of the fine tier %d: %v", latest, coarse)
+		}
+		metrics.Checkpoint()
+	}
+	t.Log("Every snapshot is consistent across the tiers")
+}
@@ -1,8 +1,17 @@
 package monitoring
 
 type GPUSpec struct {
-	Index       int   `json:"index"`
-	MemoryTotal int64 `json:"mem_total"`
+	Index       int    `json:"index"`
+	UUID        string `json:"uuid,omitempty"`
+	MemoryTotal int64  `json:"mem_total"`
+
+	// set when the device is a MIG slice of the parent gpu
+	MIG         bool   `json:"mig,omitempty"`
+	ParentUUID  string `json:"parent_uuid,omitempty"`
+	MigInstance string `json:"mig_instance,omitempty"`
+
+	// the gpu_util of the device is always 0, e.g., MIG devices
+	UtilizationUnsupported bool `json:"gpu_util_unsupported,omitempty"`
 }
 
 type Spec struct {
@@ -11,9 +20,19 @@ type Spec struct {
 }
 
 type GPURecord struct {
-	Index          int   `json:"index"`
-	MemoryUsed     int64 `json:"mem_used"`
-	GPUUtilization int   `json:"gpu_util"`
+	Index             int   `json:"index"`
+	MemoryUsed        int64 `json:"mem_used"`
+	GPUUtilization    int   `json:"gpu_util"`
+	GPUUtilizationMax int   `json:"gpu_util_max"`
+	Power             int64 `json:"power,omitempty"`
+	Temperature       int   `json:"temperature,omitempty"`
+
+	// gpu_util in thousandths of a percent, gpu_util is kept rounded to a percent for the existing readers
+	GPUUtilizationMilli int64 `json:"gpu_util_milli"`
+
+	// set on downsampled points when the envelopes are enabled
+	GPUUtilizationEnvelope *Envelope `json:"gpu_util_envelope,omitempty"`
+	MemoryEnvelope         *Envelope `json:"mem_used_envelope,omitempty"`
 }
 
 type Record struct {
@@ -21,16 +40,68 @@ type Record struct {
 	CpuUtilization int         `json:"cpu_util"`
 	MemoryUsed     int64       `json:"mem_used"`
 	GPURecords     []GPURecord `json:"GPU"`
+
+	// the cpu usage in millicores, 1000 for a fully used core,
+	// cpu_util is kept as the usage rounded to a percent of a core for the existing readers
+	CpuMillicores int64 `json:"cpu_millicores"`
+
+	// set on downsampled points when the envelopes are enabled
+	CpuEnvelope    *Envelope `json:"cpu_util_envelope,omitempty"`
+	MemoryEnvelope *Envelope `json:"mem_used_envelope,omitempty"`
+
+	// the number of raw samples merged into a downsampled point, 0 for a raw sample
+	Samples int `json:"samples,omitempty"`
+
+	// marks the start of an interval without samples, the other fields are zero and GPU is empty
+	Gap bool `json:"gap,omitempty"`
+}
+
+// MillicoresToPercent converts the cpu usage to the percent of a core
+func MillicoresToPercent(millicores int64) int {
+	return int(roundDiv(millicores, 10))
 }
 
-type Datasets struct {
-	FifteenMinutes []Record `json:"15m"`
-	OneHour        []Record `json:"1h"`
-	ThreeHours     []Record `json:"3h"`
-	LifeTime       []Record `json:"lifetime"`
+// UtilizationMilliToPercent converts the utilization in thousandths of a percent to a percent
+func UtilizationMilliToPercent(milli int64) int {
+	return int(roundDiv(milli, 1000))
 }
 
+// Millicores returns the cpu usage in millicores, falling back to cpu_util for the records written before cpu_millicores
+func (r Record) Millicores() int64 {
+	if r.CpuMillicores == 0 {
+		return int64(r.CpuUtilization) * 10
+	}
+	return r.CpuMillicores
+}
+
+// UtilizationMilli returns gpu_util in thousandths of a percent, falling back to gpu_util for the records written before gpu_util_milli
+func (g GPURecord) UtilizationMilli() int64 {
+	if g.GPUUtilizationMilli == 0 {
+		return int64(g.GPUUtilization) * 1000
+	}
+	return g.GPUUtilizationMilli
+}
+
+// NewGapRecord returns a gap with an empty GPU array rather than null, for the readers iterating it
+func NewGapRecord(timestamp int64) Record {
+	return Record{Timestamp: timestamp, GPURecords: []GPURecord{}, Gap: true}
+}
+
+// Datasets maps the tier name to its records, e.g., 15m, 1h, 3h and lifetime by default
+type Datasets map[string][]Record
+
+// SchemaVersion is the version of the Monitoring document, see schema/monitoring.schema.json.
+// The documents without a version are the legacy layout of version 1, read by ReadMonitoring.
+const SchemaVersion = 2
+
 type Monitoring struct {
-	Spec     Spec     `json:"spec"`
-	Datasets Datasets `json:"datasets"`
+	Version  int        `json:"version"`
+	Spec     Spec       `json:"spec"`
+	Tiers    []TierSpec `json:"tiers"`
+	Datasets Datasets   `json:"datasets"`
+}
+
+// NewMonitoring returns the document of the current version with the snapshot of the metrics
+func NewMonitoring(spec Spec, snapshot Snapshot) Monitoring {
+	return Monitoring{Version: SchemaVersion, Spec: spec, Tiers: snapshot.Tiers, Datasets: snapshot.Datasets}
 }
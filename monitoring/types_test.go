@@ -16,16 +16,19 @@ func TestJsonOutput(t *testing.T) {
 				},
 			},
 		},
+		Tiers: []TierSpec{
+			{Name: "15m", Interval: 10, Capacity: 90},
+		},
 		Datasets: Datasets{
-			FifteenMinutes: []Record{{
+			"15m": []Record{{
 				Timestamp:      123,
 				CpuUtilization: 0,
 				MemoryUsed:     0,
 				GPURecords:     nil,
 			}},
-			OneHour:    nil,
-			ThreeHours: nil,
-			LifeTime:   nil,
+			"1h":       nil,
+			"3h":       nil,
+			"lifetime": nil,
 		},
 	}
 	output, _ := json.Marshal(monitoring)
@@ -36,7 +39,7 @@ func TestJsonOutput(t *testing.T) {
 		panic(err)
 	}
 
-	if monitoring.Datasets.FifteenMinutes[0].Timestamp != restore.Datasets.FifteenMinutes[0].Timestamp {
+	if monitoring.Datasets["15m"][0].Timestamp != restore.Datasets["15m"][0].Timestamp {
 		t.Fatal("Json Output should be same with restored data")
 	}
 
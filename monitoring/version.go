@@ -26,7 +26,7 @@ type BuildInfo struct {
 	GoVersion    string
 }
 
-func GetVersion() string {
+func GetBuildInfo() BuildInfo {
 	info := BuildInfo{
 		Version:      version,
 		GitCommit:    gitCommit,
@@ -37,7 +37,10 @@ func GetVersion() string {
 	if tagVersion != "" {
 		info.Version = tagVersion
 	}
+	return info
+}
 
-	data, _ := json.Marshal(info)
+func GetVersion() string {
+	data, _ := json.Marshal(GetBuildInfo())
 	return fmt.Sprintf("version.BuildInfo%s", string(data))
 }
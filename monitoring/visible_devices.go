@@ -0,0 +1,162 @@
+package monitoring
+
+import (
+	"os"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	NvidiaVisibleDevicesEnv = "NVIDIA_VISIBLE_DEVICES"
+	CudaVisibleDevicesEnv   = "CUDA_VISIBLE_DEVICES"
+)
+
+// SelectVisibleDevices returns the positions of the devices visible to the job, in the order the job sees them.
+// The devices are the ones enumerated by the backend, where the Index is the physical index of the device.
+//
+// NVIDIA_VISIBLE_DEVICES is resolved first against the physical indices and UUIDs,
+// then CUDA_VISIBLE_DEVICES is resolved against the result as CUDA does.
+func SelectVisibleDevices(devices []GPUSpec) []int {
+	selected := make([]int, len(devices))
+	for i := range selected {
+		selected[i] = i
+	}
+
+	if value, ok := os.LookupEnv(NvidiaVisibleDevicesEnv); ok {
+		selected = selectNvidiaVisibleDevices(devices, selected, value)
+	}
+	if value, ok := os.LookupEnv(CudaVisibleDevicesEnv); ok {
+		selected = selectCudaVisibleDevices(devices, selected, value)
+	}
+	return selected
+}
+
+func selectNvidiaVisibleDevices(devices []GPUSpec, candidates []int, value string) []int {
+	// nvidia-container-runtime exposes no gpu for an empty value like "void"
+	value = strings.TrimSpace(value)
+	switch value {
+	case "all":
+		return candidates
+	case "", "none", "void":
+		return []int{}
+	}
+
+	selected := make([]int, 0)
+	for _, id := range splitVisibleDevices(value) {
+		positions := matchDevices(devices, candidates, id)
+		if len(positions) == 0 {
+			log.Warnf("%s: device %s is not found", NvidiaVisibleDevicesEnv, id)
+			continue
+		}
+		for _, p := range positions {
+			selected = appendUnique(selected, p)
+		}
+	}
+	return selected
+}
+
+// CUDA ignores the devices after the first invalid one
+func selectCudaVisibleDevices(devices []GPUSpec, candidates []int, value string) []int {
+	selected := make([]int, 0)
+	for _, id := range splitVisibleDevices(value) {
+		position := -1
+		if index, err := strconv.Atoi(id); err == nil {
+			if index >= 0 && index < len(candidates) {
+				position = candidates[index]
+			}
+		} else if strings.HasPrefix(id, "MIG-GPU-") {
+			if positions := matchDevices(devices, candidates, id); len(positions) == 1 {
+				position = positions[0]
+			}
+		} else {
+			position = findDeviceByUUIDPrefix(devices, candidates, id)
+		}
+
+		if position < 0 {
+			log.Debugf("%s: stop at invalid device %s", CudaVisibleDevicesEnv, id)
+			break
+		}
+		selected = appendUnique(selected, position)
+	}
+	return selected
+}
+
+// The identifier could be
+//
+//	<index>: the physical index of a gpu, which selects all MIG devices of a MIG-enabled gpu
+//	GPU-<uuid>: the uuid of a gpu, which selects all MIG devices of a MIG-enabled gpu
+//	MIG-<uuid>: the uuid of a MIG device
+//	MIG-GPU-<uuid>/<gi>/<ci>: a MIG device of the gpu, which resolves to the parent gpu if MIG devices are not enumerated
+func matchDevices(devices []GPUSpec, candidates []int, id string) []int {
+	positions := make([]int, 0)
+	index, indexErr := strconv.Atoi(id)
+
+	parentUUID, instance := "", ""
+	if strings.HasPrefix(id, "MIG-GPU-") {
+		parentUUID = strings.TrimPrefix(id, "MIG-")
+		if i := strings.Index(parentUUID, "/"); i >= 0 {
+			parentUUID, instance = parentUUID[:i], parentUUID[i+1:]
+		}
+	}
+
+	for _, p := range candidates {
+		d := devices[p]
+		switch {
+		case indexErr == nil:
+			if d.Index == index {
+				positions = append(positions, p)
+			}
+		case parentUUID != "":
+			if (d.MIG && d.ParentUUID == parentUUID && d.MigInstance == instance) || (!d.MIG && d.UUID == parentUUID) {
+				positions = append(positions, p)
+			}
+		case d.UUID != "" && d.UUID == id, d.MIG && d.ParentUUID == id:
+			positions = append(positions, p)
+		}
+	}
+	return positions
+}
+
+// CUDA accepts an unique prefix of the uuid
+func findDeviceByUUIDPrefix(devices []GPUSpec, candidates []int, id string) int {
+	found := -1
+	for _, p := range candidates {
+		uuid := devices[p].UUID
+		if uuid == "" {
+			continue
+		}
+		if uuid == id {
+			return p
+		}
+		if strings.HasPrefix(uuid, id) {
+			if found >= 0 {
+				// ambiguous prefix
+				return -1
+			}
+			found = p
+		}
+	}
+	return found
+}
+
+func splitVisibleDevices(value string) []string {
+	ids := make([]string, 0)
+	for _, id := range strings.Split(value, ",") {
+		id = strings.TrimSpace(id)
+		if id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func appendUnique(positions []int, position int) []int {
+	for _, p := range positions {
+		if p == position {
+			return positions
+		}
+	}
+	return append(positions, position)
+}
@@ -0,0 +1,99 @@
+package monitoring
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+var nodeDevices = []GPUSpec{
+	{Index: 0, UUID: "GPU-0a1b2c"},
+	{Index: 1, UUID: "GPU-1d2e3f"},
+	{Index: 2, UUID: "GPU-2a2a2a"},
+	{Index: 3, UUID: "GPU-3b3b3b"},
+}
+
+func withVisibleDevices(nvidia, cuda *string, fn func()) {
+	restore := func(key string, value *string) func() {
+		old, ok := os.LookupEnv(key)
+		if value == nil {
+			os.Unsetenv(key)
+		} else {
+			os.Setenv(key, *value)
+		}
+		return func() {
+			if ok {
+				os.Setenv(key, old)
+			} else {
+				os.Unsetenv(key)
+			}
+		}
+	}
+	defer restore(NvidiaVisibleDevicesEnv, nvidia)()
+	defer restore(CudaVisibleDevicesEnv, cuda)()
+	fn()
+}
+
+func env(value string) *string {
+	return &value
+}
+
+func TestSelectVisibleDevices(t *testing.T) {
+	cases := []struct {
+		name     string
+		nvidia   *string
+		cuda     *string
+		expected []int
+	}{
+		{"unset", nil, nil, []int{0, 1, 2, 3}},
+		{"all", env("all"), nil, []int{0, 1, 2, 3}},
+		{"none", env("none"), nil, []int{}},
+		{"void", env("void"), nil, []int{}},
+		{"empty", env(""), nil, []int{}},
+		{"blank", env(" "), nil, []int{}},
+		{"physical indices", env("3,1"), nil, []int{3, 1}},
+		{"uuids", env("GPU-2a2a2a,GPU-0a1b2c"), nil, []int{2, 0}},
+		{"mig identifier resolves to parent", env("MIG-GPU-1d2e3f/1/0"), nil, []int{1}},
+		{"unknown device is skipped", env("7,2"), nil, []int{2}},
+		{"cuda indices are relative", env("2,3"), env("1"), []int{3}},
+		{"cuda uuid prefix", nil, env("GPU-3b"), []int{3}},
+		{"cuda ambiguous prefix stops", nil, env("GPU-,1"), []int{}},
+		{"cuda stops at invalid device", nil, env("2,-1,0"), []int{2}},
+		{"cuda empty hides all devices", nil, env(""), []int{}},
+	}
+
+	migDevices := []GPUSpec{
+		{Index: 0, UUID: "GPU-0a1b2c"},
+		{Index: 1, UUID: "MIG-aaaa", MIG: true, ParentUUID: "GPU-1d2e3f", MigInstance: "1/0"},
+		{Index: 1, UUID: "MIG-bbbb", MIG: true, ParentUUID: "GPU-1d2e3f", MigInstance: "2/0"},
+	}
+	migCases := []struct {
+		name     string
+		nvidia   *string
+		cuda     *string
+		expected []int
+	}{
+		{"mig uuid", env("MIG-bbbb"), nil, []int{2}},
+		{"mig identifier", env("MIG-GPU-1d2e3f/1/0"), nil, []int{1}},
+		{"parent uuid selects all slices", env("GPU-1d2e3f"), nil, []int{1, 2}},
+		{"parent index selects all slices", env("1"), nil, []int{1, 2}},
+		{"cuda mig uuid", nil, env("MIG-aaaa"), []int{1}},
+	}
+	for _, c := range migCases {
+		withVisibleDevices(c.nvidia, c.cuda, func() {
+			selected := SelectVisibleDevices(migDevices)
+			if !reflect.DeepEqual(selected, c.expected) {
+				t.Errorf("%s: expected %v, but got %v", c.name, c.expected, selected)
+			}
+		})
+	}
+
+	for _, c := range cases {
+		withVisibleDevices(c.nvidia, c.cuda, func() {
+			selected := SelectVisibleDevices(nodeDevices)
+			if !reflect.DeepEqual(selected, c.expected) {
+				t.Errorf("%s: expected %v, but got %v", c.name, c.expected, selected)
+			}
+		})
+	}
+}